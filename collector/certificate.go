@@ -0,0 +1,212 @@
+// System Monitor Daemon - Collector - Certificate Check Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+//--------------------
+// CERTIFICATE CHECK
+//--------------------
+
+// CertificateCheck describes the check of a TLS certificate, either the
+// one served on a port or the one stored in a PEM file. Further
+// certificates in the file are used as intermediates. The server name is
+// the one the certificate has to be valid for, for ports it defaults to
+// the host of the address. The certificate chain is verified with the
+// CAs of the CA file, if set, otherwise with the ones of the system. The
+// check fails if the certificate expires in less than the minimum days.
+type CertificateCheck struct {
+	Address    string
+	File       string
+	ServerName string
+	CAFile     string
+	MinDays    int
+	Timeout    time.Duration
+}
+
+//--------------------
+// CERTIFICATE CHECK METER POINTS
+//--------------------
+
+// CertificateCheckMeterPoints inspect a TLS certificate. They return the
+// "subject", the "issuer", the expiry time as "not.after", and the days
+// until then as "expiry.days". "verified" is 1 if the certificate chain
+// is valid, "name.match" is 1 if the certificate is valid for the server
+// name. "success" is 1 if all is fine, otherwise 0. If the certificate
+// cannot be retrieved "error" contains the reason.
+type CertificateCheckMeterPoints struct {
+	id         string
+	address    string
+	file       string
+	serverName string
+	roots      *x509.CertPool
+	minDays    int
+	timeout    time.Duration
+}
+
+// NewCertificateCheckMeterPoints creates new meter points for a
+// certificate check.
+func NewCertificateCheckMeterPoints(id string, check CertificateCheck) (*CertificateCheckMeterPoints, error) {
+	if (check.Address == "") == (check.File == "") {
+		return nil, fmt.Errorf("certificate check needs either address or file")
+	}
+	cmp := &CertificateCheckMeterPoints{
+		id:         id,
+		address:    check.Address,
+		file:       check.File,
+		serverName: check.ServerName,
+		minDays:    check.MinDays,
+		timeout:    check.Timeout,
+	}
+	if check.Address != "" {
+		host, _, err := net.SplitHostPort(check.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate check address %q", check.Address)
+		}
+		if cmp.serverName == "" {
+			cmp.serverName = host
+		}
+	}
+	if cmp.timeout <= 0 {
+		cmp.timeout = 5 * time.Second
+	}
+	if check.CAFile != "" {
+		pem, err := os.ReadFile(check.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read certificate check CA file: %v", err)
+		}
+		cmp.roots = x509.NewCertPool()
+		if !cmp.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in certificate check CA file %q", check.CAFile)
+		}
+	}
+	return cmp, nil
+}
+
+// ID implements MeterPoints.
+func (cmp *CertificateCheckMeterPoints) ID() string {
+	return cmp.id
+}
+
+// Retrieve implements MeterPoints. Invalid certificates are no errors of
+// the meter points, they are reported by the "success" value.
+func (cmp *CertificateCheckMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	var certs []*x509.Certificate
+	var err error
+	if cmp.file != "" {
+		certs, err = readCertificates(cmp.file)
+	} else {
+		certs, err = cmp.fetch(ctx)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return Values{
+			"success": "0",
+			"error":   "error: " + err.Error(),
+		}, nil
+	}
+	cert := certs[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         cmp.roots,
+		Intermediates: intermediates,
+	})
+	verified := err == nil
+	days := expiryDays(cert.NotAfter)
+	success := verified && days >= cmp.minDays
+	values := Values{
+		"subject":     cert.Subject.String(),
+		"issuer":      cert.Issuer.String(),
+		"not.after":   cert.NotAfter.UTC().Format(time.RFC3339),
+		"expiry.days": strconv.Itoa(days),
+		"verified":    formatBool(verified),
+	}
+	if cmp.serverName != "" {
+		ok := cert.VerifyHostname(cmp.serverName) == nil
+		success = success && ok
+		values["name.match"] = formatBool(ok)
+	}
+	values["success"] = formatBool(success)
+	return values, nil
+}
+
+// fetch retrieves the certificates served on the port. They are verified
+// afterwards, so that invalid ones can be inspected too.
+func (cmp *CertificateCheckMeterPoints) fetch(ctx context.Context) ([]*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, cmp.timeout)
+	defer cancel()
+	dialer := tls.Dialer{
+		Config: &tls.Config{
+			ServerName:         cmp.serverName,
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", cmp.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates served")
+	}
+	return certs, nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// readCertificates reads the certificates of a PEM file.
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %q", file)
+	}
+	return certs, nil
+}
+
+// EOF
@@ -0,0 +1,269 @@
+// System Monitor Daemon - Collector - Certificate Check Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestCertificateCheckFile tests checking certificate files.
+func TestCertificateCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	valid := ca.issue(t, "valid.pem", "web1.example.com", time.Now().Add(30*24*time.Hour+time.Hour))
+	expired := ca.issue(t, "expired.pem", "web1.example.com", time.Now().Add(-47*time.Hour))
+
+	for i, test := range []struct {
+		check     collector.CertificateCheck
+		success   string
+		verified  string
+		nameMatch string
+		days      int
+	}{
+		{collector.CertificateCheck{File: valid, CAFile: ca.file}, "1", "1", "", 30},
+		{collector.CertificateCheck{File: valid, CAFile: ca.file, ServerName: "web1.example.com", MinDays: 14}, "1", "1", "1", 30},
+		{collector.CertificateCheck{File: valid, CAFile: ca.file, ServerName: "web2.example.com"}, "0", "1", "0", 30},
+		{collector.CertificateCheck{File: valid, CAFile: ca.file, MinDays: 60}, "0", "1", "", 30},
+		{collector.CertificateCheck{File: valid}, "0", "0", "", 30},
+		{collector.CertificateCheck{File: expired, CAFile: ca.file}, "0", "0", "", -2},
+	} {
+		cmp, err := collector.NewCertificateCheckMeterPoints("check.cert", test.check)
+		if err != nil {
+			t.Fatalf("%d: cannot create meter points: %v", i, err)
+		}
+		values, err := cmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if values["success"] != test.success || values["verified"] != test.verified ||
+			values["name.match"] != test.nameMatch || values["expiry.days"] != strconv.Itoa(test.days) ||
+			values["subject"] != "CN=web1.example.com" || values["issuer"] != "CN=Test CA" {
+			t.Errorf("%d: invalid values: %q", i, values)
+		}
+		if _, err := time.Parse(time.RFC3339, values["not.after"]); err != nil {
+			t.Errorf("%d: invalid expiry time: %q", i, values["not.after"])
+		}
+	}
+
+	// Missing file.
+	cmp, err := collector.NewCertificateCheckMeterPoints("check.cert", collector.CertificateCheck{
+		File: filepath.Join(dir, "missing.pem"),
+	})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err := cmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["success"] != "0" || !strings.HasPrefix(values["error"], "error: ") {
+		t.Errorf("invalid values: %q", values)
+	}
+}
+
+// TestCertificateCheckPort tests checking certificates served on ports.
+func TestCertificateCheckPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir)
+	certFile := ca.issue(t, "cert.pem", "localhost", time.Now().Add(90*24*time.Hour+time.Hour))
+	cert, err := tls.LoadX509KeyPair(certFile, certFile)
+	if err != nil {
+		t.Fatalf("cannot load certificate: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	for i, test := range []struct {
+		check     collector.CertificateCheck
+		success   string
+		nameMatch string
+	}{
+		{collector.CertificateCheck{Address: "localhost:" + port, CAFile: ca.file}, "1", "1"},
+		{collector.CertificateCheck{Address: l.Addr().String(), CAFile: ca.file}, "0", "0"},
+		{collector.CertificateCheck{Address: l.Addr().String(), CAFile: ca.file, ServerName: "localhost"}, "1", "1"},
+	} {
+		cmp, err := collector.NewCertificateCheckMeterPoints("check.cert", test.check)
+		if err != nil {
+			t.Fatalf("%d: cannot create meter points: %v", i, err)
+		}
+		values, err := cmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if values["success"] != test.success || values["verified"] != "1" ||
+			values["name.match"] != test.nameMatch || values["expiry.days"] != "90" {
+			t.Errorf("%d: invalid values: %q", i, values)
+		}
+	}
+
+	// Nothing listening.
+	cmp, err := collector.NewCertificateCheckMeterPoints("check.cert", collector.CertificateCheck{
+		Address: closedAddress(t, "tcp"),
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err := cmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["success"] != "0" || !strings.HasPrefix(values["error"], "error: ") {
+		t.Errorf("invalid values: %q", values)
+	}
+}
+
+// TestCertificateCheckInvalid tests invalid certificate checks.
+func TestCertificateCheckInvalid(t *testing.T) {
+	for _, def := range []collector.Definition{
+		{Type: collector.TypeCertificate, File: "/etc/ssl/cert.pem"},
+		{Type: collector.TypeCertificate, ID: "check.cert"},
+		{Type: collector.TypeCertificate, ID: "check.cert", File: "/etc/ssl/cert.pem", Address: "localhost:443"},
+		{Type: collector.TypeCertificate, ID: "check.cert", Address: "localhost"},
+		{Type: collector.TypeCertificate, ID: "check.cert", Address: "localhost:443", CAFile: "/does/not/exist"},
+	} {
+		if _, err := collector.NewDefinedMeterPoints(def); err == nil {
+			t.Errorf("expected error for %+v", def)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	dir  string
+	file string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA creates a CA and writes its certificate into the directory.
+func newTestCA(t *testing.T, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{
+		dir:  dir,
+		file: filepath.Join(dir, "ca.pem"),
+		cert: cert,
+		key:  key,
+	}
+	writePEM(t, ca.file, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ca
+}
+
+// issue writes a certificate for the name signed by the CA and its key
+// into a file.
+func (ca *testCA) issue(t *testing.T, file, name string, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %v", err)
+	}
+	file = filepath.Join(ca.dir, file)
+	writePEM(t, file,
+		&pem.Block{Type: "CERTIFICATE", Bytes: der},
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER},
+	)
+	return file
+}
+
+// writePEM writes the blocks PEM encoded into a file.
+func writePEM(t *testing.T, file string, blocks ...*pem.Block) {
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("cannot write %s: %v", file, err)
+	}
+}
+
+// EOF
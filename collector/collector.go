@@ -15,6 +15,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -39,11 +41,93 @@ type MeterPoints interface {
 	// defines also the stem for the returned values.
 	ID() string
 
+	// Retrieve returns the polled values. It has to return as soon as the
+	// context is done. Errors are set by the collector as value "all" of
+	// the meter points, formatted "error: xxx".
+	Retrieve(ctx context.Context) (Values, error)
+}
+
+// LegacyMeterPoints defines the former channel based interface for meter
+// points. Implementations can be registered using AdaptLegacy.
+type LegacyMeterPoints interface {
+	// ID returns the identificator of of the individual meter points.
+	ID() string
+
 	// Retrieve returns a channel delivering the polled values. Internal errors
 	// have to be returned as string value formatted "error: xxx".
 	Retrieve() <-chan Values
 }
 
+// legacyMeterPoints adapts LegacyMeterPoints to MeterPoints.
+type legacyMeterPoints struct {
+	lmp      LegacyMeterPoints
+	mu       sync.Mutex
+	finished chan struct{}
+}
+
+// AdaptLegacy wraps legacy meter points so that they can be registered. As
+// those cannot be cancelled a retrieval returns when the context is done,
+// but the goroutine of the legacy meter points runs until it delivers its
+// values. Until then the collector skips further retrievals.
+func AdaptLegacy(lmp LegacyMeterPoints) MeterPoints {
+	return &legacyMeterPoints{
+		lmp: lmp,
+	}
+}
+
+// ID implements MeterPoints.
+func (lmp *legacyMeterPoints) ID() string {
+	return lmp.lmp.ID()
+}
+
+// Retrieve implements MeterPoints.
+func (lmp *legacyMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	finished := make(chan struct{})
+	lmp.mu.Lock()
+	lmp.finished = finished
+	lmp.mu.Unlock()
+	valuesC := lmp.lmp.Retrieve()
+	select {
+	case values := <-valuesC:
+		close(finished)
+		return values, nil
+	case <-ctx.Done():
+		go func() {
+			<-valuesC
+			close(finished)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// lingering implements lingerer.
+func (lmp *legacyMeterPoints) lingering() <-chan struct{} {
+	lmp.mu.Lock()
+	defer lmp.mu.Unlock()
+	return lmp.finished
+}
+
+// Stop implements Stopper if the legacy meter points implement it.
+func (lmp *legacyMeterPoints) Stop() {
+	if s, ok := lmp.lmp.(Stopper); ok {
+		s.Stop()
+	}
+}
+
+// lingerer is implemented by meter points whose work may continue after
+// their retrieval returned, because it cannot be cancelled. The returned
+// channel is closed when the work of the latest retrieval has ended.
+type lingerer interface {
+	lingering() <-chan struct{}
+}
+
+// Stopper can be implemented by meter points running external processes or
+// holding other resources which have to be released when the collector stops.
+type Stopper interface {
+	// Stop ends all running retrievals and releases the resources.
+	Stop()
+}
+
 //--------------------
 // METRICS
 //--------------------
@@ -86,6 +170,40 @@ func (m *Metrics) Get(id string) (string, bool) {
 	return value, ok
 }
 
+// Values returns a copy of all values of the metrics.
+func (m *Metrics) Values() Values {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(Values, len(m.values))
+	for id, value := range m.values {
+		values[id] = value
+	}
+	return values
+}
+
+// Filter returns new metrics containing only the values selected by
+// the passed function.
+func (m *Metrics) Filter(selects func(id, value string) bool) *Metrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fm := NewMetrics(len(m.values))
+	for id, value := range m.values {
+		if selects(id, value) {
+			fm.values[id] = value
+		}
+	}
+	return fm
+}
+
+// merge sets a number of values with full IDs.
+func (m *Metrics) merge(values Values) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, value := range values {
+		m.values[id] = value
+	}
+}
+
 // Marshal returns the metrics encoded in JSON.
 func (m *Metrics) Marshal() ([]byte, error) {
 	m.mu.RLock()
@@ -98,19 +216,50 @@ func (m *Metrics) Marshal() ([]byte, error) {
 //--------------------
 
 // Collector maintains a number of meter points and retrieves their values
-// on demand.
+// on demand. The mutex only protects the state, it isn't held during
+// retrievals. The running meter points are kept per ID, so that those
+// replaced while running don't release their successors. The latest
+// values of each meter points are kept for those retrievals skipping them.
 type Collector struct {
 	mu          sync.Mutex
 	meterPoints map[string]MeterPoints
+	running     map[string]MeterPoints
+	latest      map[string]Values
+	workers     int
+	logger      *retrievalLogger
+	stats       *retrievalStats
 }
 
-// New creates a new collector instance.
+// New creates a new collector instance. It logs via the default logger
+// and retrieves all meter points at once.
 func New() *Collector {
 	return &Collector{
 		meterPoints: make(map[string]MeterPoints),
+		running:     make(map[string]MeterPoints),
+		latest:      make(map[string]Values),
+		logger:      newRetrievalLogger(slog.Default(), 0),
+		stats:       newRetrievalStats(),
 	}
 }
 
+// SetLogger sets the logger for retrieval errors, timeouts, and slow
+// retrievals taking longer than the passed duration. A duration of 0
+// disables the logging of slow retrievals. Repeated problems of the same
+// meter points are logged only once per minute.
+func (c *Collector) SetLogger(logger *slog.Logger, slow time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logger = newRetrievalLogger(logger, slow)
+}
+
+// SetWorkers sets the maximum number of meter points retrieved at the same
+// time by one retrieval. A number of 0 or less retrieves all at once.
+func (c *Collector) SetWorkers(workers int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.workers = workers
+}
+
 // Register adds meter points to the collector. In case of double IDs those
 // will be skipped and an error returned.
 func (c *Collector) Register(mps ...MeterPoints) error {
@@ -131,32 +280,242 @@ func (c *Collector) Register(mps ...MeterPoints) error {
 	return nil
 }
 
-// Retrieve tells the collector to retrieve the metrics. Each has
-// at maximum the passed duration time, otherwise the value will be
-// "error: timeout". All retrievals will be parallel, the wait group
-// waits for all retrievals. The context can cancel the collector
-// retrieval as well as all individual goroutines.
-func (c *Collector) Retrieve(ctx context.Context, timeout time.Duration) *Metrics {
+// Unregister removes meter points from the collector and stops those
+// implementing Stopper. Unknown IDs are skipped and an error returned.
+func (c *Collector) Unregister(ids ...string) error {
+	c.mu.Lock()
+	var unknown []string
+	var mps []MeterPoints
+	for _, id := range ids {
+		mp, ok := c.meterPoints[id]
+		if !ok {
+			unknown = append(unknown, id)
+			continue
+		}
+		delete(c.meterPoints, id)
+		delete(c.running, id)
+		delete(c.latest, id)
+		c.stats.remove(id)
+		mps = append(mps, mp)
+	}
+	c.mu.Unlock()
+	stop(mps)
+	if len(unknown) > 0 {
+		return fmt.Errorf("error: unknown IDs (%s)", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Replace adds meter points to the collector or replaces those with the
+// same IDs. Replaced meter points implementing Stopper are stopped.
+func (c *Collector) Replace(mps ...MeterPoints) {
+	c.mu.Lock()
+	var replaced []MeterPoints
+	for _, mp := range mps {
+		id := mp.ID()
+		if old, ok := c.meterPoints[id]; ok && old != mp {
+			replaced = append(replaced, old)
+			delete(c.running, id)
+			delete(c.latest, id)
+			c.stats.remove(id)
+		}
+		c.meterPoints[id] = mp
+	}
+	c.mu.Unlock()
+	stop(replaced)
+}
+
+// List returns the sorted IDs of the registered meter points.
+func (c *Collector) List() []string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	metrics := NewMetrics(len(c.meterPoints))
+	ids := make([]string, 0, len(c.meterPoints))
+	for id := range c.meterPoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Retrieve tells the collector to retrieve the metrics. Each has
+// at maximum the passed duration time, otherwise the value will be
+// "error: timeout". The retrievals are parallel, limited by the number
+// of workers, the wait group waits for all retrievals. The timeout
+// starts when a meter points retrieval starts. The context can cancel
+// the collector retrieval as well as all individual meter points, which
+// get the value "error: cancelled". Errors returned by meter points are
+// set as their value "all". Meter points still running in a different
+// retrieval, or whose work still continues after an earlier timeout, are
+// skipped. Their latest values are returned again together with the value
+// "stale" set to 1, without latest values they get the value "error: still
+// running". If IDs are passed
+// only those meter points are retrieved, unknown ones get the value
+// "error: unknown meter points".
+func (c *Collector) Retrieve(ctx context.Context, timeout time.Duration, ids ...string) *Metrics {
+	metrics, mps, logger, workers := c.start(ids)
+	var slotC chan struct{}
+	if workers > 0 {
+		slotC = make(chan struct{}, workers)
+	}
 	var wg sync.WaitGroup
-	for id, mp := range c.meterPoints {
+	for id, mp := range mps {
 		wg.Add(1)
 		go func(fid string, fmp MeterPoints) {
 			defer wg.Done()
-			select {
-			case <-ctx.Done():
-				metrics.Set(fid, "error: cancelled")
-			case values := <-fmp.Retrieve():
-				metrics.Add(fid, values)
-			case <-time.After(timeout):
-				metrics.Set(fid, "error: timeout")
+			if slotC != nil {
+				select {
+				case slotC <- struct{}{}:
+					defer func() { <-slotC }()
+				case <-ctx.Done():
+					metrics.Set(fid, "error: cancelled")
+					c.done(fid, fmp)
+					return
+				}
 			}
+			c.retrieve(ctx, timeout, fid, fmp, metrics, logger)
+			c.release(fid, fmp)
 		}(id, mp)
 	}
 	wg.Wait()
 	return metrics
 }
 
+// start selects the meter points to retrieve and marks them as running.
+// Unknown ones are set in the returned metrics, for those which are
+// already running their stale latest values or an error.
+func (c *Collector) start(ids []string) (*Metrics, map[string]MeterPoints, *retrievalLogger, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(ids) == 0 {
+		ids = make([]string, 0, len(c.meterPoints))
+		for id := range c.meterPoints {
+			ids = append(ids, id)
+		}
+	}
+	metrics := NewMetrics(len(ids))
+	mps := make(map[string]MeterPoints, len(ids))
+	for _, id := range ids {
+		mp, ok := c.meterPoints[id]
+		switch {
+		case !ok:
+			metrics.Set(id, "error: unknown meter points")
+		case c.running[id] != nil:
+			if latest := c.latest[id]; len(latest) > 0 {
+				metrics.merge(latest)
+				metrics.Set(id+".stale", "1")
+			} else {
+				metrics.Set(id, "error: still running")
+			}
+			c.logger.stillRunning(id)
+			c.stats.skipped(id)
+		default:
+			c.running[id] = mp
+			mps[id] = mp
+		}
+	}
+	return metrics, mps, c.logger, c.workers
+}
+
+// release marks the meter points as not running anymore as soon as their
+// work has ended, which may be later than their retrieval.
+func (c *Collector) release(id string, mp MeterPoints) {
+	if l, ok := mp.(lingerer); ok {
+		if finished := l.lingering(); finished != nil {
+			select {
+			case <-finished:
+			default:
+				go func() {
+					<-finished
+					c.done(id, mp)
+				}()
+				return
+			}
+		}
+	}
+	c.done(id, mp)
+}
+
+// done marks the meter points as not running anymore, unless they have
+// been replaced or unregistered meanwhile.
+func (c *Collector) done(id string, mp MeterPoints) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running[id] == mp {
+		delete(c.running, id)
+	}
+}
+
+// remember keeps the latest values of meter points and records their
+// retrieval statistics, unless they have been replaced or unregistered
+// meanwhile.
+func (c *Collector) remember(id string, mp MeterPoints, values Values, record func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.meterPoints[id] == mp {
+		c.latest[id] = values
+		record()
+	}
+}
+
+// retrieve retrieves the values of one meter points and adds them to
+// the metrics. The meter points are cancelled after the timeout. Except
+// for cancelled retrievals the values are kept as the latest ones.
+func (c *Collector) retrieve(
+	ctx context.Context,
+	timeout time.Duration,
+	id string,
+	mp MeterPoints,
+	metrics *Metrics,
+	logger *retrievalLogger,
+) {
+	rctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	values, err := mp.Retrieve(rctx)
+	d := time.Since(start)
+	var latest Values
+	var record func()
+	switch {
+	case ctx.Err() != nil:
+		metrics.Set(id, "error: cancelled")
+		return
+	case rctx.Err() != nil:
+		latest = Values{id: "error: timeout"}
+		logger.timedOut(id, timeout)
+		record = func() { c.stats.timedOut(id, timeout) }
+	default:
+		if err != nil {
+			values = Values{"all": fmt.Sprintf("error: %v", err)}
+		}
+		latest = make(Values, len(values))
+		for vid, value := range values {
+			latest[id+"."+vid] = value
+		}
+		logger.retrieved(id, values, d)
+		record = func() { c.stats.retrieved(id, values, d) }
+	}
+	metrics.merge(latest)
+	c.remember(id, mp, latest, record)
+}
+
+// Stop stops all meter points implementing Stopper.
+func (c *Collector) Stop() {
+	c.mu.Lock()
+	mps := make([]MeterPoints, 0, len(c.meterPoints))
+	for _, mp := range c.meterPoints {
+		mps = append(mps, mp)
+	}
+	c.mu.Unlock()
+	stop(mps)
+}
+
+// stop stops the meter points implementing Stopper.
+func stop(mps []MeterPoints) {
+	for _, mp := range mps {
+		if s, ok := mp.(Stopper); ok {
+			s.Stop()
+		}
+	}
+}
+
 // EOF
@@ -13,7 +13,14 @@ package collector_test
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -49,6 +56,28 @@ func TestCollectorOK(t *testing.T) {
 	}
 }
 
+// TestCollectorSelected tests retrieving only selected meter points.
+func TestCollectorSelected(t *testing.T) {
+	c := collector.New()
+	ctx := context.Background()
+	mpa := NewStubMeterPoints("a", 0, 10*time.Millisecond)
+	mpb := NewStubMeterPoints("b", 5, 10*time.Millisecond)
+	err := c.Register(mpa, mpb)
+	if err != nil {
+		t.Errorf("collector register error: %v", err)
+	}
+	metrics := c.Retrieve(ctx, time.Second, "b", "x")
+	if _, ok := metrics.Get("a.count"); ok {
+		t.Errorf("unselected value a retrieved")
+	}
+	if b, ok := metrics.Get("b.count"); !ok || b != "6" {
+		t.Errorf("illegal value b: %q", b)
+	}
+	if x, ok := metrics.Get("x"); !ok || x != "error: unknown meter points" {
+		t.Errorf("illegal value x: %q", x)
+	}
+}
+
 // TestCollectorError tests registering meter points with duplicate ID.
 func TestCollectorError(t *testing.T) {
 	c := collector.New()
@@ -88,6 +117,295 @@ func TestCollectorCancel(t *testing.T) {
 	}
 }
 
+// TestCollectorTimeout tests that timed out retrievals leave no goroutines.
+func TestCollectorTimeout(t *testing.T) {
+	script := writeScript(t, "sleep 10\necho done\n")
+	defer os.RemoveAll(filepath.Dir(script))
+	c := collector.New()
+	err := c.Register(
+		NewStubMeterPoints("a", 0, 10*time.Second),
+		collector.NewCommandMeterPoints("b", script),
+		collector.NewGenericMeterPoints("c", func(ctx context.Context) (collector.Values, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}),
+	)
+	if err != nil {
+		t.Errorf("collector register error: %v", err)
+	}
+	before := runtime.NumGoroutine()
+	start := time.Now()
+	metrics := c.Retrieve(context.Background(), 100*time.Millisecond)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("retrieval not timed out: %v", d)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if v, ok := metrics.Get(id); !ok || v != "error: timeout" {
+			t.Errorf("illegal value %s: %q", id, v)
+		}
+	}
+	assertGoroutines(t, before)
+}
+
+// TestCollectorRetrievalError tests errors returned by meter points.
+func TestCollectorRetrievalError(t *testing.T) {
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("a", func(ctx context.Context) (collector.Values, error) {
+		return nil, errors.New("flop")
+	}))
+	metrics := c.Retrieve(context.Background(), time.Second)
+	if a, ok := metrics.Get("a.all"); !ok || a != "error: flop" {
+		t.Errorf("illegal value a: %q", a)
+	}
+}
+
+// TestCollectorLegacy tests retrieving legacy meter points.
+func TestCollectorLegacy(t *testing.T) {
+	c := collector.New()
+	err := c.Register(
+		collector.AdaptLegacy(NewLegacyStubMeterPoints("a", 10*time.Millisecond)),
+		collector.AdaptLegacy(NewLegacyStubMeterPoints("b", 2*time.Second)),
+	)
+	if err != nil {
+		t.Errorf("collector register error: %v", err)
+	}
+	metrics := c.Retrieve(context.Background(), 100*time.Millisecond)
+	if a, ok := metrics.Get("a.legacy"); !ok || a != "true" {
+		t.Errorf("illegal value a: %q", a)
+	}
+	if b, ok := metrics.Get("b"); !ok || b != "error: timeout" {
+		t.Errorf("illegal value b: %q", b)
+	}
+}
+
+// TestCollectorWorkers tests limiting the number of parallel retrievals.
+func TestCollectorWorkers(t *testing.T) {
+	c := collector.New()
+	c.SetWorkers(2)
+	var mu sync.Mutex
+	current, max := 0, 0
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		c.Register(collector.NewGenericMeterPoints(id, func(ctx context.Context) (collector.Values, error) {
+			mu.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			current--
+			mu.Unlock()
+			return collector.Values{"ok": "true"}, nil
+		}))
+	}
+	metrics := c.Retrieve(context.Background(), time.Second)
+	if n := len(metrics.Values()); n != 5 {
+		t.Errorf("illegal number of values: %d", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 2 {
+		t.Errorf("illegal number of parallel retrievals: %d", max)
+	}
+}
+
+// TestCollectorStillRunning tests that meter points don't overlap with
+// themselves and that registering doesn't block during retrievals.
+func TestCollectorStillRunning(t *testing.T) {
+	c := collector.New()
+	c.Register(
+		NewStubMeterPoints("a", 0, 500*time.Millisecond),
+		NewStubMeterPoints("b", 5, 10*time.Millisecond),
+	)
+	ctx := context.Background()
+	doneC := make(chan *collector.Metrics)
+	go func() {
+		doneC <- c.Retrieve(ctx, time.Second, "a")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := c.Register(NewStubMeterPoints("c", 10, 10*time.Millisecond)); err != nil {
+		t.Errorf("collector register error: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("register blocked by retrieval: %v", d)
+	}
+
+	metrics := c.Retrieve(ctx, time.Second)
+	if a, ok := metrics.Get("a"); !ok || a != "error: still running" {
+		t.Errorf("illegal value a without latest values: %q", a)
+	}
+	if b, ok := metrics.Get("b.count"); !ok || b != "6" {
+		t.Errorf("illegal value b: %q", b)
+	}
+	if c, ok := metrics.Get("c.count"); !ok || c != "11" {
+		t.Errorf("illegal value c: %q", c)
+	}
+
+	metrics = <-doneC
+	if a, ok := metrics.Get("a.count"); !ok || a != "1" {
+		t.Errorf("illegal value a: %q", a)
+	}
+
+	// Skipped meter points return their latest values marked as stale.
+	go func() {
+		doneC <- c.Retrieve(ctx, time.Second, "a")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	metrics = c.Retrieve(ctx, time.Second)
+	if a, ok := metrics.Get("a.count"); !ok || a != "1" {
+		t.Errorf("illegal value a: %q", a)
+	}
+	if stale, ok := metrics.Get("a.stale"); !ok || stale != "1" {
+		t.Errorf("latest values of a not marked as stale: %q", stale)
+	}
+	metrics = <-doneC
+	if a, ok := metrics.Get("a.count"); !ok || a != "2" {
+		t.Errorf("illegal value a: %q", a)
+	}
+	if stale, ok := metrics.Get("a.stale"); ok {
+		t.Errorf("fresh values of a marked as stale: %q", stale)
+	}
+
+	// Replaced meter points are retrieved, also while their predecessors
+	// are still running.
+	go func() {
+		doneC <- c.Retrieve(ctx, time.Second, "a")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.Replace(NewStubMeterPoints("a", 100, 10*time.Millisecond))
+	metrics = c.Retrieve(ctx, time.Second, "a")
+	if a, ok := metrics.Get("a.count"); !ok || a != "101" {
+		t.Errorf("illegal value of replaced a: %q", a)
+	}
+	<-doneC
+	metrics = c.Retrieve(ctx, time.Second, "a")
+	if a, ok := metrics.Get("a.count"); !ok || a != "102" {
+		t.Errorf("illegal value of replaced a: %q", a)
+	}
+}
+
+// TestCollectorLingering tests that meter points whose work continues
+// after a timeout are not retrieved again until it has ended.
+func TestCollectorLingering(t *testing.T) {
+	var mu sync.Mutex
+	calls, current, max := 0, 0, 0
+	releaseC := make(chan struct{})
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("a", func(ctx context.Context) (collector.Values, error) {
+		mu.Lock()
+		calls++
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+		// Ignores the context.
+		<-releaseC
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return collector.Values{"ok": "true"}, nil
+	}))
+	ctx := context.Background()
+	metrics := c.Retrieve(ctx, 50*time.Millisecond)
+	if a, ok := metrics.Get("a"); !ok || a != "error: timeout" {
+		t.Errorf("illegal value a: %q", a)
+	}
+	for i := 0; i < 3; i++ {
+		metrics = c.Retrieve(ctx, 50*time.Millisecond)
+		if a, ok := metrics.Get("a"); !ok || a != "error: timeout" {
+			t.Errorf("illegal latest value a: %q", a)
+		}
+		if stale, ok := metrics.Get("a.stale"); !ok || stale != "1" {
+			t.Errorf("latest value a not marked as stale: %q", stale)
+		}
+	}
+	close(releaseC)
+	for i := 0; ; i++ {
+		metrics = c.Retrieve(ctx, 50*time.Millisecond)
+		if a, _ := metrics.Get("a.ok"); a == "true" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("meter points not retrieved again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 1 || calls != 2 {
+		t.Errorf("illegal calls: %d, max. parallel %d", calls, max)
+	}
+}
+
+// TestCollectorManagement tests listing, replacing, and unregistering
+// meter points.
+func TestCollectorManagement(t *testing.T) {
+	script := writeScript(t, "sleep 10\n")
+	defer os.RemoveAll(filepath.Dir(script))
+	c := collector.New()
+	ctx := context.Background()
+	cmp := collector.NewCommandMeterPoints("cmd", script)
+	c.Register(NewStubMeterPoints("b", 0, 0), NewStubMeterPoints("a", 0, 0), cmp)
+	if ids := c.List(); !reflect.DeepEqual(ids, []string{"a", "b", "cmd"}) {
+		t.Errorf("illegal IDs: %v", ids)
+	}
+
+	c.Replace(NewStubMeterPoints("a", 10, 0), NewStubMeterPoints("c", 20, 0))
+	metrics := c.Retrieve(ctx, time.Second, "a", "c")
+	if a, ok := metrics.Get("a.count"); !ok || a != "11" {
+		t.Errorf("illegal value a: %q", a)
+	}
+	if c, ok := metrics.Get("c.count"); !ok || c != "21" {
+		t.Errorf("illegal value c: %q", c)
+	}
+
+	// Unregistering stops running commands.
+	doneC := make(chan *collector.Metrics)
+	go func() {
+		doneC <- c.Retrieve(ctx, 5*time.Second, "cmd")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := c.Unregister("cmd", "b"); err != nil {
+		t.Errorf("collector unregister error: %v", err)
+	}
+	select {
+	case metrics := <-doneC:
+		if v, _ := metrics.Get("cmd.all"); !strings.HasPrefix(v, "error: cannot execute command") {
+			t.Errorf("illegal value cmd: %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("command not stopped")
+	}
+	if ids := c.List(); !reflect.DeepEqual(ids, []string{"a", "c"}) {
+		t.Errorf("illegal IDs: %v", ids)
+	}
+	err := c.Unregister("x")
+	if err == nil || err.Error() != "error: unknown IDs (x)" {
+		t.Errorf("expected different unregister error: %v", err)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// assertGoroutines waits until no more than the passed number of
+// goroutines are running.
+func assertGoroutines(t *testing.T, max int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > max {
+		if time.Now().After(deadline) {
+			t.Errorf("goroutines left: %d instead of %d", runtime.NumGoroutine(), max)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 //--------------------
 // STUBS
 //--------------------
@@ -115,12 +433,41 @@ func (smp *StubMeterPoints) ID() string {
 }
 
 // Retrieve implements MeterPoints.
-func (smp *StubMeterPoints) Retrieve() <-chan collector.Values {
+func (smp *StubMeterPoints) Retrieve(ctx context.Context) (collector.Values, error) {
+	select {
+	case <-time.After(smp.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	smp.count++
+	return collector.Values{"count": strconv.Itoa(smp.count)}, nil
+}
+
+// LegacyStubMeterPoints simulates channel based meter points.
+type LegacyStubMeterPoints struct {
+	id    string
+	delay time.Duration
+}
+
+// NewLegacyStubMeterPoints creates a new legacy stub for tests.
+func NewLegacyStubMeterPoints(id string, delay time.Duration) *LegacyStubMeterPoints {
+	return &LegacyStubMeterPoints{
+		id:    id,
+		delay: delay,
+	}
+}
+
+// ID implements LegacyMeterPoints.
+func (lsmp *LegacyStubMeterPoints) ID() string {
+	return lsmp.id
+}
+
+// Retrieve implements LegacyMeterPoints.
+func (lsmp *LegacyStubMeterPoints) Retrieve() <-chan collector.Values {
 	valuesC := make(chan collector.Values, 1)
 	go func() {
-		time.Sleep(smp.delay)
-		smp.count++
-		valuesC <- collector.Values{"count": strconv.Itoa(smp.count)}
+		time.Sleep(lsmp.delay)
+		valuesC <- collector.Values{"legacy": "true"}
 	}()
 	return valuesC
 }
@@ -12,9 +12,12 @@ package collector
 //--------------------
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 )
 
 //--------------------
@@ -23,17 +26,23 @@ import (
 
 // CommandMeterPoint retrieves the single all lines returned by the
 // configured command, which typically is a shell script. The lines
-// are enumerated.
+// are enumerated. Running commands are killed when the retrieval is
+// cancelled or when stopping.
 type CommandMeterPoints struct {
 	id      string
 	command string
+	ctx     context.Context
+	cancel  func()
 }
 
 // NewCommandMeterPoints creates a new meter point for a passed command.
 func NewCommandMeterPoints(id, command string) *CommandMeterPoints {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &CommandMeterPoints{
 		id:      id,
 		command: command,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
@@ -43,23 +52,38 @@ func (cmp *CommandMeterPoints) ID() string {
 }
 
 // Retrieve implements MeterPoints.
-func (cmp *CommandMeterPoints) Retrieve() <-chan Values {
-	valuesC := make(chan Values, 1)
-	go func() {
-		out, err := exec.Command(cmp.command).Output()
-		if err != nil {
-			errMsg := fmt.Sprintf("error: cannot execute command: %v", err)
-			valuesC <- Values{"1": errMsg}
-			return
-		}
-		lines := strings.Split(string(out), "\n")
-		values := make(Values, len(lines))
-		for i, line := range lines {
-			values[fmt.Sprintf("%d", i+1)] = line
+func (cmp *CommandMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(cmp.ctx, cancel)
+	defer stop()
+	cmd := exec.CommandContext(ctx, cmp.command)
+	// Run the command in an own process group, so that cancelling
+	// kills its child processes too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil && cmp.ctx.Err() == nil {
+			return nil, ctx.Err()
 		}
-		valuesC <- values
-	}()
-	return valuesC
+		return nil, fmt.Errorf("cannot execute command: %v", err)
+	}
+	lines := strings.Split(string(out), "\n")
+	values := make(Values, len(lines))
+	for i, line := range lines {
+		values[fmt.Sprintf("%d", i+1)] = line
+	}
+	return values, nil
+}
+
+// Stop implements Stopper. It kills the running command, later
+// retrievals fail.
+func (cmp *CommandMeterPoints) Stop() {
+	cmp.cancel()
 }
 
 // EOF
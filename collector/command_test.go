@@ -0,0 +1,105 @@
+// System Monitor Daemon - Collector - Command Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestCommandOK tests retrieving the lines of a command.
+func TestCommandOK(t *testing.T) {
+	script := writeScript(t, "echo first\necho second\n")
+	defer os.RemoveAll(filepath.Dir(script))
+	cmp := collector.NewCommandMeterPoints("script", script)
+	if cmp.ID() != "script" {
+		t.Errorf("invalid meter points ID: %q", cmp.ID())
+	}
+	values, err := cmp.Retrieve(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if values["1"] != "first" || values["2"] != "second" {
+		t.Errorf("invalid meter points values: %q", values)
+	}
+}
+
+// TestCommandStop tests killing a running command when stopping.
+func TestCommandStop(t *testing.T) {
+	script := writeScript(t, "sleep 10\necho done\n")
+	defer os.RemoveAll(filepath.Dir(script))
+	cmp := collector.NewCommandMeterPoints("script", script)
+	errC := make(chan error, 1)
+	go func() {
+		_, err := cmp.Retrieve(context.Background())
+		errC <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cmp.Stop()
+	select {
+	case err := <-errC:
+		if err == nil || !strings.HasPrefix(err.Error(), "cannot execute command") {
+			t.Errorf("invalid meter points error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("command not killed")
+	}
+}
+
+// TestCommandCancel tests killing a running command when the retrieval
+// is cancelled.
+func TestCommandCancel(t *testing.T) {
+	script := writeScript(t, "sleep 10\necho done\n")
+	defer os.RemoveAll(filepath.Dir(script))
+	cmp := collector.NewCommandMeterPoints("script", script)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cmp.Retrieve(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("invalid meter points error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command not killed: %v", d)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// writeScript writes an executable shell script into a temporary directory.
+func writeScript(t *testing.T, body string) string {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	script := filepath.Join(dir, "script.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body), 0755)
+	if err != nil {
+		t.Fatalf("cannot write script: %v", err)
+	}
+	return script
+}
+
+// EOF
@@ -12,6 +12,8 @@ package collector
 //--------------------
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/shirou/gopsutil/cpu"
@@ -35,23 +37,21 @@ func (cmp *CPUMeterPoints) ID() string {
 }
 
 // Retrieve implements MeterPoints.
-func (cmp *CPUMeterPoints) Retrieve() <-chan Values {
-	valuesC := make(chan Values, 1)
-	go func() {
-		times, err := cpu.Times(true)
-		if err != nil {
-			valuesC <- Values{"all": "error: cannot retrieve CPU times statistics"}
-			return
-		}
-		values := make(Values, len(times)*3)
-		for i, t := range times {
-			values[fmt.Sprintf("%d.user", i)] = fmt.Sprintf("%.3f", t.User)
-			values[fmt.Sprintf("%d.system", i)] = fmt.Sprintf("%.3f", t.System)
-			values[fmt.Sprintf("%d.idle", i)] = fmt.Sprintf("%.3f", t.Idle)
-		}
-		valuesC <- values
-	}()
-	return valuesC
+func (cmp *CPUMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	times, err := cpu.Times(true)
+	if err != nil {
+		return nil, errors.New("cannot retrieve CPU times statistics")
+	}
+	values := make(Values, len(times)*3)
+	for i, t := range times {
+		values[fmt.Sprintf("%d.user", i)] = fmt.Sprintf("%.3f", t.User)
+		values[fmt.Sprintf("%d.system", i)] = fmt.Sprintf("%.3f", t.System)
+		values[fmt.Sprintf("%d.idle", i)] = fmt.Sprintf("%.3f", t.Idle)
+	}
+	return values, nil
 }
 
 // EOF
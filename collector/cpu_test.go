@@ -12,10 +12,10 @@ package collector_test
 //--------------------
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/themue/sysmond/collector"
 )
@@ -39,19 +39,18 @@ func TestCPUOK(t *testing.T) {
 	if cmp.ID() != "sys.cpu" {
 		t.Errorf("invalid meter points ID: %q", cmp.ID())
 	}
-	select {
-	case values := <-cmp.Retrieve():
-		if len(values)%3 != 0 {
-			t.Errorf("invalid number of values: %d", len(values))
-		}
-		cores := len(values) / 3
-		for i := 0; i < cores; i++ {
-			testValue(values, i, "user")
-			testValue(values, i, "system")
-			testValue(values, i, "idle")
-		}
-	case <-time.After(5 * time.Second):
-		t.Errorf("meter points retrieve timeout")
+	values, err := cmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values)%3 != 0 {
+		t.Errorf("invalid number of values: %d", len(values))
+	}
+	cores := len(values) / 3
+	for i := 0; i < cores; i++ {
+		testValue(values, i, "user")
+		testValue(values, i, "system")
+		testValue(values, i, "idle")
 	}
 }
 
@@ -0,0 +1,134 @@
+// System Monitor Daemon - Collector - Meter Points Definitions
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Types of defined meter points.
+const (
+	TypeCPU         = "cpu"
+	TypeMemory      = "memory"
+	TypeDisk        = "disk"
+	TypeNetwork     = "network"
+	TypeCommand     = "command"
+	TypeHTTP        = "http"
+	TypePort        = "port"
+	TypeCertificate = "certificate"
+)
+
+//--------------------
+// DEFINITION
+//--------------------
+
+// Definition describes meter points in the configuration and in the admin
+// API. The fields needed depend on the type: disk meter points need an ID
+// and a mount point, command meter points an ID and a command, HTTP probe
+// meter points an ID and a URL. The match, the JSON path and value, and
+// the CA file are optional for HTTP probes. Port check meter points need
+// an ID and an address, optionally the network, the send data, and the
+// match. Certificate check meter points need an ID and an address or a
+// file, optionally the server name, the CA file, and the minimum days.
+type Definition struct {
+	Type       string `json:"type"`
+	ID         string `json:"id,omitempty"`
+	Mount      string `json:"mount,omitempty"`
+	Command    string `json:"command,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Match      string `json:"match,omitempty"`
+	JSONPath   string `json:"jsonPath,omitempty"`
+	JSONValue  string `json:"jsonValue,omitempty"`
+	CAFile     string `json:"caFile,omitempty"`
+	Network    string `json:"network,omitempty"`
+	Address    string `json:"address,omitempty"`
+	Send       string `json:"send,omitempty"`
+	File       string `json:"file,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	MinDays    int    `json:"minDays,omitempty"`
+}
+
+// MeterPointsID returns the ID of the meter points created by the definition.
+func (def Definition) MeterPointsID() string {
+	switch def.Type {
+	case TypeCPU:
+		return "sys.cpu"
+	case TypeMemory:
+		return "sys.mem"
+	case TypeDisk:
+		return "sys.disk." + def.ID
+	case TypeNetwork:
+		return "sys.net"
+	}
+	return def.ID
+}
+
+// NewDefinedMeterPoints creates meter points out of a definition.
+func NewDefinedMeterPoints(def Definition) (MeterPoints, error) {
+	switch def.Type {
+	case TypeCPU:
+		return NewCPUMeterPoints(), nil
+	case TypeMemory:
+		return NewMemoryMeterPoints(), nil
+	case TypeDisk:
+		if def.ID == "" || def.Mount == "" {
+			return nil, fmt.Errorf("disk meter points need ID and mount")
+		}
+		return NewDiskMeterPoints(def.ID, def.Mount), nil
+	case TypeNetwork:
+		return NewNetworkMeterPoints(), nil
+	case TypeCommand:
+		if def.ID == "" || def.Command == "" {
+			return nil, fmt.Errorf("command meter points need ID and command")
+		}
+		return NewCommandMeterPoints(def.ID, def.Command), nil
+	case TypeHTTP:
+		if def.ID == "" || def.URL == "" {
+			return nil, fmt.Errorf("HTTP probe meter points need ID and URL")
+		}
+		return NewHTTPProbeMeterPoints(def.ID, HTTPProbe{
+			URL:       def.URL,
+			Match:     def.Match,
+			JSONPath:  def.JSONPath,
+			JSONValue: def.JSONValue,
+			CAFile:    def.CAFile,
+		})
+	case TypePort:
+		if def.ID == "" || def.Address == "" {
+			return nil, fmt.Errorf("port check meter points need ID and address")
+		}
+		return NewPortCheckMeterPoints(def.ID, PortCheck{
+			Network: def.Network,
+			Address: def.Address,
+			Send:    def.Send,
+			Match:   def.Match,
+		})
+	case TypeCertificate:
+		if def.ID == "" {
+			return nil, fmt.Errorf("certificate check meter points need ID")
+		}
+		return NewCertificateCheckMeterPoints(def.ID, CertificateCheck{
+			Address:    def.Address,
+			File:       def.File,
+			ServerName: def.ServerName,
+			CAFile:     def.CAFile,
+			MinDays:    def.MinDays,
+		})
+	}
+	return nil, fmt.Errorf("invalid meter points type %q", def.Type)
+}
+
+// EOF
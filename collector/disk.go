@@ -12,6 +12,8 @@ package collector
 //--------------------
 
 import (
+	"context"
+	"errors"
 	"os/exec"
 	"strings"
 )
@@ -40,24 +42,23 @@ func (dmp *DiskMeterPoints) ID() string {
 	return dmp.id
 }
 
-// Retrieve implements MeterPoints.
-func (dmp *DiskMeterPoints) Retrieve() <-chan Values {
-	valuesC := make(chan Values, 1)
-	go func() {
-		out, err := exec.Command("df", "-Pk", dmp.mount).Output()
-		if err != nil {
-			valuesC <- Values{"all": "error: cannot retrieve disk space"}
-			return
+// Retrieve implements MeterPoints. A running df is killed when the
+// context is done.
+func (dmp *DiskMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	out, err := exec.CommandContext(ctx, "df", "-Pk", dmp.mount).Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		lines := strings.Split(string(out), "\n")
-		fields := strings.Fields(lines[1])
-		values := make(Values, 3)
-		values["total"] = fields[1]
-		values["used"] = fields[2]
-		values["available"] = fields[3]
-		valuesC <- values
-	}()
-	return valuesC
+		return nil, errors.New("cannot retrieve disk space")
+	}
+	lines := strings.Split(string(out), "\n")
+	fields := strings.Fields(lines[1])
+	values := make(Values, 3)
+	values["total"] = fields[1]
+	values["used"] = fields[2]
+	values["available"] = fields[3]
+	return values, nil
 }
 
 // EOF
@@ -12,9 +12,9 @@ package collector_test
 //--------------------
 
 import (
+	"context"
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/themue/sysmond/collector"
 )
@@ -38,17 +38,16 @@ func TestDiskOK(t *testing.T) {
 	if dmp.ID() != "sys.disk.root" {
 		t.Errorf("invalid meter points ID: %q", dmp.ID())
 	}
-	select {
-	case values := <-dmp.Retrieve():
-		if len(values) != 3 {
-			t.Errorf("invalid number of values: %d", len(values))
-		}
-		testValue(values, "total")
-		testValue(values, "used")
-		testValue(values, "available")
-	case <-time.After(5 * time.Second):
-		t.Errorf("meter points retrieve timeout")
+	values, err := dmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 3 {
+		t.Errorf("invalid number of values: %d", len(values))
 	}
+	testValue(values, "total")
+	testValue(values, "used")
+	testValue(values, "available")
 }
 
 // TestDiskError tests retrieving test data with an invalid mount point.
@@ -57,13 +56,9 @@ func TestDiskError(t *testing.T) {
 	if dmp.ID() != "sys.disk.foo" {
 		t.Errorf("invalid meter points ID: %q", dmp.ID())
 	}
-	select {
-	case values := <-dmp.Retrieve():
-		if len(values) != 1 || values["all"] != "error: cannot retrieve disk space" {
-			t.Errorf("invalid return values: %q", values)
-		}
-	case <-time.After(5 * time.Second):
-		t.Errorf("meter points retrieve timeout")
+	_, err := dmp.Retrieve(context.Background())
+	if err == nil || err.Error() != "cannot retrieve disk space" {
+		t.Errorf("invalid error: %v", err)
 	}
 }
 
@@ -12,7 +12,8 @@ package collector
 //--------------------
 
 import (
-	"fmt"
+	"context"
+	"sync"
 )
 
 //--------------------
@@ -20,13 +21,17 @@ import (
 //--------------------
 
 // GenericMeterPoints takes a user defined function to retrieve any wanted values.
+// The function gets the context of the retrieval and should return when it's
+// done.
 type GenericMeterPoints struct {
 	id       string
-	retrieve func() (Values, error)
+	retrieve func(ctx context.Context) (Values, error)
+	mu       sync.Mutex
+	finished chan struct{}
 }
 
 // NewGenericMeterPoints creates new meter points for generic functions.
-func NewGenericMeterPoints(id string, r func() (Values, error)) *GenericMeterPoints {
+func NewGenericMeterPoints(id string, r func(ctx context.Context) (Values, error)) *GenericMeterPoints {
 	return &GenericMeterPoints{
 		id:       id,
 		retrieve: r,
@@ -38,18 +43,37 @@ func (gmp *GenericMeterPoints) ID() string {
 	return gmp.id
 }
 
-// Retrieve implements MeterPoints.
-func (gmp *GenericMeterPoints) Retrieve() <-chan Values {
-	valuesC := make(chan Values, 1)
+// Retrieve implements MeterPoints. It returns when the context is done
+// even if the function doesn't. Until the function returns the collector
+// skips further retrievals.
+func (gmp *GenericMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	type result struct {
+		values Values
+		err    error
+	}
+	resultC := make(chan result, 1)
+	finished := make(chan struct{})
+	gmp.mu.Lock()
+	gmp.finished = finished
+	gmp.mu.Unlock()
 	go func() {
-		values, err := gmp.retrieve()
-		if err != nil {
-			valuesC <- Values{"all": fmt.Sprintf("error: %v", err)}
-			return
-		}
-		valuesC <- values
+		defer close(finished)
+		values, err := gmp.retrieve(ctx)
+		resultC <- result{values, err}
 	}()
-	return valuesC
+	select {
+	case r := <-resultC:
+		return r.values, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// lingering implements lingerer.
+func (gmp *GenericMeterPoints) lingering() <-chan struct{} {
+	gmp.mu.Lock()
+	defer gmp.mu.Unlock()
+	return gmp.finished
 }
 
 // EOF
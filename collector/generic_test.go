@@ -12,6 +12,7 @@ package collector_test
 //--------------------
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -25,7 +26,7 @@ import (
 
 // TestGenericOK tests a positive generic meter points retrieval.
 func TestGenericOK(t *testing.T) {
-	gmp := collector.NewGenericMeterPoints("ok", func() (collector.Values, error) {
+	gmp := collector.NewGenericMeterPoints("ok", func(ctx context.Context) (collector.Values, error) {
 		return collector.Values{
 			"first":  "top",
 			"second": "ok",
@@ -34,31 +35,48 @@ func TestGenericOK(t *testing.T) {
 	if gmp.ID() != "ok" {
 		t.Errorf("invalid meter points ID: %q", gmp.ID())
 	}
-	select {
-	case values := <-gmp.Retrieve():
-		if values["first"] != "top" || values["second"] != "ok" {
-			t.Errorf("invalid meter points values: %q", values)
-		}
-	case <-time.After(5 * time.Second):
-		t.Errorf("meter points retrieval timeout")
+	values, err := gmp.Retrieve(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if values["first"] != "top" || values["second"] != "ok" {
+		t.Errorf("invalid meter points values: %q", values)
 	}
 }
 
 // TestGenericError tests a negative generic meter point retrieval.
 func TestGenericError(t *testing.T) {
-	gmp := collector.NewGenericMeterPoints("nok", func() (collector.Values, error) {
+	gmp := collector.NewGenericMeterPoints("nok", func(ctx context.Context) (collector.Values, error) {
 		return nil, errors.New("flop")
 	})
 	if gmp.ID() != "nok" {
 		t.Errorf("invalid meter points ID: %q", gmp.ID())
 	}
-	select {
-	case values := <-gmp.Retrieve():
-		if len(values) != 1 || values["all"] != "error: flop" {
-			t.Errorf("invalid meter points values: %q", values)
+	_, err := gmp.Retrieve(context.Background())
+	if err == nil || err.Error() != "flop" {
+		t.Errorf("invalid meter points error: %v", err)
+	}
+}
+
+// TestGenericCancel tests cancelling a generic meter point retrieval.
+func TestGenericCancel(t *testing.T) {
+	gmp := collector.NewGenericMeterPoints("slow", func(ctx context.Context) (collector.Values, error) {
+		select {
+		case <-time.After(5 * time.Second):
+			return collector.Values{"done": "true"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-	case <-time.After(5 * time.Second):
-		t.Errorf("meter points retrieval timeout")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := gmp.Retrieve(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("invalid meter points error: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("retrieval not cancelled: %v", d)
 	}
 }
 
@@ -0,0 +1,346 @@
+// System Monitor Daemon - Collector - HTTP Probe Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// httpProbeMaxBody is the maximum number of body bytes checked for the
+// expectations, larger bodies are only counted.
+const httpProbeMaxBody = 1 << 20
+
+//--------------------
+// HTTP PROBE
+//--------------------
+
+// HTTPProbe describes the HTTP(S) request of a probe. The body of the
+// response can be expected to match a regular expression and to contain
+// the value at a JSON path like "status" or "checks[0].state". With an
+// empty value the path only has to exist. Server certificates are
+// verified with the CAs of the CA file, if set, otherwise with the ones
+// of the system.
+type HTTPProbe struct {
+	URL       string
+	Match     string
+	JSONPath  string
+	JSONValue string
+	CAFile    string
+}
+
+//--------------------
+// HTTP PROBE METER POINTS
+//--------------------
+
+// HTTPProbeMeterPoints probe a service via HTTP(S). "success" is 1 if the
+// request succeeded with a status code below 400 and all expectations are
+// met, otherwise 0, failed requests set "error". Additionally the meter
+// points return "status.code", "body.size", "body.match" and "json.match"
+// if expected, and "tls.expiry.days" for HTTPS. The request phases are
+// returned in seconds as "duration.dns", "duration.connect",
+// "duration.tls", "duration.firstbyte" from the established connection
+// to the first response byte, and "duration.total". When redirected the
+// phases are the ones of the last request.
+type HTTPProbeMeterPoints struct {
+	id        string
+	url       string
+	match     *regexp.Regexp
+	jsonPath  []string
+	jsonValue string
+	transport *http.Transport
+}
+
+// NewHTTPProbeMeterPoints creates new meter points for a probe.
+func NewHTTPProbeMeterPoints(id string, probe HTTPProbe) (*HTTPProbeMeterPoints, error) {
+	u, err := url.Parse(probe.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid probe URL %q", probe.URL)
+	}
+	hmp := &HTTPProbeMeterPoints{
+		id:        id,
+		url:       u.String(),
+		jsonValue: probe.JSONValue,
+		transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{},
+		},
+	}
+	if probe.Match != "" {
+		if hmp.match, err = regexp.Compile(probe.Match); err != nil {
+			return nil, fmt.Errorf("invalid probe match: %v", err)
+		}
+	}
+	if probe.JSONPath != "" {
+		if hmp.jsonPath, err = parseJSONPath(probe.JSONPath); err != nil {
+			return nil, err
+		}
+	}
+	if probe.CAFile != "" {
+		pem, err := os.ReadFile(probe.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read probe CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in probe CA file %q", probe.CAFile)
+		}
+		hmp.transport.TLSClientConfig.RootCAs = pool
+	}
+	return hmp, nil
+}
+
+// ID implements MeterPoints.
+func (hmp *HTTPProbeMeterPoints) ID() string {
+	return hmp.id
+}
+
+// Retrieve implements MeterPoints. Failing probes are no errors of the
+// meter points, they are reported by the "success" value.
+func (hmp *HTTPProbeMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	trace := &probeTrace{}
+	start := time.Now()
+	values, err := hmp.probe(httptrace.WithClientTrace(ctx, trace.clientTrace()), trace)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		values = Values{
+			"success": "0",
+			"error":   "error: " + err.Error(),
+		}
+	}
+	values["duration.total"] = formatSeconds(time.Since(start))
+	return values, nil
+}
+
+// probe performs the request and checks the response.
+func (hmp *HTTPProbeMeterPoints) probe(ctx context.Context, trace *probeTrace) (Values, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", hmp.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: hmp.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			trace.reset()
+			return nil
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpProbeMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	rest, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	success := resp.StatusCode < 400
+	values := Values{
+		"status.code": strconv.Itoa(resp.StatusCode),
+		"body.size":   strconv.FormatInt(int64(len(body))+rest, 10),
+	}
+	for id, d := range trace.durations() {
+		values[id] = formatSeconds(d)
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		values["tls.expiry.days"] = strconv.Itoa(expiryDays(resp.TLS.PeerCertificates[0].NotAfter))
+	}
+	if hmp.match != nil {
+		ok := hmp.match.Match(body)
+		success = success && ok
+		values["body.match"] = formatBool(ok)
+	}
+	if hmp.jsonPath != nil {
+		ok := matchJSONPath(body, hmp.jsonPath, hmp.jsonValue)
+		success = success && ok
+		values["json.match"] = formatBool(ok)
+	}
+	values["success"] = formatBool(success)
+	return values, nil
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// probeTrace records the times of the request phases.
+type probeTrace struct {
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	firstByte    time.Time
+}
+
+// clientTrace returns the hooks setting the times.
+func (pt *probeTrace) clientTrace() *httptrace.ClientTrace {
+	set := func(t *time.Time) {
+		pt.mu.Lock()
+		defer pt.mu.Unlock()
+		*t = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { set(&pt.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { set(&pt.dnsDone) },
+		ConnectStart: func(network, addr string) {
+			pt.mu.Lock()
+			defer pt.mu.Unlock()
+			// Dual-stack dialing may start multiple connects.
+			if pt.connectStart.IsZero() {
+				pt.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				set(&pt.connectDone)
+			}
+		},
+		TLSHandshakeStart:    func() { set(&pt.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&pt.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { set(&pt.gotConn) },
+		GotFirstResponseByte: func() { set(&pt.firstByte) },
+	}
+}
+
+// reset clears the times before a redirected request.
+func (pt *probeTrace) reset() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.dnsStart, pt.dnsDone = time.Time{}, time.Time{}
+	pt.connectStart, pt.connectDone = time.Time{}, time.Time{}
+	pt.tlsStart, pt.tlsDone = time.Time{}, time.Time{}
+	pt.gotConn, pt.firstByte = time.Time{}, time.Time{}
+}
+
+// durations returns the durations of the request phases. Phases that
+// didn't happen, like DNS for IP addresses, have a duration of zero.
+func (pt *probeTrace) durations() map[string]time.Duration {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	between := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return end.Sub(start)
+	}
+	return map[string]time.Duration{
+		"duration.dns":       between(pt.dnsStart, pt.dnsDone),
+		"duration.connect":   between(pt.connectStart, pt.connectDone),
+		"duration.tls":       between(pt.tlsStart, pt.tlsDone),
+		"duration.firstbyte": between(pt.gotConn, pt.firstByte),
+	}
+}
+
+// parseJSONPath splits a path like "$.checks[0].state" into its keys
+// and indexes.
+func parseJSONPath(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	p = strings.Replace(strings.Replace(p, "[", ".", -1), "]", "", -1)
+	parts := strings.Split(p, ".")
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid JSON path %q", path)
+		}
+	}
+	return parts, nil
+}
+
+// matchJSONPath checks if the JSON document contains the value at the
+// path. With an empty value the path only has to exist.
+func matchJSONPath(doc []byte, path []string, value string) bool {
+	var current interface{}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	if err := decoder.Decode(&current); err != nil {
+		return false
+	}
+	for _, part := range path {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			v, ok := c[part]
+			if !ok {
+				return false
+			}
+			current = v
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return false
+			}
+			current = c[i]
+		default:
+			return false
+		}
+	}
+	if value == "" {
+		return true
+	}
+	if s, ok := current.(string); ok {
+		return s == value
+	}
+	b, err := json.Marshal(current)
+	return err == nil && string(b) == value
+}
+
+// expiryDays returns the full days until a certificate expires, negative
+// if it already expired.
+func expiryDays(notAfter time.Time) int {
+	return int(math.Floor(time.Until(notAfter).Hours() / 24))
+}
+
+// formatSeconds returns a duration as seconds.
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
+// formatBool returns 1 for true and 0 for false.
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// EOF
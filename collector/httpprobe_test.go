@@ -0,0 +1,217 @@
+// System Monitor Daemon - Collector - HTTP Probe Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestHTTPProbeOK tests probing a service with expectations.
+func TestHTTPProbeOK(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/health", http.StatusMovedPermanently)
+		case "/health":
+			w.Write([]byte(`{"status": "ok", "checks": [{"name": "db", "latency": 1.50, "up": true}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	hmp, err := collector.NewHTTPProbeMeterPoints("probe.app", collector.HTTPProbe{
+		URL:       srv.URL + "/old",
+		Match:     `"status":\s*"ok"`,
+		JSONPath:  "$.checks[0].latency",
+		JSONValue: "1.50",
+	})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	if hmp.ID() != "probe.app" {
+		t.Errorf("invalid meter points ID: %q", hmp.ID())
+	}
+	values, err := hmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["success"] != "1" || values["status.code"] != "200" || values["body.size"] != "73" ||
+		values["body.match"] != "1" || values["json.match"] != "1" {
+		t.Errorf("invalid values: %q", values)
+	}
+	if _, ok := values["tls.expiry.days"]; ok {
+		t.Errorf("unexpected certificate expiry: %q", values)
+	}
+	assertDurations(t, values, "connect", "firstbyte", "total")
+
+	// Expectations not met.
+	for _, probe := range []collector.HTTPProbe{
+		{URL: srv.URL + "/health", Match: "failed"},
+		{URL: srv.URL + "/health", JSONPath: "checks[0].up", JSONValue: "false"},
+		{URL: srv.URL + "/health", JSONPath: "checks.1"},
+		{URL: srv.URL + "/missing"},
+	} {
+		hmp, err := collector.NewHTTPProbeMeterPoints("probe.app", probe)
+		if err != nil {
+			t.Fatalf("cannot create meter points: %v", err)
+		}
+		values, err := hmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if values["success"] != "0" || values["body.match"] == "1" || values["json.match"] == "1" {
+			t.Errorf("%+v: invalid values: %q", probe, values)
+		}
+	}
+}
+
+// TestHTTPProbeTLS tests probing a service via HTTPS.
+func TestHTTPProbeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// Don't log the rejected handshake.
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatalf("cannot write CA file: %v", err)
+	}
+
+	hmp, err := collector.NewHTTPProbeMeterPoints("probe.app", collector.HTTPProbe{
+		URL:    srv.URL,
+		CAFile: caFile,
+	})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err := hmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	days, err := strconv.Atoi(values["tls.expiry.days"])
+	if values["success"] != "1" || err != nil || days <= 0 {
+		t.Errorf("invalid values: %q", values)
+	}
+	assertDurations(t, values, "tls")
+
+	// Unknown certificate authority.
+	hmp, err = collector.NewHTTPProbeMeterPoints("probe.app", collector.HTTPProbe{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err = hmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["success"] != "0" || !strings.Contains(values["error"], "certificate") {
+		t.Errorf("invalid values: %q", values)
+	}
+}
+
+// TestHTTPProbeDown tests probing an unreachable service.
+func TestHTTPProbeDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	hmp, err := collector.NewHTTPProbeMeterPoints("probe.app", collector.HTTPProbe{URL: "http://" + addr})
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err := hmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["success"] != "0" || !strings.HasPrefix(values["error"], "error: ") {
+		t.Errorf("invalid values: %q", values)
+	}
+
+	// Cancelled retrieval.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := hmp.Retrieve(ctx); err != context.Canceled {
+		t.Errorf("expected cancel error, got %v", err)
+	}
+}
+
+// TestHTTPProbeInvalid tests invalid probes.
+func TestHTTPProbeInvalid(t *testing.T) {
+	for _, def := range []collector.Definition{
+		{Type: collector.TypeHTTP, URL: "http://localhost"},
+		{Type: collector.TypeHTTP, ID: "probe.app"},
+		{Type: collector.TypeHTTP, ID: "probe.app", URL: "ftp://localhost"},
+		{Type: collector.TypeHTTP, ID: "probe.app", URL: "http://localhost", Match: "("},
+		{Type: collector.TypeHTTP, ID: "probe.app", URL: "http://localhost", JSONPath: "a..b"},
+		{Type: collector.TypeHTTP, ID: "probe.app", URL: "https://localhost", CAFile: "/does/not/exist"},
+	} {
+		if _, err := collector.NewDefinedMeterPoints(def); err == nil {
+			t.Errorf("expected error for %+v", def)
+		}
+	}
+	if _, err := collector.NewDefinedMeterPoints(collector.Definition{
+		Type: collector.TypeHTTP,
+		ID:   "probe.app",
+		URL:  "http://localhost",
+	}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// assertDurations checks if the durations of the request phases are
+// valid seconds, positive for the passed ones.
+func assertDurations(t *testing.T, values collector.Values, positive ...string) {
+	for _, phase := range []string{"dns", "connect", "tls", "firstbyte", "total"} {
+		id := "duration." + phase
+		d, err := strconv.ParseFloat(values[id], 64)
+		if err != nil || d < 0 {
+			t.Errorf("invalid %s: %q", id, values[id])
+		}
+		for _, p := range positive {
+			if p == phase && d == 0 {
+				t.Errorf("%s is zero", id)
+			}
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,147 @@
+// System Monitor Daemon - Collector - Logging
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Kinds of logged retrieval problems.
+const (
+	problemError   = "error"
+	problemTimeout = "timeout"
+	problemSlow    = "slow"
+	problemRunning = "running"
+)
+
+// defaultLogInterval is the minimum interval between two logs of the same
+// problem of the same meter points.
+const defaultLogInterval = time.Minute
+
+//--------------------
+// RETRIEVAL LOGGER
+//--------------------
+
+// problem contains the state of a logged problem of meter points.
+type problem struct {
+	logged     time.Time
+	suppressed int
+}
+
+// retrievalLogger logs the problems of meter point retrievals. To avoid log
+// floods when meter points fail in each poll the same problem is logged only
+// once per interval, together with the number of suppressed occurrences.
+type retrievalLogger struct {
+	mu       sync.Mutex
+	logger   *slog.Logger
+	slow     time.Duration
+	interval time.Duration
+	problems map[string]*problem
+}
+
+// newRetrievalLogger creates a logger for meter point retrievals. Retrievals
+// taking longer than slow are logged as slow, 0 disables it.
+func newRetrievalLogger(logger *slog.Logger, slow time.Duration) *retrievalLogger {
+	return &retrievalLogger{
+		logger:   logger,
+		slow:     slow,
+		interval: defaultLogInterval,
+		problems: make(map[string]*problem),
+	}
+}
+
+// retrieved logs a finished retrieval, erroneous values, and slowness.
+func (rl *retrievalLogger) retrieved(id string, values Values, d time.Duration) {
+	rl.logger.Debug("meter points retrieved", "id", id, "duration", d)
+	var errs []string
+	for vid, value := range values {
+		if strings.HasPrefix(value, "error:") {
+			errs = append(errs, vid+": "+strings.TrimSpace(strings.TrimPrefix(value, "error:")))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		rl.log(slog.LevelError, id, problemError, "meter points retrieval error",
+			"duration", d, "errors", errs)
+	} else {
+		rl.recovered(id, problemError)
+	}
+	rl.recovered(id, problemTimeout)
+	if rl.slow > 0 && d > rl.slow {
+		rl.log(slog.LevelWarn, id, problemSlow, "meter points retrieval slow",
+			"duration", d, "threshold", rl.slow)
+	} else {
+		rl.recovered(id, problemSlow)
+	}
+}
+
+// timedOut logs a timed out retrieval.
+func (rl *retrievalLogger) timedOut(id string, timeout time.Duration) {
+	rl.log(slog.LevelError, id, problemTimeout, "meter points retrieval timeout",
+		"timeout", timeout)
+}
+
+// stillRunning logs a skipped retrieval of meter points which are still
+// running in a different retrieval.
+func (rl *retrievalLogger) stillRunning(id string) {
+	rl.log(slog.LevelWarn, id, problemRunning, "meter points retrieval still running")
+}
+
+// log logs a problem if it hasn't been logged during the interval,
+// otherwise it's counted as suppressed.
+func (rl *retrievalLogger) log(level slog.Level, id, kind, msg string, args ...interface{}) {
+	rl.mu.Lock()
+	key := id + "/" + kind
+	p, ok := rl.problems[key]
+	if !ok {
+		p = &problem{}
+		rl.problems[key] = p
+	}
+	now := time.Now()
+	if ok && now.Sub(p.logged) < rl.interval {
+		p.suppressed++
+		rl.mu.Unlock()
+		return
+	}
+	suppressed := p.suppressed
+	p.logged = now
+	p.suppressed = 0
+	rl.mu.Unlock()
+	args = append([]interface{}{"id", id}, args...)
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	rl.logger.Log(context.Background(), level, msg, args...)
+}
+
+// recovered logs the ending of a logged problem.
+func (rl *retrievalLogger) recovered(id, kind string) {
+	rl.mu.Lock()
+	key := id + "/" + kind
+	_, ok := rl.problems[key]
+	delete(rl.problems, key)
+	rl.mu.Unlock()
+	if ok {
+		rl.logger.Info("meter points recovered", "id", id, "problem", kind)
+	}
+}
+
+// EOF
@@ -0,0 +1,121 @@
+// System Monitor Daemon - Collector - Logging - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestLogging tests the rate limited logging of retrieval problems.
+func TestLogging(t *testing.T) {
+	failing := true
+	buf := &syncBuffer{}
+	c := collector.New()
+	c.SetLogger(slog.New(slog.NewJSONHandler(buf, nil)), 50*time.Millisecond)
+	c.Register(
+		collector.NewGenericMeterPoints("flaky", func(ctx context.Context) (collector.Values, error) {
+			if failing {
+				return nil, errors.New("broken")
+			}
+			return collector.Values{"ok": "yes"}, nil
+		}),
+		newSleepingMeterPoints("slow", 100*time.Millisecond),
+		newSleepingMeterPoints("hanging", time.Second),
+	)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		c.Retrieve(ctx, 200*time.Millisecond)
+	}
+	failing = false
+	c.Retrieve(ctx, 200*time.Millisecond)
+
+	counts := map[string]int{}
+	for _, entry := range buf.entries(t) {
+		counts[entry["msg"].(string)+" "+entry["id"].(string)]++
+		if entry["msg"] == "meter points retrieval error" {
+			if errs, ok := entry["errors"].([]interface{}); !ok || len(errs) != 1 || errs[0] != "all: broken" {
+				t.Errorf("invalid logged errors: %v", entry["errors"])
+			}
+		}
+	}
+	expected := map[string]int{
+		"meter points retrieval error flaky":     1,
+		"meter points recovered flaky":           1,
+		"meter points retrieval slow slow":       1,
+		"meter points retrieval timeout hanging": 1,
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("logged %q %d times, expected %d", key, counts[key], count)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newSleepingMeterPoints creates meter points sleeping before returning.
+func newSleepingMeterPoints(id string, d time.Duration) collector.MeterPoints {
+	return collector.NewGenericMeterPoints(id, func(ctx context.Context) (collector.Values, error) {
+		select {
+		case <-time.After(d):
+			return collector.Values{"slept": d.String()}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+}
+
+// syncBuffer is a buffer which can be written concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements io.Writer.
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+// entries returns the written JSON log entries.
+func (sb *syncBuffer) entries(t *testing.T) []map[string]interface{} {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(&sb.buf)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("invalid log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// EOF
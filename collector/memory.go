@@ -13,7 +13,7 @@ package collector
 
 import (
 	"bufio"
-	"fmt"
+	"context"
 	"os"
 	"strings"
 )
@@ -49,32 +49,30 @@ func (mmp *MemoryMeterPoints) ID() string {
 }
 
 // Retrieve implements MeterPoints.
-func (mmp *MemoryMeterPoints) Retrieve() <-chan Values {
-	valuesC := make(chan Values, 1)
-	go func() {
-		file, err := os.Open("/proc/meminfo")
+func (mmp *MemoryMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	values := make(Values)
+	for {
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			valuesC <- Values{"all": fmt.Sprintf("error: %v", err)}
-			return
+			break
 		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
-		values := make(Values)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				break
-			}
-			fields := strings.Fields(line)
-			id, ok := mmp.prefixes[fields[0]]
-			if !ok {
-				continue
-			}
-			values[id] = fields[1]
+		fields := strings.Fields(line)
+		id, ok := mmp.prefixes[fields[0]]
+		if !ok {
+			continue
 		}
-		valuesC <- values
-	}()
-	return valuesC
+		values[id] = fields[1]
+	}
+	return values, nil
 }
 
 // EOF
@@ -0,0 +1,79 @@
+// System Monitor Daemon - Collector - Network Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"strings"
+)
+
+//--------------------
+// NETWORK METER POINTS
+//--------------------
+
+// networkColumns are the names of the used columns of /proc/net/dev.
+var networkColumns = map[int]string{
+	0:  "rx.bytes",
+	1:  "rx.packets",
+	2:  "rx.errors",
+	3:  "rx.drops",
+	8:  "tx.bytes",
+	9:  "tx.packets",
+	10: "tx.errors",
+	11: "tx.drops",
+}
+
+// NetworkMeterPoints retrieves the received and transmitted bytes, packets,
+// errors, and drops of all network interfaces by reading /proc/net/dev.
+type NetworkMeterPoints struct{}
+
+// NewNetworkMeterPoints creates new meter points for network interfaces.
+func NewNetworkMeterPoints() *NetworkMeterPoints {
+	return &NetworkMeterPoints{}
+}
+
+// ID implements MeterPoints.
+func (nmp *NetworkMeterPoints) ID() string {
+	return "sys.net"
+}
+
+// Retrieve implements MeterPoints.
+func (nmp *NetworkMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	values := make(Values)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			// Header lines.
+			continue
+		}
+		iface := strings.TrimSpace(parts[0])
+		for i, field := range strings.Fields(parts[1]) {
+			if column, ok := networkColumns[i]; ok {
+				values[iface+"."+column] = field
+			}
+		}
+	}
+	return values, scanner.Err()
+}
+
+// EOF
@@ -0,0 +1,43 @@
+// System Monitor Daemon - Collector - Network Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestNetworkOK tests retrieving the statistics of the loopback interface.
+func TestNetworkOK(t *testing.T) {
+	nmp := collector.NewNetworkMeterPoints()
+	if nmp.ID() != "sys.net" {
+		t.Errorf("invalid meter points ID: %q", nmp.ID())
+	}
+	values, err := nmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, id := range []string{"rx.bytes", "rx.packets", "rx.errors", "rx.drops", "tx.bytes", "tx.packets", "tx.errors", "tx.drops"} {
+		if _, err := strconv.ParseUint(values["lo."+id], 10, 64); err != nil {
+			t.Errorf("invalid value lo.%s: %q", id, values["lo."+id])
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,156 @@
+// System Monitor Daemon - Collector - Peer Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// peerMaxBody is the maximum number of bytes of the metrics read from a
+// peer, larger ones are an error.
+const peerMaxBody = 16 << 20
+
+//--------------------
+// PEER
+//--------------------
+
+// Peer is another system monitor daemon scraped by an aggregating one. The
+// URL is the one of its metrics endpoint, "/metrics" is added if it has no
+// path. The name defaults to the host name of the URL.
+type Peer struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url"`
+}
+
+// MeterPointsID returns the ID of the meter points scraping the peer. It's
+// the name with dots replaced by underscores, so that the values of the
+// peer are prefixed by one ID part.
+func (p Peer) MeterPointsID() string {
+	name := p.Name
+	if name == "" {
+		if u, err := url.Parse(p.URL); err == nil {
+			name = u.Hostname()
+		}
+	}
+	return strings.Replace(name, ".", "_", -1)
+}
+
+//--------------------
+// PEER METER POINTS
+//--------------------
+
+// PeerMeterPoints retrieves the latest metrics of a peer via its metrics
+// endpoint. Additionally "up" is 1 if the peer has been scraped
+// successfully, otherwise 0 and "scrape.error" contains the error.
+// "scrape.duration" contains the duration of the scrape in seconds.
+type PeerMeterPoints struct {
+	id     string
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewPeerMeterPoints creates new meter points for a peer. The token is
+// sent as bearer token if the peer requires authentication. Scrapes are
+// cancelled after the timeout.
+func NewPeerMeterPoints(peer Peer, token string, timeout time.Duration) (*PeerMeterPoints, error) {
+	u, err := url.Parse(peer.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid peer URL %q", peer.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/metrics"
+	}
+	id := peer.MeterPointsID()
+	if id == "" {
+		return nil, fmt.Errorf("peer %q needs a name", peer.URL)
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &PeerMeterPoints{
+		id:     id,
+		url:    u.String(),
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// ID implements MeterPoints.
+func (pmp *PeerMeterPoints) ID() string {
+	return pmp.id
+}
+
+// Retrieve implements MeterPoints. Failing scrapes are no errors of the
+// meter points, they are reported by the "up" value.
+func (pmp *PeerMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	start := time.Now()
+	values, err := pmp.scrape(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		values = Values{
+			"up":           "0",
+			"scrape.error": "error: " + err.Error(),
+		}
+	} else {
+		values["up"] = "1"
+	}
+	values["scrape.duration"] = fmt.Sprintf("%.6f", time.Since(start).Seconds())
+	return values, nil
+}
+
+// scrape retrieves the metrics of the peer.
+func (pmp *PeerMeterPoints) scrape(ctx context.Context) (Values, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pmp.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pmp.token != "" {
+		req.Header.Set("Authorization", "Bearer "+pmp.token)
+	}
+	resp, err := pmp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("peer returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, peerMaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > peerMaxBody {
+		return nil, fmt.Errorf("metrics larger than %d bytes", peerMaxBody)
+	}
+	values := Values{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		return nil, fmt.Errorf("invalid metrics: %v", err)
+	}
+	return values, nil
+}
+
+// EOF
@@ -0,0 +1,137 @@
+// System Monitor Daemon - Collector - Peer Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestPeerOK tests scraping a peer.
+func TestPeerOK(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" || r.Header.Get("Authorization") != "Bearer s3cr3t" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sys.mem.free": "2048", "sys.disk.root.all": "error: timeout"}`))
+	}))
+	defer srv.Close()
+	pmp, err := collector.NewPeerMeterPoints(collector.Peer{Name: "web1.example.com", URL: srv.URL}, "s3cr3t", time.Second)
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	if pmp.ID() != "web1_example_com" {
+		t.Errorf("invalid meter points ID: %q", pmp.ID())
+	}
+
+	c := collector.New()
+	c.Register(pmp)
+	values := c.Retrieve(context.Background(), 5*time.Second).Values()
+	if values["web1_example_com.up"] != "1" ||
+		values["web1_example_com.sys.mem.free"] != "2048" ||
+		values["web1_example_com.sys.disk.root.all"] != "error: timeout" {
+		t.Errorf("invalid values: %q", values)
+	}
+	if _, err := strconv.ParseFloat(values["web1_example_com.scrape.duration"], 64); err != nil {
+		t.Errorf("invalid scrape duration: %q", values["web1_example_com.scrape.duration"])
+	}
+}
+
+// TestPeerDown tests scraping failing peers.
+func TestPeerDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			http.Error(w, "no metrics", http.StatusServiceUnavailable)
+		case "/invalid":
+			w.Write([]byte("<html>"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	for path, expected := range map[string]string{
+		"/unavailable": "503 Service Unavailable",
+		"/invalid":     "invalid metrics",
+		"/slow":        "Timeout",
+	} {
+		pmp, err := collector.NewPeerMeterPoints(collector.Peer{URL: srv.URL + path}, "", 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("cannot create meter points: %v", err)
+		}
+		if pmp.ID() != "127_0_0_1" {
+			t.Errorf("invalid meter points ID: %q", pmp.ID())
+		}
+		values, err := pmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", path, err)
+		}
+		if values["up"] != "0" || !strings.HasPrefix(values["scrape.error"], "error: ") || !strings.Contains(values["scrape.error"], expected) {
+			t.Errorf("%s: invalid values: %q", path, values)
+		}
+	}
+}
+
+// TestPeerTooLarge tests that scraping stops at too large metrics.
+func TestPeerTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a":"`))
+		chunk := bytes.Repeat([]byte("x"), 1<<20)
+		for i := 0; i < 32; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+		w.Write([]byte(`"}`))
+	}))
+	defer srv.Close()
+	pmp, err := collector.NewPeerMeterPoints(collector.Peer{URL: srv.URL}, "", 5*time.Second)
+	if err != nil {
+		t.Fatalf("cannot create meter points: %v", err)
+	}
+	values, err := pmp.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values["up"] != "0" || !strings.Contains(values["scrape.error"], "metrics larger than") {
+		t.Errorf("invalid values: %.200q", values)
+	}
+}
+
+// TestPeerInvalid tests invalid peers.
+func TestPeerInvalid(t *testing.T) {
+	for _, peer := range []collector.Peer{
+		{URL: "ftp://web1/metrics"},
+		{URL: "http://"},
+		{URL: "::"},
+	} {
+		if _, err := collector.NewPeerMeterPoints(peer, "", 0); err == nil {
+			t.Errorf("expected error for %+v", peer)
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,191 @@
+// System Monitor Daemon - Collector - Port Check Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// portCheckMaxResponse is the maximum number of response bytes checked
+// for the expectation.
+const portCheckMaxResponse = 4096
+
+//--------------------
+// PORT CHECK
+//--------------------
+
+// PortCheck describes the check of a TCP or UDP port. The send data is
+// written after connecting, e.g. "PING\r\n" for Redis. The response has
+// to match the regular expression, if set, like "^220 " for the banner
+// of SMTP. UDP services have to respond to the send data. The check
+// fails after the timeout, by default 5 seconds.
+type PortCheck struct {
+	Network string
+	Address string
+	Send    string
+	Match   string
+	Timeout time.Duration
+}
+
+//--------------------
+// PORT CHECK METER POINTS
+//--------------------
+
+// PortCheckMeterPoints check if a port accepts connections and responds
+// as expected. "success" is 1 if the check succeeded, otherwise 0 and
+// "error" contains the reason. "duration.connect" and "duration.total"
+// are the durations in seconds, "response.match" is returned if a
+// response is expected.
+type PortCheckMeterPoints struct {
+	id      string
+	network string
+	address string
+	send    []byte
+	match   *regexp.Regexp
+	timeout time.Duration
+}
+
+// NewPortCheckMeterPoints creates new meter points for a port check.
+func NewPortCheckMeterPoints(id string, check PortCheck) (*PortCheckMeterPoints, error) {
+	network := check.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("invalid port check network %q", check.Network)
+	}
+	if _, _, err := net.SplitHostPort(check.Address); err != nil {
+		return nil, fmt.Errorf("invalid port check address %q", check.Address)
+	}
+	if network == "udp" && check.Send == "" {
+		return nil, fmt.Errorf("UDP port check needs send data")
+	}
+	pmp := &PortCheckMeterPoints{
+		id:      id,
+		network: network,
+		address: check.Address,
+		send:    []byte(check.Send),
+		timeout: check.Timeout,
+	}
+	if pmp.timeout <= 0 {
+		pmp.timeout = 5 * time.Second
+	}
+	if check.Match != "" {
+		var err error
+		if pmp.match, err = regexp.Compile(check.Match); err != nil {
+			return nil, fmt.Errorf("invalid port check match: %v", err)
+		}
+	}
+	return pmp, nil
+}
+
+// ID implements MeterPoints.
+func (pmp *PortCheckMeterPoints) ID() string {
+	return pmp.id
+}
+
+// Retrieve implements MeterPoints. Failing checks are no errors of the
+// meter points, they are reported by the "success" value.
+func (pmp *PortCheckMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	checkCtx, cancel := context.WithTimeout(ctx, pmp.timeout)
+	defer cancel()
+	start := time.Now()
+	values, err := pmp.check(checkCtx, start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		values["success"] = "0"
+		values["error"] = "error: " + err.Error()
+	} else {
+		values["success"] = "1"
+	}
+	values["duration.total"] = formatSeconds(time.Since(start))
+	return values, nil
+}
+
+// check connects to the port, sends the data, and checks the response.
+// The returned values are valid in case of errors too.
+func (pmp *PortCheckMeterPoints) check(ctx context.Context, start time.Time) (Values, error) {
+	values := Values{}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, pmp.network, pmp.address)
+	if err != nil {
+		return values, err
+	}
+	defer conn.Close()
+	values["duration.connect"] = formatSeconds(time.Since(start))
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if len(pmp.send) > 0 {
+		if _, err := conn.Write(pmp.send); err != nil {
+			return values, err
+		}
+	}
+	if pmp.match == nil && pmp.network == "tcp" {
+		return values, nil
+	}
+	response, err := pmp.receive(conn)
+	if pmp.match == nil {
+		return values, err
+	}
+	ok := pmp.match.Match(response)
+	values["response.match"] = formatBool(ok)
+	if !ok {
+		if err != nil {
+			return values, err
+		}
+		return values, fmt.Errorf("response %q doesn't match", response)
+	}
+	return values, nil
+}
+
+// receive reads the response. UDP services respond with one datagram,
+// TCP responses are read until they match the expectation.
+func (pmp *PortCheckMeterPoints) receive(conn net.Conn) ([]byte, error) {
+	buf := make([]byte, portCheckMaxResponse)
+	var response []byte
+	var err error
+	for len(response) < portCheckMaxResponse {
+		var n int
+		n, err = conn.Read(buf[:portCheckMaxResponse-len(response)])
+		response = append(response, buf[:n]...)
+		if err != nil || pmp.network == "udp" || pmp.match.Match(response) {
+			break
+		}
+	}
+	var netErr net.Error
+	switch {
+	case err == io.EOF && len(response) > 0:
+		return response, nil
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return response, errors.New("timeout waiting for response")
+	}
+	return response, err
+}
+
+// EOF
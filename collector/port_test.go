@@ -0,0 +1,186 @@
+// System Monitor Daemon - Collector - Port Check Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestPortCheckTCP tests checking TCP ports with and without banners.
+func TestPortCheckTCP(t *testing.T) {
+	smtp := listenTCP(t, func(conn net.Conn) {
+		conn.Write([]byte("220 mail.example.com ESMTP\r\n"))
+	})
+	defer smtp.Close()
+	redis := listenTCP(t, func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line == "PING\r\n" {
+			conn.Write([]byte("+PONG\r\n"))
+		}
+	})
+	defer redis.Close()
+	silent := listenTCP(t, func(conn net.Conn) {
+		time.Sleep(time.Second)
+	})
+	defer silent.Close()
+
+	for i, test := range []struct {
+		check   collector.PortCheck
+		success string
+		match   string
+		err     string
+	}{
+		{collector.PortCheck{Address: smtp.Addr().String()}, "1", "", ""},
+		{collector.PortCheck{Address: smtp.Addr().String(), Match: "^220 "}, "1", "1", ""},
+		{collector.PortCheck{Address: smtp.Addr().String(), Match: "^554 "}, "0", "0", "doesn't match"},
+		{collector.PortCheck{Address: redis.Addr().String(), Send: "PING\r\n", Match: `^\+PONG`}, "1", "1", ""},
+		{collector.PortCheck{Address: silent.Addr().String(), Match: "^220 ", Timeout: 50 * time.Millisecond}, "0", "0", "timeout"},
+		{collector.PortCheck{Address: closedAddress(t, "tcp")}, "0", "", "refused"},
+	} {
+		pmp, err := collector.NewPortCheckMeterPoints("check.port", test.check)
+		if err != nil {
+			t.Fatalf("%d: cannot create meter points: %v", i, err)
+		}
+		values, err := pmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if values["success"] != test.success || values["response.match"] != test.match ||
+			!strings.Contains(values["error"], test.err) {
+			t.Errorf("%d: invalid values: %q", i, values)
+		}
+		if _, err := strconv.ParseFloat(values["duration.total"], 64); err != nil {
+			t.Errorf("%d: invalid total duration: %q", i, values["duration.total"])
+		}
+		if test.success == "1" {
+			if _, err := strconv.ParseFloat(values["duration.connect"], 64); err != nil {
+				t.Errorf("%d: invalid connect duration: %q", i, values["duration.connect"])
+			}
+		}
+	}
+}
+
+// TestPortCheckUDP tests checking UDP services.
+func TestPortCheckUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				pc.WriteTo([]byte("pong"), addr)
+			}
+		}
+	}()
+
+	for i, test := range []struct {
+		check   collector.PortCheck
+		success string
+	}{
+		{collector.PortCheck{Network: "udp", Address: pc.LocalAddr().String(), Send: "ping"}, "1"},
+		{collector.PortCheck{Network: "udp", Address: pc.LocalAddr().String(), Send: "ping", Match: "^pong$"}, "1"},
+		{collector.PortCheck{Network: "udp", Address: pc.LocalAddr().String(), Send: "hello", Timeout: 50 * time.Millisecond}, "0"},
+		{collector.PortCheck{Network: "udp", Address: closedAddress(t, "udp"), Send: "ping", Timeout: 50 * time.Millisecond}, "0"},
+	} {
+		pmp, err := collector.NewPortCheckMeterPoints("check.port", test.check)
+		if err != nil {
+			t.Fatalf("%d: cannot create meter points: %v", i, err)
+		}
+		values, err := pmp.Retrieve(context.Background())
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if values["success"] != test.success || (test.success == "0") != strings.HasPrefix(values["error"], "error: ") {
+			t.Errorf("%d: invalid values: %q", i, values)
+		}
+	}
+}
+
+// TestPortCheckInvalid tests invalid port checks.
+func TestPortCheckInvalid(t *testing.T) {
+	for _, def := range []collector.Definition{
+		{Type: collector.TypePort, Address: "localhost:25"},
+		{Type: collector.TypePort, ID: "check.port"},
+		{Type: collector.TypePort, ID: "check.port", Address: "localhost"},
+		{Type: collector.TypePort, ID: "check.port", Address: "localhost:25", Network: "icmp"},
+		{Type: collector.TypePort, ID: "check.port", Address: "localhost:53", Network: "udp"},
+		{Type: collector.TypePort, ID: "check.port", Address: "localhost:25", Match: "("},
+	} {
+		if _, err := collector.NewDefinedMeterPoints(def); err == nil {
+			t.Errorf("expected error for %+v", def)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// listenTCP starts a TCP server handling each connection.
+func listenTCP(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// closedAddress returns a local address nobody listens on.
+func closedAddress(t *testing.T, network string) string {
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %v", err)
+		}
+		defer pc.Close()
+		return pc.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// EOF
@@ -0,0 +1,169 @@
+// System Monitor Daemon - Collector - Self Meter Points
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// RETRIEVAL STATISTICS
+//--------------------
+
+// retrievalStat contains the statistics of one meter points ID.
+type retrievalStat struct {
+	duration   time.Duration
+	retrievals int
+	errors     int
+	timeouts   int
+	skipped    int
+}
+
+// retrievalStats collects the statistics of all retrievals of a collector.
+// It uses an own mutex as it's updated by concurrent retrievals.
+type retrievalStats struct {
+	mu    sync.Mutex
+	stats map[string]*retrievalStat
+}
+
+// newRetrievalStats creates empty statistics.
+func newRetrievalStats() *retrievalStats {
+	return &retrievalStats{
+		stats: make(map[string]*retrievalStat),
+	}
+}
+
+// retrieved records a finished retrieval.
+func (rs *retrievalStats) retrieved(id string, values Values, d time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := rs.stat(id)
+	s.duration = d
+	s.retrievals++
+	for _, value := range values {
+		if strings.HasPrefix(value, "error:") {
+			s.errors++
+			break
+		}
+	}
+}
+
+// timedOut records a timed out retrieval.
+func (rs *retrievalStats) timedOut(id string, timeout time.Duration) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	s := rs.stat(id)
+	s.duration = timeout
+	s.retrievals++
+	s.timeouts++
+}
+
+// skipped records a skipped retrieval of still running meter points.
+func (rs *retrievalStats) skipped(id string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.stat(id).skipped++
+}
+
+// remove removes the statistic of unregistered or replaced meter points.
+func (rs *retrievalStats) remove(id string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.stats, id)
+}
+
+// stat returns the statistic for the ID, it's created if needed.
+func (rs *retrievalStats) stat(id string) *retrievalStat {
+	s, ok := rs.stats[id]
+	if !ok {
+		s = &retrievalStat{}
+		rs.stats[id] = s
+	}
+	return s
+}
+
+// values returns the statistics as values.
+func (rs *retrievalStats) values() Values {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	values := make(Values, len(rs.stats)*5)
+	for id, s := range rs.stats {
+		values["collector."+id+".duration"] = fmt.Sprintf("%.6f", s.duration.Seconds())
+		values["collector."+id+".retrievals"] = fmt.Sprintf("%d", s.retrievals)
+		values["collector."+id+".errors"] = fmt.Sprintf("%d", s.errors)
+		values["collector."+id+".timeouts"] = fmt.Sprintf("%d", s.timeouts)
+		values["collector."+id+".skipped"] = fmt.Sprintf("%d", s.skipped)
+	}
+	return values
+}
+
+//--------------------
+// SELF METER POINTS
+//--------------------
+
+// SelfMeterPoints retrieves metrics of the daemon itself: the retrieval
+// statistics of the collector, the Go runtime, and the number of open
+// file descriptors. Additional sources like HTTP statistics can be added.
+type SelfMeterPoints struct {
+	collector *Collector
+	sources   []func() Values
+}
+
+// NewSelfMeterPoints creates new meter points for the passed collector.
+// The values of the additional sources are added.
+func NewSelfMeterPoints(c *Collector, sources ...func() Values) *SelfMeterPoints {
+	return &SelfMeterPoints{
+		collector: c,
+		sources:   sources,
+	}
+}
+
+// ID implements MeterPoints.
+func (smp *SelfMeterPoints) ID() string {
+	return "sysmond.self"
+}
+
+// Retrieve implements MeterPoints.
+func (smp *SelfMeterPoints) Retrieve(ctx context.Context) (Values, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	values := smp.collector.stats.values()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	values["runtime.goroutines"] = fmt.Sprintf("%d", runtime.NumGoroutine())
+	values["runtime.heap.alloc"] = fmt.Sprintf("%d", ms.HeapAlloc)
+	values["runtime.heap.sys"] = fmt.Sprintf("%d", ms.HeapSys)
+	values["runtime.heap.objects"] = fmt.Sprintf("%d", ms.HeapObjects)
+	values["runtime.gc.count"] = fmt.Sprintf("%d", ms.NumGC)
+	values["runtime.gc.pause.total"] = fmt.Sprintf("%.6f", time.Duration(ms.PauseTotalNs).Seconds())
+	values["runtime.gc.pause.last"] = fmt.Sprintf("%.6f", time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).Seconds())
+	if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		values["process.fds"] = fmt.Sprintf("%d", len(fds))
+	} else {
+		values["process.fds"] = "error: cannot read open file descriptors"
+	}
+	for _, source := range smp.sources {
+		for id, value := range source() {
+			values[id] = value
+		}
+	}
+	return values, nil
+}
+
+// EOF
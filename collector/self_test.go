@@ -0,0 +1,110 @@
+// System Monitor Daemon - Collector - Self Meter Points - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package collector_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestSelf tests retrieving the metrics of the daemon itself.
+func TestSelf(t *testing.T) {
+	c := collector.New()
+	smp := collector.NewSelfMeterPoints(c, func() collector.Values {
+		return collector.Values{"source.value": "added"}
+	})
+	if smp.ID() != "sysmond.self" {
+		t.Errorf("invalid meter points ID: %q", smp.ID())
+	}
+	c.Register(
+		smp,
+		collector.NewGenericMeterPoints("failing", func(ctx context.Context) (collector.Values, error) {
+			return nil, errors.New("broken")
+		}),
+		newSleepingMeterPoints("hanging", time.Second),
+	)
+	ctx := context.Background()
+	c.Retrieve(ctx, 100*time.Millisecond, "failing", "hanging")
+	metrics := c.Retrieve(ctx, 100*time.Millisecond, "sysmond.self")
+
+	expected := map[string]string{
+		"sysmond.self.collector.failing.retrievals": "1",
+		"sysmond.self.collector.failing.errors":     "1",
+		"sysmond.self.collector.hanging.timeouts":   "1",
+		"sysmond.self.collector.hanging.duration":   "0.100000",
+		"sysmond.self.source.value":                 "added",
+	}
+	for id, value := range expected {
+		if v, ok := metrics.Get(id); !ok || v != value {
+			t.Errorf("illegal value %s: %q", id, v)
+		}
+	}
+	for _, id := range []string{"runtime.goroutines", "runtime.heap.alloc", "process.fds"} {
+		v, _ := metrics.Get("sysmond.self." + id)
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			t.Errorf("illegal value %s: %q", id, v)
+		}
+	}
+}
+
+// TestSelfRemoved tests that the retrieval statistics of unregistered and
+// replaced meter points are removed.
+func TestSelfRemoved(t *testing.T) {
+	c := collector.New()
+	newMeterPoints := func(id string) collector.MeterPoints {
+		return collector.NewGenericMeterPoints(id, func(ctx context.Context) (collector.Values, error) {
+			return collector.Values{"value": "1"}, nil
+		})
+	}
+	c.Register(
+		collector.NewSelfMeterPoints(c),
+		newMeterPoints("kept"),
+		newMeterPoints("gone"),
+		newMeterPoints("replaced"),
+		newSleepingMeterPoints("slow", 200*time.Millisecond),
+	)
+	ctx := context.Background()
+	c.Retrieve(ctx, time.Second, "kept", "gone", "replaced")
+	c.Unregister("gone")
+	c.Replace(newMeterPoints("replaced"))
+
+	// Retrievals finishing after unregistering aren't recorded.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Retrieve(ctx, time.Second, "slow")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Unregister("slow")
+	<-done
+
+	metrics := c.Retrieve(ctx, time.Second, "sysmond.self")
+	if v, ok := metrics.Get("sysmond.self.collector.kept.retrievals"); !ok || v != "1" {
+		t.Errorf("illegal value kept.retrievals: %q", v)
+	}
+	for _, id := range []string{"gone", "replaced", "slow"} {
+		if v, ok := metrics.Get("sysmond.self.collector." + id + ".retrievals"); ok {
+			t.Errorf("statistics of %s not removed: %q", id, v)
+		}
+	}
+}
+
+// EOF
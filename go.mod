@@ -1,6 +1,10 @@
 module github.com/themue/sysmond
 
+go 1.24
+
 require (
 	github.com/shirou/gopsutil v2.17.12+incompatible
-	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba // indirect
+	golang.org/x/crypto v0.0.0-20181009213950-7c1a557ab941
 )
+
+require golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba // indirect
@@ -0,0 +1,204 @@
+// System Monitor Daemon - Handler - Admin
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// AdminPath is the path of the meter points admin API.
+const AdminPath = "/admin/meterpoints"
+
+// maxDefinitionSize limits the size of a meter points definition.
+const maxDefinitionSize = 64 * 1024
+
+//--------------------
+// ADMIN HANDLER
+//--------------------
+
+// AdminEntry describes registered meter points. Meter points not created
+// by a definition, like the self meter points, have none.
+type AdminEntry struct {
+	ID         string                `json:"id"`
+	Definition *collector.Definition `json:"definition,omitempty"`
+}
+
+// adminHandler manages the meter points of a collector.
+type adminHandler struct {
+	mu          sync.Mutex
+	collector   *collector.Collector
+	definitions map[string]collector.Definition
+}
+
+// NewAdmin returns a handler for the meter points admin API at AdminPath.
+// GET on the path lists all meter points, GET, PUT, and DELETE on
+// AdminPath/{id} return, create or replace, and remove the meter points
+// with the ID. PUT takes the definition as JSON document. The passed
+// definitions are those the collector has been configured with. Meter
+// points registered without definition, like the self meter points or
+// those of fleet peers, are managed by the daemon and cannot be changed.
+func NewAdmin(c *collector.Collector, defs []collector.Definition) http.Handler {
+	h := &adminHandler{
+		collector:   c,
+		definitions: make(map[string]collector.Definition, len(defs)),
+	}
+	for _, def := range defs {
+		h.definitions[def.MeterPointsID()] = def
+	}
+	return h
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		h.list(w)
+	case id == "":
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, "", fmt.Errorf("method %s not allowed", r.Method))
+	case r.Method == http.MethodGet:
+		h.get(w, id)
+	case r.Method == http.MethodPut:
+		h.put(w, r, id)
+	case r.Method == http.MethodDelete:
+		h.delete(w, id)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "", fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// list writes all registered meter points.
+func (h *adminHandler) list(w http.ResponseWriter) {
+	ids := h.collector.List()
+	entries := make([]AdminEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = h.entry(id)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// get writes the meter points with the ID.
+func (h *adminHandler) get(w http.ResponseWriter, id string) {
+	if !h.registered(id) {
+		writeError(w, http.StatusNotFound, "", fmt.Errorf("meter points %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, h.entry(id))
+}
+
+// put creates or replaces the meter points with the ID.
+func (h *adminHandler) put(w http.ResponseWriter, r *http.Request, id string) {
+	var def collector.Definition
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDefinitionSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&def); err != nil {
+		writeError(w, http.StatusBadRequest, "", fmt.Errorf("invalid definition: %v", err))
+		return
+	}
+	if def.ID == "" {
+		def.ID = id
+	}
+	if def.MeterPointsID() != id {
+		writeError(w, http.StatusBadRequest, "", fmt.Errorf("definition is for meter points %q", def.MeterPointsID()))
+		return
+	}
+	mp, err := collector.NewDefinedMeterPoints(def)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err)
+		return
+	}
+	h.mu.Lock()
+	if h.reserved(id) {
+		h.mu.Unlock()
+		writeError(w, http.StatusConflict, "", fmt.Errorf("meter points %q are managed by the daemon", id))
+		return
+	}
+	code := http.StatusOK
+	if !h.registered(id) {
+		code = http.StatusCreated
+	}
+	h.collector.Replace(mp)
+	h.definitions[id] = def
+	h.mu.Unlock()
+	writeJSON(w, code, AdminEntry{ID: id, Definition: &def})
+}
+
+// delete removes the meter points with the ID.
+func (h *adminHandler) delete(w http.ResponseWriter, id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.reserved(id) {
+		writeError(w, http.StatusConflict, "", fmt.Errorf("meter points %q are managed by the daemon", id))
+		return
+	}
+	if err := h.collector.Unregister(id); err != nil {
+		writeError(w, http.StatusNotFound, "", errors.New(strings.TrimPrefix(err.Error(), "error: ")))
+		return
+	}
+	delete(h.definitions, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// entry returns the admin entry for the meter points ID.
+func (h *adminHandler) entry(id string) AdminEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry := AdminEntry{ID: id}
+	if def, ok := h.definitions[id]; ok {
+		entry.Definition = &def
+	}
+	return entry
+}
+
+// registered checks if the meter points ID is registered.
+func (h *adminHandler) registered(id string) bool {
+	for _, rid := range h.collector.List() {
+		if rid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// reserved checks if the meter points ID is registered without
+// definition. It has to be called with the lock held.
+func (h *adminHandler) reserved(id string) bool {
+	_, ok := h.definitions[id]
+	return !ok && h.registered(id)
+}
+
+// writeJSON writes the value as JSON document.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// EOF
@@ -0,0 +1,155 @@
+// System Monitor Daemon - Handler - Admin - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestAdmin tests managing meter points via the admin API.
+func TestAdmin(t *testing.T) {
+	c := collector.New()
+	disk := collector.Definition{Type: collector.TypeDisk, ID: "root", Mount: "/"}
+	peer, err := collector.NewPeerMeterPoints(collector.Peer{Name: "web1", URL: "http://web1:1984"}, "", 0)
+	if err != nil {
+		t.Fatalf("cannot create peer meter points: %v", err)
+	}
+	c.Register(
+		newValuesMeterPoints("version", collector.Values{"sysmond": "test"}),
+		collector.NewDiskMeterPoints("root", "/"),
+		collector.NewSelfMeterPoints(c),
+		peer,
+	)
+	auth := handler.NewAuth(map[string]handler.Permissions{
+		"deployer": {Admin: true},
+		"reader":   {},
+	}, handler.NewTokenAuthenticator(map[string]string{"d": "deployer", "r": "reader"}))
+	h := auth.ProtectAdmin(handler.AdminPath, handler.NewAdmin(c, []collector.Definition{disk}))
+	mux := http.NewServeMux()
+	mux.Handle(handler.AdminPath, h)
+	mux.Handle(handler.AdminPath+"/", h)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Only admins are allowed.
+	if code, _ := adminRequest(t, "GET", srv.URL+handler.AdminPath, "r", ""); code != http.StatusForbidden {
+		t.Errorf("reader not denied: %d", code)
+	}
+
+	// List and get.
+	code, body := adminRequest(t, "GET", srv.URL+handler.AdminPath, "d", "")
+	var entries []handler.AdminEntry
+	json.Unmarshal(body, &entries)
+	expected := []handler.AdminEntry{
+		{ID: "sys.disk.root", Definition: &disk},
+		{ID: "sysmond.self"},
+		{ID: "version"},
+		{ID: "web1"},
+	}
+	if code != http.StatusOK || !reflect.DeepEqual(entries, expected) {
+		t.Errorf("invalid list (%d): %s", code, body)
+	}
+	if code, _ := adminRequest(t, "GET", srv.URL+handler.AdminPath+"/version", "d", ""); code != http.StatusOK {
+		t.Errorf("invalid get status: %d", code)
+	}
+	if code, _ := adminRequest(t, "GET", srv.URL+handler.AdminPath+"/nope", "d", ""); code != http.StatusNotFound {
+		t.Errorf("invalid get status of unknown meter points: %d", code)
+	}
+
+	// Create, replace, and invalid definitions.
+	tests := []struct {
+		id   string
+		body string
+		code int
+	}{
+		{"app.check", `{"type": "command", "command": "/bin/true"}`, http.StatusCreated},
+		{"app.check", `{"type": "command", "command": "/bin/false"}`, http.StatusOK},
+		{"sys.mem", `{"type": "memory"}`, http.StatusCreated},
+		{"sys.disk.data", `{"type": "disk", "id": "data", "mount": "/"}`, http.StatusCreated},
+		{"other", `{"type": "memory"}`, http.StatusBadRequest},
+		{"app.x", `{"type": "command"}`, http.StatusBadRequest},
+		{"app.x", `{"type": "unknown"}`, http.StatusBadRequest},
+		{"app.x", `{"type": "command", "cmd": "/bin/true"}`, http.StatusBadRequest},
+		{"app.x", `no json`, http.StatusBadRequest},
+		{"sysmond.self", `{"type": "command", "command": "/bin/true"}`, http.StatusConflict},
+		{"web1", `{"type": "command", "command": "/bin/true"}`, http.StatusConflict},
+	}
+	for _, test := range tests {
+		code, body := adminRequest(t, "PUT", srv.URL+handler.AdminPath+"/"+test.id, "d", test.body)
+		if code != test.code {
+			t.Errorf("invalid put status for %s %s: %d (%s)", test.id, test.body, code, body)
+		}
+	}
+	_, body = adminRequest(t, "GET", srv.URL+handler.AdminPath+"/app.check", "d", "")
+	var entry handler.AdminEntry
+	json.Unmarshal(body, &entry)
+	if entry.Definition == nil || entry.Definition.Command != "/bin/false" {
+		t.Errorf("invalid replaced definition: %s", body)
+	}
+
+	// Delete.
+	if code, _ := adminRequest(t, "DELETE", srv.URL+handler.AdminPath+"/app.check", "d", ""); code != http.StatusNoContent {
+		t.Errorf("invalid delete status: %d", code)
+	}
+	if code, _ := adminRequest(t, "DELETE", srv.URL+handler.AdminPath+"/app.check", "d", ""); code != http.StatusNotFound {
+		t.Errorf("invalid delete status of unknown meter points: %d", code)
+	}
+	for _, id := range []string{"sysmond.self", "web1", "version"} {
+		if code, _ := adminRequest(t, "DELETE", srv.URL+handler.AdminPath+"/"+id, "d", ""); code != http.StatusConflict {
+			t.Errorf("invalid delete status of %s managed by the daemon: %d", id, code)
+		}
+	}
+	if code, _ := adminRequest(t, "POST", srv.URL+handler.AdminPath+"/app.check", "d", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("invalid status of unsupported method: %d", code)
+	}
+	if ids := c.List(); !reflect.DeepEqual(ids, []string{"sys.disk.data", "sys.disk.root", "sys.mem", "sysmond.self", "version", "web1"}) {
+		t.Errorf("illegal IDs: %v", ids)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// adminRequest performs a request against the admin API using the token.
+func adminRequest(t *testing.T, method, url, token, body string) (int, []byte) {
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("cannot create request: %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("cannot perform request: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("cannot read response: %v", err)
+	}
+	return resp.StatusCode, b
+}
+
+// EOF
@@ -0,0 +1,304 @@
+// System Monitor Daemon - Handler - Authentication and Authorisation
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//--------------------
+// AUTHENTICATORS
+//--------------------
+
+// Authenticator checks the credentials of a request and returns the name
+// of the authenticated identity. If the request contains no or invalid
+// credentials false is returned.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, bool)
+}
+
+// tokenAuthenticator authenticates requests by static bearer tokens.
+type tokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewTokenAuthenticator returns an authenticator for bearer tokens. The
+// passed map contains the tokens and the according identity names.
+func NewTokenAuthenticator(tokens map[string]string) Authenticator {
+	return &tokenAuthenticator{
+		tokens: tokens,
+	}
+}
+
+// Authenticate implements Authenticator.
+func (ta *tokenAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	// Compare all tokens in constant time.
+	identity := ""
+	for t, name := range ta.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			identity = name
+		}
+	}
+	return identity, identity != ""
+}
+
+// basicAuthenticator authenticates requests by HTTP basic authentication.
+type basicAuthenticator struct {
+	hashes map[string][]byte
+}
+
+// NewBasicAuthenticator returns an authenticator for HTTP basic authentication.
+// The passwords are read from a file containing lines "name:bcrypt-hash".
+// Empty lines and lines starting with "#" are ignored.
+func NewBasicAuthenticator(filename string) (Authenticator, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open password file: %v", err)
+	}
+	defer file.Close()
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid password file line %d", n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("invalid password hash in line %d: %v", n, err)
+		}
+		hashes[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read password file: %v", err)
+	}
+	return &basicAuthenticator{
+		hashes: hashes,
+	}, nil
+}
+
+// Authenticate implements Authenticator.
+func (ba *basicAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := ba.hashes[name]
+	if !ok {
+		return "", false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// certAuthenticator authenticates requests by verified client certificates.
+type certAuthenticator struct {
+	subjects map[string]string
+}
+
+// NewCertAuthenticator returns an authenticator for mutual TLS. The passed
+// map contains the common names of the certificate subjects and the according
+// identity names.
+func NewCertAuthenticator(subjects map[string]string) Authenticator {
+	return &certAuthenticator{
+		subjects: subjects,
+	}
+}
+
+// Authenticate implements Authenticator.
+func (ca *certAuthenticator) Authenticate(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	name, ok := ca.subjects[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+	return name, ok
+}
+
+//--------------------
+// AUTHORISATION
+//--------------------
+
+// Permissions define which metric ID prefixes and which endpoints an
+// identity may access. Empty lists allow all. A prefix allows the ID
+// itself and all IDs continuing with a dot, a trailing dot is optional.
+// Admin endpoints are only allowed with Admin set.
+type Permissions struct {
+	Prefixes  []string
+	Endpoints []string
+	Admin     bool
+}
+
+// allowsEndpoint checks if the endpoint may be accessed.
+func (p Permissions) allowsEndpoint(endpoint string) bool {
+	if len(p.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range p.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsID checks if the metric ID may be accessed.
+func (p Permissions) allowsID(id string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if below(id, strings.TrimSuffix(prefix, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMeterPoint checks if the meter points with the ID may be collected.
+// That's the case if a prefix is at or below their ID, or above it.
+func (p Permissions) allowsMeterPoint(id string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		prefix = strings.TrimSuffix(prefix, ".")
+		if below(id, prefix) || below(prefix, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionsKey is the context key for the permissions of a request.
+type permissionsKey struct{}
+
+// permitted returns the function checking if a metric ID may be accessed
+// by the identity of the request. It's nil for unrestricted access.
+func permitted(r *http.Request) func(id string) bool {
+	p, ok := r.Context().Value(permissionsKey{}).(Permissions)
+	if !ok || len(p.Prefixes) == 0 {
+		return nil
+	}
+	return p.allowsID
+}
+
+// permittedMeterPoint returns the function checking if meter points may be
+// collected for the identity of the request. It's nil for unrestricted
+// access.
+func permittedMeterPoint(r *http.Request) func(id string) bool {
+	p, ok := r.Context().Value(permissionsKey{}).(Permissions)
+	if !ok || len(p.Prefixes) == 0 {
+		return nil
+	}
+	return p.allowsMeterPoint
+}
+
+// below checks if the ID is the passed one or below it.
+func below(id, above string) bool {
+	return id == above || strings.HasPrefix(id, above+".")
+}
+
+//--------------------
+// AUTH
+//--------------------
+
+// Auth protects handlers by authenticating the requests and authorising
+// the identities.
+type Auth struct {
+	authenticators []Authenticator
+	permissions    map[string]Permissions
+	challenges     []string
+}
+
+// NewAuth creates an instance using the passed authenticators in their order.
+// Authenticated identities without permissions are rejected. Unauthenticated
+// requests are challenged for basic authentication only if it's configured,
+// otherwise for bearer tokens.
+func NewAuth(permissions map[string]Permissions, authenticators ...Authenticator) *Auth {
+	a := &Auth{
+		authenticators: authenticators,
+		permissions:    permissions,
+	}
+	for _, authenticator := range authenticators {
+		switch authenticator.(type) {
+		case *basicAuthenticator:
+			a.challenges = append(a.challenges, `Basic realm="sysmond"`)
+		case *tokenAuthenticator:
+			a.challenges = append(a.challenges, `Bearer realm="sysmond"`)
+		}
+	}
+	if len(a.challenges) == 0 {
+		a.challenges = []string{`Bearer realm="sysmond"`}
+	}
+	return a
+}
+
+// Protect wraps the handler for the named endpoint. Unauthenticated requests
+// are answered with 401, unauthorised ones with 403. The permissions of the
+// identity are passed to the handler, which filters the metric values.
+func (a *Auth) Protect(endpoint string, h http.Handler) http.Handler {
+	return a.protect(endpoint, false, h)
+}
+
+// ProtectAdmin works like Protect but additionally requires the Admin
+// permission of the identity.
+func (a *Auth) ProtectAdmin(endpoint string, h http.Handler) http.Handler {
+	return a.protect(endpoint, true, h)
+}
+
+// protect wraps the handler for the named endpoint, admin endpoints need
+// the according permission.
+func (a *Auth) protect(endpoint string, admin bool, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := ""
+		for _, authenticator := range a.authenticators {
+			if name, ok := authenticator.Authenticate(r); ok {
+				identity = name
+				break
+			}
+		}
+		if identity == "" {
+			for _, challenge := range a.challenges {
+				w.Header().Add("WWW-Authenticate", challenge)
+			}
+			writeError(w, http.StatusUnauthorized, "", errors.New("authentication required"))
+			return
+		}
+		p, ok := a.permissions[identity]
+		if !ok || !p.allowsEndpoint(endpoint) || (admin && !p.Admin) {
+			writeError(w, http.StatusForbidden, "", fmt.Errorf("access to %s denied", endpoint))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), permissionsKey{}, p)))
+	})
+}
+
+// EOF
@@ -0,0 +1,265 @@
+// System Monitor Daemon - Handler - Authentication and Authorisation - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestAuth tests authentication and authorisation of requests.
+func TestAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := collector.New()
+	c.Register(
+		newValuesMeterPoints("sys.mem", collector.Values{"total": "1000"}),
+		newValuesMeterPoints("app", collector.Values{"secret": "42"}),
+	)
+	p := poller.New(ctx, c, 20*time.Millisecond)
+	for !p.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	file, err := ioutil.TempFile("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create password file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# users\nops:" + string(hash) + "\n")
+	file.Close()
+	ba, err := handler.NewBasicAuthenticator(file.Name())
+	if err != nil {
+		t.Fatalf("cannot create basic authenticator: %v", err)
+	}
+
+	auth := handler.NewAuth(map[string]handler.Permissions{
+		"ops":       {},
+		"wallboard": {Prefixes: []string{"sys."}},
+		"robot":     {Endpoints: []string{"/metrics/stream"}},
+	},
+		handler.NewCertAuthenticator(map[string]string{"wallboard.example.com": "wallboard"}),
+		handler.NewTokenAuthenticator(map[string]string{"t0k3n": "robot", "w4ll": "wallboard"}),
+		ba,
+	)
+	h := auth.Protect("/metrics", handler.New(p))
+
+	tests := []struct {
+		name    string
+		prepare func(r *http.Request)
+		code    int
+		ids     []string
+	}{
+		{"none", func(r *http.Request) {}, http.StatusUnauthorized, nil},
+		{"basic ok", func(r *http.Request) { r.SetBasicAuth("ops", "s3cr3t") }, http.StatusOK, []string{"sys.mem.total", "app.secret"}},
+		{"basic wrong password", func(r *http.Request) { r.SetBasicAuth("ops", "guess") }, http.StatusUnauthorized, nil},
+		{"basic unknown user", func(r *http.Request) { r.SetBasicAuth("eve", "s3cr3t") }, http.StatusUnauthorized, nil},
+		{"token prefixes", func(r *http.Request) { r.Header.Set("Authorization", "Bearer w4ll") }, http.StatusOK, []string{"sys.mem.total"}},
+		{"token endpoint denied", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0k3n") }, http.StatusForbidden, nil},
+		{"token invalid", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized, nil},
+		{"certificate", func(r *http.Request) { r.TLS = newConnectionState("wallboard.example.com") }, http.StatusOK, []string{"sys.mem.total"}},
+		{"unknown certificate", func(r *http.Request) { r.TLS = newConnectionState("eve.example.com") }, http.StatusUnauthorized, nil},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		test.prepare(r)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: invalid status code: %d", test.name, w.Code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var values collector.Values
+		if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil {
+			t.Errorf("%s: invalid metrics document: %v", test.name, err)
+			continue
+		}
+		if len(values) != len(test.ids) {
+			t.Errorf("%s: invalid values: %v", test.name, values)
+		}
+		for _, id := range test.ids {
+			if _, ok := values[id]; !ok {
+				t.Errorf("%s: missing value %q", test.name, id)
+			}
+		}
+	}
+}
+
+// TestAuthFresh tests that on-demand collections are restricted to the
+// permitted meter points.
+func TestAuthFresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var retrievals atomic.Int64
+	c := collector.New()
+	c.Register(
+		newValuesMeterPoints("sys.mem", collector.Values{"total": "1000", "free": "500"}),
+		newValuesMeterPoints("sys.memory", collector.Values{"used": "10"}),
+		collector.NewGenericMeterPoints("app", func(ctx context.Context) (collector.Values, error) {
+			retrievals.Add(1)
+			return collector.Values{"secret": "42"}, nil
+		}),
+	)
+	p := poller.New(ctx, c, time.Hour)
+	for !p.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	auth := handler.NewAuth(map[string]handler.Permissions{
+		"wallboard": {Prefixes: []string{"sys."}},
+		"memory":    {Prefixes: []string{"sys.mem"}},
+		"free":      {Prefixes: []string{"sys.mem.free"}},
+	}, handler.NewTokenAuthenticator(map[string]string{"w4ll": "wallboard", "m3m": "memory", "fr33": "free"}))
+	h := auth.Protect("/metrics", handler.New(p))
+
+	for _, test := range []struct {
+		token string
+		query string
+		code  int
+		ids   []string
+	}{
+		{"w4ll", "?fresh=1", http.StatusOK, []string{"sys.mem.total", "sys.mem.free", "sys.memory.used"}},
+		{"w4ll", "?fresh=1&id=sys.mem", http.StatusOK, []string{"sys.mem.total", "sys.mem.free"}},
+		{"w4ll", "?fresh=1&id=app", http.StatusForbidden, nil},
+		{"w4ll", "?fresh=1&id=sys.mem&id=app", http.StatusForbidden, nil},
+		{"m3m", "?fresh=1", http.StatusOK, []string{"sys.mem.total", "sys.mem.free"}},
+		{"m3m", "", http.StatusOK, []string{"sys.mem.total", "sys.mem.free"}},
+		{"m3m", "?fresh=1&id=sys.memory", http.StatusForbidden, nil},
+		{"fr33", "?fresh=1&id=sys.mem", http.StatusOK, []string{"sys.mem.free"}},
+		{"fr33", "?fresh=1", http.StatusOK, []string{"sys.mem.free"}},
+	} {
+		r := httptest.NewRequest("GET", "/metrics"+test.query, nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: invalid status code: %d", test.token, test.query, w.Code)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var values collector.Values
+		if err := json.Unmarshal(w.Body.Bytes(), &values); err != nil {
+			t.Errorf("%s %s: invalid metrics document: %v", test.token, test.query, err)
+			continue
+		}
+		if len(values) != len(test.ids) {
+			t.Errorf("%s %s: invalid values: %v", test.token, test.query, values)
+		}
+		for _, id := range test.ids {
+			if _, ok := values[id]; !ok {
+				t.Errorf("%s %s: missing value %q", test.token, test.query, id)
+			}
+		}
+	}
+	if n := retrievals.Load(); n != 1 {
+		t.Errorf("not permitted meter point collected: %d retrievals", n)
+	}
+}
+
+// TestAuthChallenge tests the challenges of unauthenticated requests
+// depending on the configured authenticators.
+func TestAuthChallenge(t *testing.T) {
+	file, err := ioutil.TempFile("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create password file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+	ba, err := handler.NewBasicAuthenticator(file.Name())
+	if err != nil {
+		t.Fatalf("cannot create basic authenticator: %v", err)
+	}
+	ta := handler.NewTokenAuthenticator(map[string]string{"t0k3n": "robot"})
+	ca := handler.NewCertAuthenticator(map[string]string{"robot.example.com": "robot"})
+
+	for _, test := range []struct {
+		name           string
+		authenticators []handler.Authenticator
+		challenges     []string
+	}{
+		{"basic", []handler.Authenticator{ba}, []string{`Basic realm="sysmond"`}},
+		{"token", []handler.Authenticator{ta}, []string{`Bearer realm="sysmond"`}},
+		{"certificate", []handler.Authenticator{ca}, []string{`Bearer realm="sysmond"`}},
+		{"all", []handler.Authenticator{ca, ta, ba}, []string{`Bearer realm="sysmond"`, `Basic realm="sysmond"`}},
+	} {
+		auth := handler.NewAuth(nil, test.authenticators...)
+		h := auth.Protect("/metrics", http.NotFoundHandler())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if challenges := w.Header()["Www-Authenticate"]; w.Code != http.StatusUnauthorized || !reflect.DeepEqual(challenges, test.challenges) {
+			t.Errorf("%s: invalid challenges (%d): %q", test.name, w.Code, challenges)
+		}
+	}
+}
+
+// TestBasicAuthenticatorInvalid tests reading invalid password files.
+func TestBasicAuthenticatorInvalid(t *testing.T) {
+	if _, err := handler.NewBasicAuthenticator("/does/not/exist"); err == nil {
+		t.Errorf("expected error for missing file")
+	}
+	file, err := ioutil.TempFile("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create password file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("ops:plaintext\n")
+	file.Close()
+	if _, err := handler.NewBasicAuthenticator(file.Name()); err == nil {
+		t.Errorf("expected error for plaintext password")
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newConnectionState simulates a connection with a verified client certificate.
+func newConnectionState(cn string) *tls.ConnectionState {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: cn},
+	}
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+}
+
+// EOF
@@ -0,0 +1,128 @@
+// System Monitor Daemon - Handler - Metrics Filter
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+//--------------------
+// PATTERN
+//--------------------
+
+// pattern matches metric IDs. It is created out of a string which is
+// interpreted as regular expression when enclosed in slashes, as glob
+// when containing any of "*?[", and as ID prefix otherwise. A prefix
+// matches the ID itself and all IDs continuing with a dot, so "sys.mem"
+// matches "sys.mem.free" but not "sys.memory".
+type pattern func(id string) bool
+
+// compilePattern creates a pattern out of its string representation.
+func compilePattern(s string) (pattern, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("empty pattern")
+	case len(s) > 1 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %v", s, err)
+		}
+		return re.MatchString, nil
+	case strings.ContainsAny(s, "*?["):
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", s, err)
+		}
+		return func(id string) bool {
+			ok, _ := path.Match(s, id)
+			return ok
+		}, nil
+	default:
+		return func(id string) bool {
+			return id == s || strings.HasPrefix(id, s+".")
+		}, nil
+	}
+}
+
+// compilePatterns creates a list of patterns.
+func compilePatterns(ss []string) ([]pattern, error) {
+	patterns := make([]pattern, len(ss))
+	for i, s := range ss {
+		p, err := compilePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		patterns[i] = p
+	}
+	return patterns, nil
+}
+
+// matchAny checks if any of the patterns matches the ID.
+func matchAny(patterns []pattern, id string) bool {
+	for _, p := range patterns {
+		if p(id) {
+			return true
+		}
+	}
+	return false
+}
+
+//--------------------
+// FILTER
+//--------------------
+
+// filter selects metric values by ID and state.
+type filter struct {
+	match      []pattern
+	exclude    []pattern
+	errorsOnly bool
+}
+
+// newFilter creates a filter out of the query parameters "match" and
+// "exclude", both may be passed multiple times, and "errors=1" to select
+// only erroneous values.
+func newFilter(query url.Values) (*filter, error) {
+	match, err := compilePatterns(query["match"])
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(query["exclude"])
+	if err != nil {
+		return nil, err
+	}
+	return &filter{
+		match:      match,
+		exclude:    exclude,
+		errorsOnly: query.Get("errors") == "1",
+	}, nil
+}
+
+// isEmpty returns true if the filter selects all values.
+func (f *filter) isEmpty() bool {
+	return len(f.match) == 0 && len(f.exclude) == 0 && !f.errorsOnly
+}
+
+// selects checks if the filter selects the passed value.
+func (f *filter) selects(id, value string) bool {
+	if f.errorsOnly && !strings.HasPrefix(value, "error:") {
+		return false
+	}
+	if len(f.match) > 0 && !matchAny(f.match, id) {
+		return false
+	}
+	return !matchAny(f.exclude, id)
+}
+
+// EOF
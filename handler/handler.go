@@ -12,7 +12,8 @@ package handler
 //--------------------
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -25,38 +26,119 @@ import (
 // METRICS HANDLER
 //--------------------
 
-// metricsHandler provides a http.Handler running the metrics server.
+// handler provides a http.Handler serving the latest metrics of a poller.
 type handler struct {
-	collector *collector.Collector
-	poller    *poller.Poller
+	poller *poller.Poller
 }
 
-// newMetricsHandler returns a new metrics handler instance.
-func New(ctx context.Context, c *collector.Collector, i time.Duration) http.Handler {
+// New returns a new metrics handler instance.
+func New(p *poller.Poller) http.Handler {
 	return &handler{
-		collector: c,
-		poller:    poller.New(ctx, c, i),
+		poller: p,
 	}
 }
 
-// ServeHTTP implements the http.Handler interface.
+// ServeHTTP implements the http.Handler interface. The returned metrics can
+// be selected by the query parameters "match", "exclude", and "errors". With
+// "fresh=1" the metrics are collected immediately instead of returning the
+// latest polled ones. Here "id" limits the collection to the given meter
+// points and "timeout" sets the retrieval timeout. Only meter points the
+// identity of the request is permitted to access are collected. Values
+// the identity isn't permitted to access are removed.
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ts, m := h.poller.Metrics()
+	query := r.URL.Query()
+	f, err := newFilter(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err)
+		return
+	}
+	var ts time.Time
+	var m *collector.Metrics
+	if query.Get("fresh") == "1" {
+		timeout := h.poller.Interval()
+		if query.Get("timeout") != "" {
+			timeout, err = time.ParseDuration(query.Get("timeout"))
+			if err != nil || timeout <= 0 {
+				writeError(w, http.StatusBadRequest, "", fmt.Errorf("invalid timeout %q", query.Get("timeout")))
+				return
+			}
+		}
+		ids := query["id"]
+		if allowed := permittedMeterPoint(r); allowed != nil {
+			if ids, err = permittedMeterPoints(h.poller, allowed, ids); err != nil {
+				writeError(w, http.StatusForbidden, "", err)
+				return
+			}
+		}
+		u, err := h.poller.Collect(r.Context(), timeout, ids...)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, "", err)
+			return
+		}
+		ts, m = u.Timestamp, u.Metrics
+	} else {
+		ts, m = h.poller.Metrics()
+	}
+	if m == nil {
+		writeError(w, http.StatusServiceUnavailable, "", errors.New("no metrics collected yet"))
+		return
+	}
 	tsb, _ := ts.MarshalText()
 	tss := string(tsb)
+	if allowed := permitted(r); allowed != nil {
+		m = m.Filter(func(id, value string) bool {
+			return allowed(id) && f.selects(id, value)
+		})
+	} else if !f.isEmpty() {
+		m = m.Filter(f.selects)
+	}
 	b, err := m.Marshal()
 	if err != nil {
-		errDoc := fmt.Sprintf("{\"error\": \"%v\"}", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Timestamp", tss)
-		w.Write([]byte(errDoc))
+		writeError(w, http.StatusInternalServerError, tss, err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Timestamp", tss)
+	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
 
+//--------------------
+// HELPERS
+//--------------------
+
+// permittedMeterPoints checks if the requested meter points may be
+// accessed before collecting them. Without requested meter points all
+// permitted ones are returned.
+func permittedMeterPoints(p *poller.Poller, allowed func(id string) bool, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		for _, id := range p.MeterPoints() {
+			if allowed(id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("no permitted meter points")
+		}
+		return ids, nil
+	}
+	for _, id := range ids {
+		if !allowed(id) {
+			return nil, fmt.Errorf("meter point %q not permitted", id)
+		}
+	}
+	return ids, nil
+}
+
+// writeError writes an error document with the passed status code.
+func writeError(w http.ResponseWriter, code int, tss string, err error) {
+	errDoc, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	if tss != "" {
+		w.Header().Set("X-Timestamp", tss)
+	}
+	w.WriteHeader(code)
+	w.Write(errDoc)
+}
+
 // EOF
@@ -0,0 +1,147 @@
+// System Monitor Daemon - Handler - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestMetricsFilter tests the selection of metrics by query parameters.
+func TestMetricsFilter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := collector.New()
+	c.Register(
+		newValuesMeterPoints("sys.disk.root", collector.Values{"total": "100", "used": "50"}),
+		newValuesMeterPoints("sys.disk.home", collector.Values{"total": "200", "used": "20"}),
+		newValuesMeterPoints("sys.mem", collector.Values{"total": "1000", "free": "500"}),
+		collector.NewGenericMeterPoints("app", func(ctx context.Context) (collector.Values, error) {
+			return nil, errors.New("failed")
+		}),
+	)
+	p := poller.New(ctx, c, 20*time.Millisecond)
+	s := p.Subscribe()
+	<-s.Updates()
+	s.Unsubscribe()
+	srv := httptest.NewServer(handler.New(p))
+	defer srv.Close()
+
+	tests := []struct {
+		query string
+		ids   []string
+	}{
+		{"", []string{"sys.disk.root.total", "sys.disk.root.used", "sys.disk.home.total", "sys.disk.home.used", "sys.mem.total", "sys.mem.free", "app.all"}},
+		{"?match=sys.disk", []string{"sys.disk.root.total", "sys.disk.root.used", "sys.disk.home.total", "sys.disk.home.used"}},
+		{"?match=sys.disk.ro", []string{}},
+		{"?match=sys.mem.total", []string{"sys.mem.total"}},
+		{"?match=sys.*.total", []string{"sys.disk.root.total", "sys.disk.home.total", "sys.mem.total"}},
+		{"?match=/^sys\\.(mem|disk\\.root)\\.t/", []string{"sys.disk.root.total", "sys.mem.total"}},
+		{"?match=sys.mem&match=app", []string{"sys.mem.total", "sys.mem.free", "app.all"}},
+		{"?match=sys&exclude=*.used&exclude=sys.mem", []string{"sys.disk.root.total", "sys.disk.home.total"}},
+		{"?errors=1", []string{"app.all"}},
+		{"?errors=1&match=sys", []string{}},
+	}
+	for _, test := range tests {
+		values, code := getMetrics(t, srv.URL+test.query)
+		if code != http.StatusOK {
+			t.Errorf("query %q: invalid status code: %d", test.query, code)
+			continue
+		}
+		if len(values) != len(test.ids) {
+			t.Errorf("query %q: invalid number of values: %v", test.query, values)
+		}
+		for _, id := range test.ids {
+			if _, ok := values[id]; !ok {
+				t.Errorf("query %q: missing value %q", test.query, id)
+			}
+		}
+	}
+
+	// Invalid patterns.
+	for _, query := range []string{"?match=/(/", "?exclude=sys.[", "?match="} {
+		values, code := getMetrics(t, srv.URL+query)
+		if code != http.StatusBadRequest {
+			t.Errorf("query %q: invalid status code: %d", query, code)
+		}
+		if values["error"] == "" {
+			t.Errorf("query %q: missing error", query)
+		}
+	}
+}
+
+// TestMetricsFresh tests the on-demand collection of metrics.
+func TestMetricsFresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := collector.New()
+	c.Register(
+		newValuesMeterPoints("a", collector.Values{"value": "1"}),
+		newValuesMeterPoints("b", collector.Values{"value": "2"}),
+	)
+	p := poller.New(ctx, c, time.Hour)
+	srv := httptest.NewServer(handler.New(p))
+	defer srv.Close()
+
+	values, code := getMetrics(t, srv.URL+"?fresh=1")
+	if code != http.StatusOK || values["a.value"] != "1" || values["b.value"] != "2" {
+		t.Errorf("invalid fresh metrics (%d): %v", code, values)
+	}
+	values, code = getMetrics(t, srv.URL+"?fresh=1&id=b&timeout=1s")
+	if code != http.StatusOK || len(values) != 1 || values["b.value"] != "2" {
+		t.Errorf("invalid selected fresh metrics (%d): %v", code, values)
+	}
+	values, code = getMetrics(t, srv.URL+"?fresh=1&timeout=soon")
+	if code != http.StatusBadRequest || values["error"] != `invalid timeout "soon"` {
+		t.Errorf("invalid timeout not rejected (%d): %v", code, values)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newValuesMeterPoints creates meter points always returning the passed values.
+func newValuesMeterPoints(id string, values collector.Values) collector.MeterPoints {
+	return collector.NewGenericMeterPoints(id, func(ctx context.Context) (collector.Values, error) {
+		return values, nil
+	})
+}
+
+// getMetrics retrieves the metrics document and the status code.
+func getMetrics(t *testing.T, url string) (collector.Values, int) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	var values collector.Values
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		t.Fatalf("invalid metrics document: %v", err)
+	}
+	return values, resp.StatusCode
+}
+
+// EOF
@@ -0,0 +1,66 @@
+// System Monitor Daemon - Handler - Health and Readiness
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// HEALTH HANDLERS
+//--------------------
+
+// statusHandler reports the state of the poller as returned by the check.
+type statusHandler struct {
+	check       func() bool
+	okStatus    string
+	notOKStatus string
+}
+
+// NewReady returns a handler reporting if the poller has retrieved its first
+// metrics. This is intended for readiness probes of orchestrators.
+func NewReady(p *poller.Poller) http.Handler {
+	return &statusHandler{
+		check:       p.Ready,
+		okStatus:    "ready",
+		notOKStatus: "not ready",
+	}
+}
+
+// NewHealth returns a handler reporting if the poller is running. This is
+// intended for liveness probes of orchestrators.
+func NewHealth(p *poller.Poller) http.Handler {
+	return &statusHandler{
+		check:       p.Running,
+		okStatus:    "ok",
+		notOKStatus: "stopped",
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code := http.StatusOK
+	status := h.okStatus
+	if !h.check() {
+		code = http.StatusServiceUnavailable
+		status = h.notOKStatus
+	}
+	b, _ := json.Marshal(map[string]string{"status": status})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// EOF
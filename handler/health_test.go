@@ -0,0 +1,119 @@
+// System Monitor Daemon - Handler - Health and Readiness - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestReadiness tests the reporting of readiness and health.
+func TestReadiness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	releaseC := make(chan struct{})
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("slow", func(ctx context.Context) (collector.Values, error) {
+		<-releaseC
+		return collector.Values{"done": "yes"}, nil
+	}))
+	p := poller.New(ctx, c, time.Hour)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler.New(p))
+	mux.Handle("/ready", handler.NewReady(p))
+	mux.Handle("/healthz", handler.NewHealth(p))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Before the first collection.
+	values, code := getMetrics(t, srv.URL+"/metrics")
+	if code != http.StatusServiceUnavailable || values["error"] != "no metrics collected yet" {
+		t.Errorf("invalid metrics before first collection (%d): %v", code, values)
+	}
+	assertStatus(t, srv.URL+"/ready", http.StatusServiceUnavailable, "not ready")
+	assertStatus(t, srv.URL+"/healthz", http.StatusOK, "ok")
+
+	// After the first collection.
+	close(releaseC)
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no initial collection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	values, code = getMetrics(t, srv.URL+"/metrics")
+	if code != http.StatusOK || values["slow.done"] != "yes" {
+		t.Errorf("invalid metrics after first collection (%d): %v", code, values)
+	}
+	assertStatus(t, srv.URL+"/ready", http.StatusOK, "ready")
+
+	// After stopping.
+	cancel()
+	assertStatus(t, srv.URL+"/healthz", http.StatusServiceUnavailable, "stopped")
+}
+
+// TestHealthDuringCollection tests that readiness and health are reported
+// immediately while collections are running.
+func TestHealthDuringCollection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("slow", func(ctx context.Context) (collector.Values, error) {
+		time.Sleep(500 * time.Millisecond)
+		return collector.Values{"done": "yes"}, nil
+	}))
+	p := poller.New(ctx, c, 10*time.Millisecond)
+	mux := http.NewServeMux()
+	mux.Handle("/ready", handler.NewReady(p))
+	mux.Handle("/healthz", handler.NewHealth(p))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	for !p.Ready() {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		assertStatus(t, srv.URL+"/healthz", http.StatusOK, "ok")
+		assertStatus(t, srv.URL+"/ready", http.StatusOK, "ready")
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("status blocked by collection: %v", d)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// assertStatus checks the status code and document of a health request.
+func assertStatus(t *testing.T, url string, code int, status string) {
+	values, rcode := getMetrics(t, url)
+	if rcode != code || values["status"] != status {
+		t.Errorf("%s: invalid status (%d): %v", url, rcode, values)
+	}
+}
+
+// EOF
@@ -0,0 +1,297 @@
+// System Monitor Daemon - Handler - WebSocket Live Metrics
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Message types of the live metrics protocol.
+const (
+	MsgSubscribe   = "subscribe"
+	MsgUnsubscribe = "unsubscribe"
+	MsgRate        = "rate"
+	MsgRefresh     = "refresh"
+	MsgMetrics     = "metrics"
+	MsgError       = "error"
+)
+
+// Timeouts of the live metrics connections.
+const (
+	liveWriteTimeout       = 10 * time.Second
+	liveDefaultIdleTimeout = time.Minute
+)
+
+//--------------------
+// MESSAGES
+//--------------------
+
+// Request is a message sent by the client. Subscribe and unsubscribe
+// contain the metric ID patterns in the same syntax as the filter of the
+// metrics handler: regular expressions enclosed in slashes, globs when
+// containing any of "*?[", and otherwise IDs selecting themselves and the
+// IDs below them, e.g. "sys.mem" selects "sys.mem.free". Rate contains the
+// minimal interval between two updates, and refresh requests the immediate
+// sending of the metrics.
+type Request struct {
+	Type     string   `json:"type"`
+	Patterns []string `json:"patterns,omitempty"`
+	Interval string   `json:"interval,omitempty"`
+}
+
+// Response is a message sent to the client. It contains either metrics or
+// an error.
+type Response struct {
+	Type      string           `json:"type"`
+	Timestamp *time.Time       `json:"timestamp,omitempty"`
+	Values    collector.Values `json:"values,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+//--------------------
+// LIVE HANDLER
+//--------------------
+
+// liveHandler provides a http.Handler for WebSocket clients subscribing
+// to the metrics of a poller.
+type liveHandler struct {
+	poller      *poller.Poller
+	idleTimeout time.Duration
+	origins     []string
+}
+
+// NewLive returns a new handler for live metrics via WebSocket. Clients
+// not sending any message or pong within the idle timeout get disconnected.
+// Browsers may only connect from the origin of the server or one of the
+// allowed origins like "https://dashboard.example.com", "*" allows all.
+func NewLive(p *poller.Poller, idleTimeout time.Duration, origins ...string) http.Handler {
+	if idleTimeout <= 0 {
+		idleTimeout = liveDefaultIdleTimeout
+	}
+	return &liveHandler{
+		poller:      p,
+		idleTimeout: idleTimeout,
+		origins:     origins,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *liveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrade(w, r, liveWriteTimeout, h.origins)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s := h.poller.Subscribe()
+	defer s.Unsubscribe()
+	ts, m := h.poller.Metrics()
+	lc := &liveConn{
+		conn:     conn,
+		allowed:  permitted(r),
+		patterns: make(map[string]pattern),
+		latest: poller.Update{
+			Timestamp: ts,
+			Metrics:   m,
+		},
+	}
+	lc.serve(s, h.idleTimeout)
+}
+
+//--------------------
+// LIVE CONNECTION
+//--------------------
+
+// liveRequest contains a received request or the error when parsing it.
+type liveRequest struct {
+	req Request
+	err error
+}
+
+// liveConn contains the state of one live metrics connection.
+type liveConn struct {
+	conn     *wsConn
+	allowed  func(id string) bool
+	patterns map[string]pattern
+	interval time.Duration
+	lastSent time.Time
+	pending  *poller.Update
+	latest   poller.Update
+}
+
+// serve runs the connection until the client disconnects, the poller
+// stops, or an error occurs.
+func (lc *liveConn) serve(s *poller.Subscription, idleTimeout time.Duration) {
+	requestC := make(chan liveRequest)
+	doneC := make(chan struct{})
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go lc.receive(requestC, doneC, stopC, idleTimeout)
+
+	ping := time.NewTicker(idleTimeout / 2)
+	defer ping.Stop()
+	throttle := time.NewTimer(0)
+	defer throttle.Stop()
+	<-throttle.C
+
+	for {
+		var err error
+		select {
+		case <-doneC:
+			return
+		case lr := <-requestC:
+			if lr.err != nil {
+				err = lc.sendError(fmt.Sprintf("invalid request: %v", lr.err))
+				break
+			}
+			err = lc.handle(lr.req)
+		case u, ok := <-s.Updates():
+			if !ok {
+				lc.conn.WriteMessage(opClose, nil)
+				return
+			}
+			lc.latest = u
+			if wait := lc.interval - time.Since(lc.lastSent); wait > 0 {
+				if lc.pending == nil {
+					throttle.Reset(wait)
+				}
+				lc.pending = &u
+				continue
+			}
+			err = lc.send(u)
+		case <-throttle.C:
+			if lc.pending != nil {
+				err = lc.send(*lc.pending)
+			}
+		case <-ping.C:
+			err = lc.conn.WriteMessage(opPing, nil)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// receive reads the requests of the client until the connection fails
+// or serving stops. Any received frame, also a pong, resets the idle
+// timeout.
+func (lc *liveConn) receive(requestC chan<- liveRequest, doneC, stopC chan struct{}, idleTimeout time.Duration) {
+	defer close(doneC)
+	lc.conn.SetIdleTimeout(idleTimeout)
+	for {
+		_, msg, err := lc.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var lr liveRequest
+		lr.err = json.Unmarshal(msg, &lr.req)
+		select {
+		case requestC <- lr:
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// handle processes one client request.
+func (lc *liveConn) handle(req Request) error {
+	switch req.Type {
+	case MsgSubscribe:
+		for _, s := range req.Patterns {
+			p, err := compilePattern(s)
+			if err != nil {
+				return lc.sendError(err.Error())
+			}
+			lc.patterns[s] = p
+		}
+		return lc.refresh()
+	case MsgUnsubscribe:
+		for _, s := range req.Patterns {
+			delete(lc.patterns, s)
+		}
+		return nil
+	case MsgRate:
+		interval, err := time.ParseDuration(req.Interval)
+		if err != nil || interval < 0 {
+			return lc.sendError(fmt.Sprintf("invalid interval %q", req.Interval))
+		}
+		lc.interval = interval
+		return nil
+	case MsgRefresh:
+		return lc.refresh()
+	default:
+		return lc.sendError(fmt.Sprintf("unknown request type %q", req.Type))
+	}
+}
+
+// refresh sends the latest known metrics immediately.
+func (lc *liveConn) refresh() error {
+	if lc.latest.Metrics == nil {
+		return nil
+	}
+	return lc.send(lc.latest)
+}
+
+// send sends the subscribed values of an update.
+func (lc *liveConn) send(u poller.Update) error {
+	lc.pending = nil
+	lc.lastSent = time.Now()
+	values := collector.Values{}
+	for id, value := range u.Metrics.Values() {
+		if lc.allowed != nil && !lc.allowed(id) {
+			continue
+		}
+		for _, p := range lc.patterns {
+			if p(id) {
+				values[id] = value
+				break
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	ts := u.Timestamp
+	return lc.write(Response{
+		Type:      MsgMetrics,
+		Timestamp: &ts,
+		Values:    values,
+	})
+}
+
+// sendError sends an error message to the client.
+func (lc *liveConn) sendError(msg string) error {
+	return lc.write(Response{
+		Type:  MsgError,
+		Error: msg,
+	})
+}
+
+// write marshals and writes a response.
+func (lc *liveConn) write(resp Response) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return lc.conn.WriteMessage(opText, b)
+}
+
+// EOF
@@ -0,0 +1,366 @@
+// System Monitor Daemon - Handler - WebSocket Live Metrics - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestLiveSubscribe tests subscribing to metric ID patterns.
+func TestLiveSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newCollector()
+	c.Register(collector.NewGenericMeterPoints("b", func(ctx context.Context) (collector.Values, error) {
+		return collector.Values{"value": "b"}, nil
+	}))
+	p := poller.New(ctx, c, 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, time.Second))
+	defer srv.Close()
+
+	wc := dialLive(t, srv.URL)
+	defer wc.Close()
+	wc.send(t, handler.Request{Type: handler.MsgSubscribe, Patterns: []string{"a.*"}})
+	for i := 0; i < 3; i++ {
+		resp := wc.receive(t)
+		if resp.Type != handler.MsgMetrics {
+			t.Fatalf("invalid response type: %q", resp.Type)
+		}
+		if resp.Values["a.static"] != "constant" {
+			t.Errorf("invalid static value: %q", resp.Values["a.static"])
+		}
+		if _, ok := resp.Values["b.value"]; ok {
+			t.Errorf("received unsubscribed value b.value")
+		}
+	}
+
+	// Invalid requests are answered with errors.
+	wc.send(t, handler.Request{Type: "foo"})
+	for {
+		resp := wc.receive(t)
+		if resp.Type == handler.MsgError {
+			if resp.Error != `unknown request type "foo"` {
+				t.Errorf("invalid error: %q", resp.Error)
+			}
+			break
+		}
+	}
+}
+
+// TestLiveRate tests the changing of the update rate and the refresh.
+func TestLiveRate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 20*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, time.Second))
+	defer srv.Close()
+
+	wc := dialLive(t, srv.URL)
+	defer wc.Close()
+	wc.send(t, handler.Request{Type: handler.MsgRate, Interval: "300ms"})
+	wc.send(t, handler.Request{Type: handler.MsgSubscribe, Patterns: []string{"a.count"}})
+	first := wc.receive(t)
+	second := wc.receive(t)
+	if d := second.Timestamp.Sub(*first.Timestamp); d < 250*time.Millisecond {
+		t.Errorf("updates not throttled: %v", d)
+	}
+	wc.send(t, handler.Request{Type: handler.MsgRefresh})
+	start := time.Now()
+	wc.receive(t)
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("refresh not immediate: %v", d)
+	}
+}
+
+// TestLiveIdleTimeout tests the disconnecting of idle clients.
+func TestLiveIdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, 200*time.Millisecond))
+	defer srv.Close()
+
+	wc := dialLive(t, srv.URL)
+	defer wc.Close()
+	wc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		// Read but never answer pings.
+		op, _, err := wc.readFrame()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				t.Fatalf("idle connection not closed")
+			}
+			return
+		}
+		if op == 0x8 {
+			return
+		}
+	}
+}
+
+// TestLivePong tests keeping clients connected which only answer pings.
+func TestLivePong(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, 200*time.Millisecond))
+	defer srv.Close()
+
+	wc := dialLive(t, srv.URL)
+	defer wc.Close()
+	deadline := time.Now().Add(time.Second)
+	wc.conn.SetReadDeadline(deadline)
+	for {
+		op, payload, err := wc.readFrame()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			t.Fatalf("connection closed: %v", err)
+		}
+		switch op {
+		case 0x8:
+			t.Fatalf("connection closed after %v", time.Until(deadline))
+		case 0x9:
+			wc.writeFrame(t, 0xA, payload)
+		}
+	}
+	// Still connected.
+	wc.send(t, handler.Request{Type: handler.MsgSubscribe, Patterns: []string{"a"}})
+	if resp := wc.receive(t); resp.Type != handler.MsgMetrics {
+		t.Errorf("invalid response: %+v", resp)
+	}
+}
+
+// TestLiveControlFrame tests rejecting control frames with too large
+// payloads.
+func TestLiveControlFrame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, time.Second))
+	defer srv.Close()
+
+	wc := dialLive(t, srv.URL)
+	defer wc.Close()
+	wc.writeFrame(t, 0x9, []byte(strings.Repeat("x", 126)))
+	wc.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		op, _, err := wc.readFrame()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				t.Fatalf("connection not closed")
+			}
+			return
+		}
+		if op == 0xA {
+			t.Fatalf("invalid ping answered")
+		}
+	}
+}
+
+// TestLiveHandshake tests rejecting non-WebSocket requests.
+func TestLiveHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, time.Second))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid status code: %d", resp.StatusCode)
+	}
+}
+
+// TestLiveOrigin tests rejecting handshakes from foreign origins.
+func TestLiveOrigin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewLive(p, time.Second, "https://dashboard.example.com"))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		origin string
+		code   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{srv.URL, http.StatusSwitchingProtocols},
+		{"https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"http://127.0.0.1:1", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%q: request error: %v", test.origin, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%q: invalid status code: %d", test.origin, resp.StatusCode)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// wsClient is a minimal WebSocket client for the tests.
+type wsClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialLive connects to the live handler.
+func dialLive(t *testing.T, url string) *wsClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("cannot dial: %v", err)
+	}
+	handshake := "GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(handshake)); err != nil {
+		t.Fatalf("cannot write handshake: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("cannot read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("invalid handshake status: %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("invalid accept key: %q", accept)
+	}
+	return &wsClient{
+		conn:   conn,
+		reader: reader,
+	}
+}
+
+// send writes a masked text frame containing the request.
+func (wc *wsClient) send(t *testing.T, req handler.Request) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("cannot marshal request: %v", err)
+	}
+	wc.writeFrame(t, 0x1, payload)
+}
+
+// writeFrame writes a masked frame.
+func (wc *wsClient) writeFrame(t *testing.T, op byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op}
+	if len(payload) < 126 {
+		frame = append(frame, 0x80|byte(len(payload)))
+	} else {
+		frame = append(frame, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := wc.conn.Write(frame); err != nil {
+		t.Fatalf("cannot write frame: %v", err)
+	}
+}
+
+// receive reads the next response and answers pings.
+func (wc *wsClient) receive(t *testing.T) handler.Response {
+	wc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		op, payload, err := wc.readFrame()
+		if err != nil {
+			t.Fatalf("cannot read frame: %v", err)
+		}
+		if op != 0x1 {
+			continue
+		}
+		var resp handler.Response
+		if err := json.Unmarshal(payload, &resp); err != nil {
+			t.Fatalf("cannot unmarshal response: %v", err)
+		}
+		return resp
+	}
+}
+
+// readFrame reads an unmasked server frame.
+func (wc *wsClient) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(wc.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(wc.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(wc.reader, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(wc.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// Close closes the connection.
+func (wc *wsClient) Close() error {
+	return wc.conn.Close()
+}
+
+// EOF
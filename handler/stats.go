@@ -0,0 +1,88 @@
+// System Monitor Daemon - Handler - Request Statistics
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// STATISTICS
+//--------------------
+
+// endpointStat contains the statistics of one endpoint.
+type endpointStat struct {
+	requests int
+	latency  time.Duration
+	max      time.Duration
+}
+
+// Stats counts the requests and their latencies per endpoint.
+type Stats struct {
+	mu    sync.Mutex
+	stats map[string]*endpointStat
+}
+
+// NewStats creates empty request statistics.
+func NewStats() *Stats {
+	return &Stats{
+		stats: make(map[string]*endpointStat),
+	}
+}
+
+// Instrument wraps the handler for the named endpoint to record its
+// requests. For streaming endpoints the latency is the connection time.
+func (s *Stats) Instrument(endpoint string, h http.Handler) http.Handler {
+	id := strings.Replace(strings.Trim(endpoint, "/"), "/", ".", -1)
+	s.mu.Lock()
+	s.stats[id] = &endpointStat{}
+	s.mu.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		d := time.Since(start)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		es := s.stats[id]
+		es.requests++
+		es.latency += d
+		if d > es.max {
+			es.max = d
+		}
+	})
+}
+
+// Values returns the statistics as values to be used as source of the
+// self meter points.
+func (s *Stats) Values() collector.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(collector.Values, len(s.stats)*3)
+	for id, es := range s.stats {
+		avg := time.Duration(0)
+		if es.requests > 0 {
+			avg = es.latency / time.Duration(es.requests)
+		}
+		values["http."+id+".requests"] = fmt.Sprintf("%d", es.requests)
+		values["http."+id+".latency.avg"] = fmt.Sprintf("%.6f", avg.Seconds())
+		values["http."+id+".latency.max"] = fmt.Sprintf("%.6f", es.max.Seconds())
+	}
+	return values
+}
+
+// EOF
@@ -0,0 +1,50 @@
+// System Monitor Daemon - Handler - Request Statistics - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/handler"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestStats tests counting requests per endpoint.
+func TestStats(t *testing.T) {
+	stats := handler.NewStats()
+	h := stats.Instrument("/metrics/stream", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	stats.Instrument("/ready", h)
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics/stream", nil))
+	}
+	values := stats.Values()
+	if values["http.metrics.stream.requests"] != "3" {
+		t.Errorf("invalid number of requests: %q", values["http.metrics.stream.requests"])
+	}
+	if avg, err := strconv.ParseFloat(values["http.metrics.stream.latency.avg"], 64); err != nil || avg < 0.01 {
+		t.Errorf("invalid average latency: %q", values["http.metrics.stream.latency.avg"])
+	}
+	if values["http.ready.requests"] != "0" {
+		t.Errorf("invalid number of requests: %q", values["http.ready.requests"])
+	}
+}
+
+// EOF
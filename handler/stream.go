@@ -0,0 +1,132 @@
+// System Monitor Daemon - Handler - Server-Sent Events Stream
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// STREAM HANDLER
+//--------------------
+
+// streamHandler provides a http.Handler pushing the updates of a poller
+// as Server-Sent Events.
+type streamHandler struct {
+	poller *poller.Poller
+}
+
+// NewStream returns a new handler streaming the metrics of each poll. With
+// the query parameter "changes=1" only the changed values are sent after
+// an initial complete event.
+func NewStream(p *poller.Poller) http.Handler {
+	return &streamHandler{
+		poller: p,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	changes := r.URL.Query().Get("changes") == "1"
+	allowed := permitted(r)
+	s := h.poller.Subscribe()
+	defer s.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var last collector.Values
+	send := func(u poller.Update) error {
+		values := u.Metrics.Values()
+		if allowed != nil {
+			for id := range values {
+				if !allowed(id) {
+					delete(values, id)
+				}
+			}
+		}
+		event := values
+		if changes && last != nil {
+			event = diff(last, values)
+		}
+		last = values
+		if len(event) == 0 {
+			return nil
+		}
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: metrics\ndata: %s\n\n", u.Timestamp.UnixNano(), b)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// Start with the latest known metrics.
+	ts, m := h.poller.Metrics()
+	if m != nil {
+		if err := send(poller.Update{Timestamp: ts, Metrics: m}); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case u, ok := <-s.Updates():
+			if !ok {
+				return
+			}
+			if err := send(u); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// diff returns the values of next which are new or changed compared to
+// prev. Removed values are returned with an empty string.
+func diff(prev, next collector.Values) collector.Values {
+	changed := collector.Values{}
+	for id, value := range next {
+		if pvalue, ok := prev[id]; !ok || pvalue != value {
+			changed[id] = value
+		}
+	}
+	for id := range prev {
+		if _, ok := next[id]; !ok {
+			changed[id] = ""
+		}
+	}
+	return changed
+}
+
+// EOF
@@ -0,0 +1,120 @@
+// System Monitor Daemon - Handler - Server-Sent Events Stream - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestStreamAll tests streaming complete metrics.
+func TestStreamAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewStream(p))
+	defer srv.Close()
+
+	events := readEvents(t, srv.URL, 3)
+	for i, event := range events {
+		if event["a.static"] != "constant" {
+			t.Errorf("event %d has invalid static value: %q", i, event["a.static"])
+		}
+		if event["a.count"] == "" {
+			t.Errorf("event %d has no count value", i)
+		}
+	}
+}
+
+// TestStreamChanges tests streaming only changed values.
+func TestStreamChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, newCollector(), 50*time.Millisecond)
+	srv := httptest.NewServer(handler.NewStream(p))
+	defer srv.Close()
+
+	events := readEvents(t, srv.URL+"?changes=1", 3)
+	if events[0]["a.static"] != "constant" {
+		t.Errorf("first event has invalid static value: %q", events[0]["a.static"])
+	}
+	for i, event := range events[1:] {
+		if len(event) != 1 || event["a.count"] == "" {
+			t.Errorf("event %d contains invalid changes: %v", i+1, event)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newCollector creates a collector with meter points "a" returning a
+// static and a changing value.
+func newCollector() *collector.Collector {
+	count := 0
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("a", func(ctx context.Context) (collector.Values, error) {
+		count++
+		return collector.Values{
+			"static": "constant",
+			"count":  strconv.Itoa(count),
+		}, nil
+	}))
+	return c
+}
+
+// readEvents connects to the stream and reads the given number of events.
+func readEvents(t *testing.T, url string, n int) []collector.Values {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("cannot connect stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("invalid content type: %q", ct)
+	}
+	var events []collector.Values
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < n && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event collector.Values
+		if err := json.Unmarshal([]byte(line[6:]), &event); err != nil {
+			t.Fatalf("invalid event data: %v", err)
+		}
+		events = append(events, event)
+	}
+	if len(events) < n {
+		t.Fatalf("stream ended after %d events: %v", len(events), scanner.Err())
+	}
+	return events
+}
+
+// EOF
@@ -0,0 +1,289 @@
+// System Monitor Daemon - Handler - WebSocket Protocol
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package handler
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// WebSocket opcodes as defined in RFC 6455.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// wsGUID is used to calculate the accept key of the handshake.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessageSize limits the size of messages sent by clients.
+const wsMaxMessageSize = 64 * 1024
+
+// wsMaxControlSize is the maximum payload size of control frames.
+const wsMaxControlSize = 125
+
+//--------------------
+// WEBSOCKET CONNECTION
+//--------------------
+
+// wsConn is a minimal server side WebSocket connection. Reading has to be
+// done by one goroutine, writing is synchronised.
+type wsConn struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	mu           sync.Mutex
+}
+
+// upgrade performs the WebSocket handshake and hijacks the connection.
+// Handshakes of browsers from foreign origins not listed in the allowed
+// origins are rejected.
+func upgrade(w http.ResponseWriter, r *http.Request, writeTimeout time.Duration, origins []string) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("invalid handshake method")
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("missing upgrade headers")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, errors.New("missing websocket key")
+	}
+	if !originAllowed(r, origins) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, errors.New("origin not allowed")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("cannot hijack connection: %v", err)
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot write handshake: %v", err)
+	}
+	return &wsConn{
+		conn:         conn,
+		reader:       rw.Reader,
+		writeTimeout: writeTimeout,
+	}, nil
+}
+
+// ReadMessage reads the next text or binary message. Control frames are
+// handled internally. A close frame by the client results in io.EOF.
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.WriteMessage(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.WriteMessage(opClose, payload)
+			return 0, nil, io.EOF
+		case opText, opBinary:
+			if message != nil {
+				return 0, nil, errors.New("unexpected new message in fragmented message")
+			}
+			opcode = op
+			message = payload
+		case opContinuation:
+			if message == nil {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+			message = append(message, payload...)
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %x", op)
+		}
+		if len(message) > wsMaxMessageSize {
+			return 0, nil, errors.New("message too large")
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame and unmasks its payload. With an idle timeout
+// each frame, also control frames, has to arrive within this timeout.
+func (c *wsConn) readFrame() (bool, int, []byte, error) {
+	if c.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return false, 0, nil, errors.New("client frame not masked")
+	}
+	if length > wsMaxMessageSize {
+		return false, 0, nil, errors.New("frame too large")
+	}
+	if op >= opClose && (length > wsMaxControlSize || !fin) {
+		return false, 0, nil, errors.New("invalid control frame")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage writes one unfragmented message. Writes taking longer than
+// the write timeout fail, so slow clients cannot block the server.
+func (c *wsConn) WriteMessage(opcode int, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|byte(opcode))
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// SetIdleTimeout sets the timeout for reading each frame. Zero disables
+// it. It has to be set by the reading goroutine.
+func (c *wsConn) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// Close closes the underlying connection.
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// acceptKey calculates the Sec-WebSocket-Accept value for a client key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// originAllowed checks the origin of the handshake. Requests without
+// origin aren't sent by browsers, so only foreign origins not contained
+// in the allowed ones are rejected.
+func originAllowed(r *http.Request, origins []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains checks if a comma separated header contains a token.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EOF
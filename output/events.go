@@ -0,0 +1,224 @@
+// System Monitor Daemon - Output - Events
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Severities of the events, the same as the syslog and journald priorities.
+const (
+	severityCrit    = 2
+	severityErr     = 3
+	severityWarning = 4
+	severityNotice  = 5
+)
+
+// severityNames are the syslog names of the severities.
+var severityNames = map[int]string{
+	severityCrit:    "crit",
+	severityErr:     "err",
+	severityWarning: "warning",
+	severityNotice:  "notice",
+}
+
+// States of the events.
+const (
+	stateError     = "error"
+	stateRecovered = "recovered"
+	stateOK        = "ok"
+	stateWarning   = "warning"
+	stateCritical  = "critical"
+)
+
+// alertSeverities maps the alert states to their severities.
+var alertSeverities = map[string]int{
+	stateOK:       severityNotice,
+	stateWarning:  severityWarning,
+	stateCritical: severityCrit,
+}
+
+//--------------------
+// ALERTS
+//--------------------
+
+// Alert defines thresholds for the numeric metric values with IDs matching
+// the pattern, e.g. "sys.disk.*.percent". Values reaching the Warning or
+// Critical threshold change the alert state to "warning" or "critical",
+// otherwise it is "ok". With Below the thresholds are lower bounds, e.g.
+// for free memory. A zero threshold isn't checked.
+type Alert struct {
+	Pattern  string
+	Warning  float64
+	Critical float64
+	Below    bool
+}
+
+// state returns the alert state of a value.
+func (a Alert) state(v float64) string {
+	reached := func(threshold float64) bool {
+		if threshold == 0 {
+			return false
+		}
+		if a.Below {
+			return v <= threshold
+		}
+		return v >= threshold
+	}
+	switch {
+	case reached(a.Critical):
+		return stateCritical
+	case reached(a.Warning):
+		return stateWarning
+	}
+	return stateOK
+}
+
+// validateAlerts checks the patterns and thresholds of the alerts.
+func validateAlerts(alerts []Alert) error {
+	for _, a := range alerts {
+		if _, err := path.Match(a.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid alert pattern %q: %v", a.Pattern, err)
+		}
+		if a.Warning == 0 && a.Critical == 0 {
+			return fmt.Errorf("missing thresholds of alert %q", a.Pattern)
+		}
+	}
+	return nil
+}
+
+//--------------------
+// EVENTS
+//--------------------
+
+// event is an error or alert state change of a metric value.
+type event struct {
+	timestamp time.Time
+	id        string
+	value     string
+	state     string
+	severity  int
+}
+
+// message returns the human readable message of the event.
+func (e event) message() string {
+	switch e.state {
+	case stateError:
+		return "metric " + e.id + " failed: " + e.value
+	case stateRecovered:
+		return "metric " + e.id + " recovered"
+	}
+	return "metric " + e.id + " alert " + e.state + ": " + e.value
+}
+
+// eventTracker detects the error and alert state changes of the metric
+// values. Values starting with "error:" are errors, metric values are
+// recovered when they are no errors anymore or when they are gone, like the
+// "<id>.all" values of failed meter points. The alert state of a value is
+// defined by the first alert matching its ID, it starts as "ok". Alert
+// states of values which are gone or not numeric anymore are forgotten.
+type eventTracker struct {
+	alerts []Alert
+	errors map[string]string
+	states map[string]string
+}
+
+// track returns the events of the update sorted by metric ID.
+func (et *eventTracker) track(u poller.Update) []event {
+	values := u.Metrics.Values()
+	errors := make(map[string]string)
+	var events []event
+	for id, value := range values {
+		if !strings.HasPrefix(value, "error:") {
+			continue
+		}
+		errors[id] = value
+		if _, ok := et.errors[id]; !ok {
+			events = append(events, event{
+				timestamp: u.Timestamp,
+				id:        id,
+				value:     value,
+				state:     stateError,
+				severity:  severityErr,
+			})
+		}
+	}
+	for id := range et.errors {
+		if _, ok := errors[id]; !ok {
+			events = append(events, event{
+				timestamp: u.Timestamp,
+				id:        id,
+				value:     values[id],
+				state:     stateRecovered,
+				severity:  severityNotice,
+			})
+		}
+	}
+	et.errors = errors
+	states := make(map[string]string)
+	for id, value := range values {
+		state, ok := et.alertState(id, value)
+		if !ok {
+			continue
+		}
+		previous, ok := et.states[id]
+		if !ok {
+			previous = stateOK
+		}
+		if state != stateOK {
+			states[id] = state
+		}
+		if state != previous {
+			events = append(events, event{
+				timestamp: u.Timestamp,
+				id:        id,
+				value:     value,
+				state:     state,
+				severity:  alertSeverities[state],
+			})
+		}
+	}
+	et.states = states
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].id < events[j].id
+	})
+	return events
+}
+
+// alertState returns the alert state of a metric value if an alert
+// matches its ID and the value is numeric.
+func (et *eventTracker) alertState(id, value string) (string, bool) {
+	for _, a := range et.alerts {
+		if ok, _ := path.Match(a.Pattern, id); !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", false
+		}
+		return a.state(v), true
+	}
+	return "", false
+}
+
+// EOF
@@ -0,0 +1,196 @@
+// System Monitor Daemon - Output - Graphite
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Maximum sizes of the batches written at once.
+const (
+	graphiteTCPBatchSize = 32 * 1024
+	graphiteUDPBatchSize = 1432
+)
+
+//--------------------
+// GRAPHITE
+//--------------------
+
+// GraphiteConfiguration contains the configuration of a Graphite output.
+// Network is "tcp" or "udp", the address the one of the Carbon plaintext
+// endpoint. The paths are built out of prefix, host, and metric ID. The host
+// defaults to the host name, dots are replaced by underscores. At most
+// BufferSize lines are buffered while the endpoint isn't reachable, then
+// the oldest ones are dropped. The timeout is used for connecting and
+// writing.
+type GraphiteConfiguration struct {
+	Network    string
+	Address    string
+	Prefix     string
+	Host       string
+	BufferSize int
+	Timeout    time.Duration
+}
+
+// Graphite writes the numeric values of the metrics using the Carbon
+// plaintext protocol.
+type Graphite struct {
+	network   string
+	address   string
+	stem      string
+	size      int
+	batchSize int
+	timeout   time.Duration
+	conn      net.Conn
+	lines     []string
+	dropped   int
+}
+
+// NewGraphite creates a Graphite writer. The connection is established
+// with the first write and reestablished after errors.
+func NewGraphite(cfg GraphiteConfiguration) (*Graphite, error) {
+	g := &Graphite{
+		network:   cfg.Network,
+		address:   cfg.Address,
+		size:      cfg.BufferSize,
+		batchSize: graphiteTCPBatchSize,
+		timeout:   cfg.Timeout,
+	}
+	switch g.network {
+	case "", "tcp":
+		g.network = "tcp"
+	case "udp":
+		g.batchSize = graphiteUDPBatchSize
+	default:
+		return nil, fmt.Errorf("invalid Graphite network %q", cfg.Network)
+	}
+	if g.address == "" {
+		return nil, fmt.Errorf("missing Graphite address")
+	}
+	if g.size <= 0 {
+		g.size = 10000
+	}
+	if g.timeout <= 0 {
+		g.timeout = 5 * time.Second
+	}
+	host := cfg.Host
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot get host name: %v", err)
+		}
+	}
+	g.stem = graphitePath(strings.Replace(host, ".", "_", -1))
+	if cfg.Prefix != "" {
+		g.stem = graphitePath(strings.Trim(cfg.Prefix, ".")) + "." + g.stem
+	}
+	return g, nil
+}
+
+// Write implements Writer. The lines are buffered and written in batches.
+func (g *Graphite) Write(ctx context.Context, u poller.Update) error {
+	ts := strconv.FormatInt(u.Timestamp.Unix(), 10)
+	values := u.Metrics.Values()
+	ids := make([]string, 0, len(values))
+	for id, value := range values {
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		g.lines = append(g.lines, g.stem+"."+graphitePath(id)+" "+values[id]+" "+ts+"\n")
+	}
+	if over := len(g.lines) - g.size; over > 0 {
+		g.lines = append(g.lines[:0], g.lines[over:]...)
+		g.dropped += over
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return g.flush(ctx)
+}
+
+// Dropped returns the number of lines dropped due to a full buffer.
+func (g *Graphite) Dropped() int {
+	return g.dropped
+}
+
+// Close implements Writer.
+func (g *Graphite) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	err := g.flush(ctx)
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	return err
+}
+
+// flush writes the buffered lines in batches. In case of errors the
+// connection is closed and the unwritten lines stay in the buffer.
+func (g *Graphite) flush(ctx context.Context) error {
+	for len(g.lines) > 0 {
+		if g.conn == nil {
+			d := net.Dialer{Timeout: g.timeout}
+			conn, err := d.DialContext(ctx, g.network, g.address)
+			if err != nil {
+				return fmt.Errorf("cannot connect to Graphite: %v", err)
+			}
+			g.conn = conn
+		}
+		var batch []byte
+		n := 0
+		for _, line := range g.lines {
+			if n > 0 && len(batch)+len(line) > g.batchSize {
+				break
+			}
+			batch = append(batch, line...)
+			n++
+		}
+		g.conn.SetWriteDeadline(time.Now().Add(g.timeout))
+		if _, err := g.conn.Write(batch); err != nil {
+			g.conn.Close()
+			g.conn = nil
+			return fmt.Errorf("cannot write to Graphite: %v", err)
+		}
+		g.lines = g.lines[n:]
+	}
+	return nil
+}
+
+// graphitePath replaces characters not allowed in Graphite paths.
+func graphitePath(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '/':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// EOF
@@ -0,0 +1,184 @@
+// System Monitor Daemon - Output - Graphite - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestGraphiteTCP tests writing lines via TCP.
+func TestGraphiteTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer l.Close()
+	g, err := output.NewGraphite(output.GraphiteConfiguration{
+		Address: l.Addr().String(),
+		Prefix:  "sysmond.",
+		Host:    "web1.example.com",
+	})
+	if err != nil {
+		t.Fatalf("cannot create Graphite writer: %v", err)
+	}
+	err = g.Write(context.Background(), newUpdate(1500000000, collector.Values{
+		"sys.mem.free":    "1024",
+		"sys.cpu.0.user":  "12.500",
+		"sys.disk.root":   "error: timeout",
+		"version.sysmond": "0.1.0",
+		"app.my check":    "1",
+	}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	g.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("cannot accept: %v", err)
+	}
+	defer conn.Close()
+	expected := []string{
+		"sysmond.web1_example_com.app.my_check 1 1500000000",
+		"sysmond.web1_example_com.sys.cpu.0.user 12.500 1500000000",
+		"sysmond.web1_example_com.sys.mem.free 1024 1500000000",
+	}
+	if lines := readLines(t, conn, len(expected)); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("invalid lines: %q", lines)
+	}
+}
+
+// TestGraphiteUDP tests writing lines via UDP.
+func TestGraphiteUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	g, err := output.NewGraphite(output.GraphiteConfiguration{
+		Network: "udp",
+		Address: pc.LocalAddr().String(),
+		Host:    "web1",
+	})
+	if err != nil {
+		t.Fatalf("cannot create Graphite writer: %v", err)
+	}
+	defer g.Close()
+	err = g.Write(context.Background(), newUpdate(1500000000, collector.Values{"sys.mem.free": "1024"}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	if s := string(buf[:n]); s != "web1.sys.mem.free 1024 1500000000\n" {
+		t.Errorf("invalid datagram: %q", s)
+	}
+}
+
+// TestGraphiteBuffer tests buffering and dropping the oldest lines while
+// Carbon isn't reachable.
+func TestGraphiteBuffer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	g, err := output.NewGraphite(output.GraphiteConfiguration{
+		Address:    addr,
+		Host:       "h",
+		BufferSize: 3,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatalf("cannot create Graphite writer: %v", err)
+	}
+	for i := int64(1); i <= 4; i++ {
+		if err := g.Write(context.Background(), newUpdate(i, collector.Values{"a": "1"})); err == nil {
+			t.Errorf("expected write error")
+		}
+	}
+	if g.Dropped() != 1 {
+		t.Errorf("invalid number of dropped lines: %d", g.Dropped())
+	}
+
+	// Carbon is back again.
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen again: %v", err)
+	}
+	defer l.Close()
+	if err := g.Write(context.Background(), newUpdate(5, collector.Values{"a": "1"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	g.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("cannot accept: %v", err)
+	}
+	defer conn.Close()
+	expected := []string{"h.a 1 3", "h.a 1 4", "h.a 1 5"}
+	if lines := readLines(t, conn, len(expected)); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("invalid lines: %q", lines)
+	}
+	if g.Dropped() != 2 {
+		t.Errorf("invalid number of dropped lines: %d", g.Dropped())
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newUpdate creates a poller update with the values.
+func newUpdate(ts int64, values collector.Values) poller.Update {
+	m := collector.NewMetrics(len(values))
+	for id, value := range values {
+		m.Set(id, value)
+	}
+	return poller.Update{
+		Timestamp: time.Unix(ts, 0),
+		Metrics:   m,
+	}
+}
+
+// readLines reads the number of lines from the connection.
+func readLines(t *testing.T, conn net.Conn, n int) []string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	var lines []string
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Errorf("cannot read lines: %v", err)
+	}
+	return lines
+}
+
+// EOF
@@ -0,0 +1,355 @@
+// System Monitor Daemon - Output - InfluxDB
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// influxUDPBatchSize is the maximum size of the datagrams sent via UDP.
+const influxUDPBatchSize = 1400
+
+//--------------------
+// INFLUXDB
+//--------------------
+
+// InfluxConfiguration contains the configuration of an InfluxDB output. The
+// URL is the one of the write endpoint including database or bucket, e.g.
+// "http://influx:8086/write?db=sysmond", or "udp://influx:8089" for UDP.
+// HTTP requests are authenticated with the token or username and password
+// if set. The tags are added to all points, host defaults to the host name.
+// Failed HTTP writes are retried with doubling backoff, afterwards the
+// batches are buffered in the directory, or in memory if none is set. At
+// most BufferSize batches are buffered, on overflow the oldest ones are
+// dropped.
+type InfluxConfiguration struct {
+	URL          string
+	Token        string
+	Username     string
+	Password     string
+	Tags         map[string]string
+	Gzip         bool
+	Retries      int
+	RetryBackoff time.Duration
+	BufferDir    string
+	BufferSize   int
+	Timeout      time.Duration
+}
+
+// Influx writes the numeric values of the metrics using the InfluxDB line
+// protocol. The meter points IDs are the measurements, the remaining parts
+// of the metric IDs the fields.
+type Influx struct {
+	cfg    InfluxConfiguration
+	tags   string
+	stems  func() []string
+	client *http.Client
+	conn   net.Conn
+	spool  *spool
+}
+
+// NewInflux creates an InfluxDB writer. The stems function returns the
+// IDs of the meter points, typically Collector.List. Metric IDs without
+// matching stem are split at their last dot.
+func NewInflux(cfg InfluxConfiguration, stems func() []string) (*Influx, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %v", err)
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	tags := map[string]string{}
+	for k, v := range cfg.Tags {
+		tags[k] = v
+	}
+	if tags["host"] == "" {
+		if tags["host"], err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot get host name: %v", err)
+		}
+	}
+	i := &Influx{
+		cfg:   cfg,
+		tags:  influxTags(tags),
+		stems: stems,
+	}
+	switch u.Scheme {
+	case "http", "https":
+		i.client = &http.Client{Timeout: cfg.Timeout}
+		if i.spool, err = newSpool(cfg.BufferDir, cfg.BufferSize); err != nil {
+			return nil, err
+		}
+	case "udp":
+		if i.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, fmt.Errorf("cannot connect to InfluxDB: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid InfluxDB URL scheme %q", u.Scheme)
+	}
+	return i, nil
+}
+
+// Write implements Writer. Buffered batches are written first.
+func (i *Influx) Write(ctx context.Context, u poller.Update) error {
+	batch := i.lines(u)
+	if i.conn != nil {
+		return i.writeUDP(batch)
+	}
+	if len(batch) > 0 && ctx.Err() != nil {
+		i.spool.push(batch)
+		return ctx.Err()
+	}
+	err := i.flush(ctx)
+	if err == nil && len(batch) > 0 {
+		var permanent bool
+		if permanent, err = i.deliver(ctx, batch); err == nil || permanent {
+			return err
+		}
+	}
+	if len(batch) > 0 {
+		if serr := i.spool.push(batch); serr != nil {
+			return serr
+		}
+	}
+	return err
+}
+
+// Dropped returns the number of batches dropped due to a full buffer.
+func (i *Influx) Dropped() int {
+	if i.spool == nil {
+		return 0
+	}
+	return i.spool.dropped
+}
+
+// Close implements Writer. Buffered batches are written if possible, those
+// buffered in a directory are kept for the next start otherwise.
+func (i *Influx) Close() error {
+	if i.conn != nil {
+		return i.conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), i.cfg.Timeout)
+	defer cancel()
+	return i.flush(ctx)
+}
+
+// flush writes the buffered batches. Those rejected permanently are dropped.
+func (i *Influx) flush(ctx context.Context) error {
+	var rerr error
+	for {
+		batch, ok, err := i.spool.peek()
+		if err != nil || !ok {
+			if err == nil {
+				err = rerr
+			}
+			return err
+		}
+		permanent, err := i.deliver(ctx, batch)
+		if err != nil && !permanent {
+			return err
+		}
+		rerr = err
+		if err := i.spool.pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver posts the batch and retries it with backoff. It returns true
+// if the batch has been rejected permanently.
+func (i *Influx) deliver(ctx context.Context, batch []byte) (bool, error) {
+	backoff := i.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		permanent, err := i.post(ctx, batch)
+		if err == nil || permanent || attempt > i.cfg.Retries {
+			return permanent, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false, err
+		}
+		backoff *= 2
+	}
+}
+
+// post posts the batch once. It returns true if the batch has been rejected
+// permanently and retrying makes no sense.
+func (i *Influx) post(ctx context.Context, batch []byte) (bool, error) {
+	body := batch
+	if i.cfg.Gzip {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(batch)
+		gw.Close()
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", i.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case i.cfg.Token != "":
+		req.Header.Set("Authorization", "Token "+i.cfg.Token)
+	case i.cfg.Username != "":
+		req.SetBasicAuth(i.cfg.Username, i.cfg.Password)
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("cannot write to InfluxDB: %v", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return false, fmt.Errorf("InfluxDB unavailable: %s", resp.Status)
+	}
+	return true, fmt.Errorf("InfluxDB rejected batch: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// writeUDP writes the lines in datagrams.
+func (i *Influx) writeUDP(batch []byte) error {
+	for len(batch) > 0 {
+		n := 0
+		for n < len(batch) {
+			end := bytes.IndexByte(batch[n:], '\n') + n + 1
+			if n > 0 && end > influxUDPBatchSize {
+				break
+			}
+			n = end
+		}
+		if _, err := i.conn.Write(batch[:n]); err != nil {
+			return fmt.Errorf("cannot write to InfluxDB: %v", err)
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+// lines creates the lines of the update, one per measurement.
+func (i *Influx) lines(u poller.Update) []byte {
+	var stems []string
+	if i.stems != nil {
+		stems = i.stems()
+	}
+	fields := map[string][]string{}
+	for id, value := range u.Metrics.Values() {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		measurement, key := influxSplit(id, stems)
+		if key == "" {
+			continue
+		}
+		fields[measurement] = append(fields[measurement],
+			influxEscape(key, ",= ")+"="+strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	measurements := make([]string, 0, len(fields))
+	for measurement := range fields {
+		measurements = append(measurements, measurement)
+	}
+	sort.Strings(measurements)
+	ts := strconv.FormatInt(u.Timestamp.UnixNano(), 10)
+	var buf bytes.Buffer
+	for _, measurement := range measurements {
+		fs := fields[measurement]
+		sort.Strings(fs)
+		buf.WriteString(influxEscape(measurement, ", ") + i.tags + " " + strings.Join(fs, ",") + " " + ts + "\n")
+	}
+	return buf.Bytes()
+}
+
+// influxSplit splits a metric ID into measurement and field key. The
+// measurement is the longest stem prefixing the ID, otherwise the part
+// before the last dot.
+func influxSplit(id string, stems []string) (string, string) {
+	measurement := ""
+	for _, stem := range stems {
+		if len(stem) > len(measurement) && strings.HasPrefix(id, stem+".") {
+			measurement = stem
+		}
+	}
+	if measurement == "" {
+		dot := strings.LastIndex(id, ".")
+		if dot < 0 {
+			return id, ""
+		}
+		measurement = id[:dot]
+	}
+	return measurement, id[len(measurement)+1:]
+}
+
+// influxTags renders the tags sorted by key.
+func influxTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range keys {
+		s += "," + influxEscape(k, ",= ") + "=" + influxEscape(tags[k], ",= ")
+	}
+	return s
+}
+
+// influxEscape escapes the passed special characters with backslashes.
+func influxEscape(s, special string) string {
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// EOF
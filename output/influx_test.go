@@ -0,0 +1,256 @@
+// System Monitor Daemon - Output - InfluxDB - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestInfluxHTTP tests writing lines via HTTP.
+func TestInfluxHTTP(t *testing.T) {
+	r := newInfluxReceiver(t)
+	defer r.Close()
+	i, err := output.NewInflux(output.InfluxConfiguration{
+		URL:   r.URL + "/write?db=sysmond",
+		Token: "s3cr3t",
+		Tags:  map[string]string{"host": "web1", "datacenter": "dc 1"},
+		Gzip:  true,
+	}, func() []string { return []string{"sys.cpu", "sys.disk.root", "app"} })
+	if err != nil {
+		t.Fatalf("cannot create InfluxDB writer: %v", err)
+	}
+	defer i.Close()
+	err = i.Write(context.Background(), newUpdate(1500000000, collector.Values{
+		"sys.cpu.0.user":      "12.500",
+		"sys.cpu.0.idle":      "80",
+		"sys.disk.root.total": "1024",
+		"sys.mem.free":        "2048",
+		"app.check,1":         "1",
+		"app":                 "error: timeout",
+		"version.sysmond":     "0.1.0",
+	}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	expected := []string{
+		`app,datacenter=dc\ 1,host=web1 check\,1=1 1500000000000000000
+sys.cpu,datacenter=dc\ 1,host=web1 0.idle=80,0.user=12.5 1500000000000000000
+sys.disk.root,datacenter=dc\ 1,host=web1 total=1024 1500000000000000000
+sys.mem,datacenter=dc\ 1,host=web1 free=2048 1500000000000000000
+`,
+	}
+	if batches := r.batches(); !reflect.DeepEqual(batches, expected) {
+		t.Errorf("invalid batches: %q", batches)
+	}
+	if r.header.Get("Authorization") != "Token s3cr3t" || r.header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("invalid headers: %v", r.header)
+	}
+}
+
+// TestInfluxRetry tests retrying unavailable endpoints and not retrying
+// rejected batches.
+func TestInfluxRetry(t *testing.T) {
+	r := newInfluxReceiver(t)
+	defer r.Close()
+	r.fail(http.StatusServiceUnavailable, 2)
+	i, err := output.NewInflux(output.InfluxConfiguration{
+		URL:          r.URL + "/write?db=sysmond",
+		Tags:         map[string]string{"host": "h"},
+		RetryBackoff: time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatalf("cannot create InfluxDB writer: %v", err)
+	}
+	defer i.Close()
+	if err := i.Write(context.Background(), newUpdate(1, collector.Values{"a.b": "1"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	r.mu.Lock()
+	if r.requests != 3 || len(r.received) != 1 {
+		t.Errorf("invalid requests: %d", r.requests)
+	}
+	r.mu.Unlock()
+
+	r.fail(http.StatusBadRequest, 1)
+	if err := i.Write(context.Background(), newUpdate(2, collector.Values{"a.b": "1"})); err == nil {
+		t.Errorf("expected write error")
+	}
+	if err := i.Write(context.Background(), newUpdate(3, collector.Values{"a.b": "1"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	expected := []string{"a,host=h b=1 1000000000\n", "a,host=h b=1 3000000000\n"}
+	if batches := r.batches(); !reflect.DeepEqual(batches, expected) {
+		t.Errorf("invalid batches: %q", batches)
+	}
+}
+
+// TestInfluxBuffer tests buffering batches on disk during outages, also
+// across restarts.
+func TestInfluxBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := newInfluxReceiver(t)
+	defer r.Close()
+	cfg := output.InfluxConfiguration{
+		URL:          r.URL + "/write?db=sysmond",
+		Tags:         map[string]string{"host": "h"},
+		Retries:      1,
+		RetryBackoff: time.Millisecond,
+		BufferDir:    dir,
+		BufferSize:   2,
+	}
+	i, err := output.NewInflux(cfg, nil)
+	if err != nil {
+		t.Fatalf("cannot create InfluxDB writer: %v", err)
+	}
+	r.fail(http.StatusInternalServerError, 100)
+	for ts := int64(1); ts <= 3; ts++ {
+		if err := i.Write(context.Background(), newUpdate(ts, collector.Values{"a.b": "1"})); err == nil {
+			t.Errorf("expected write error")
+		}
+	}
+	if i.Dropped() != 1 {
+		t.Errorf("invalid number of dropped batches: %d", i.Dropped())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("invalid number of buffered batches: %d", len(files))
+	}
+
+	// Restart after InfluxDB is back again.
+	r.fail(0, 0)
+	i, err = output.NewInflux(cfg, nil)
+	if err != nil {
+		t.Fatalf("cannot create InfluxDB writer: %v", err)
+	}
+	if err := i.Write(context.Background(), newUpdate(4, collector.Values{"a.b": "1"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	expected := []string{"a,host=h b=1 2000000000\n", "a,host=h b=1 3000000000\n", "a,host=h b=1 4000000000\n"}
+	if batches := r.batches(); !reflect.DeepEqual(batches, expected) {
+		t.Errorf("invalid batches: %q", batches)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("invalid number of buffered batches: %d", len(files))
+	}
+}
+
+// TestInfluxUDP tests writing lines via UDP.
+func TestInfluxUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	i, err := output.NewInflux(output.InfluxConfiguration{
+		URL:  "udp://" + pc.LocalAddr().String(),
+		Tags: map[string]string{"host": "h"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("cannot create InfluxDB writer: %v", err)
+	}
+	defer i.Close()
+	if err := i.Write(context.Background(), newUpdate(1, collector.Values{"a.b": "1", "c.d": "2"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	if s := string(buf[:n]); s != "a,host=h b=1 1000000000\nc,host=h d=2 1000000000\n" {
+		t.Errorf("invalid datagram: %q", s)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// influxReceiver simulates the InfluxDB write endpoint.
+type influxReceiver struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	received  []string
+	header    http.Header
+	requests  int
+	failCode  int
+	failCount int
+}
+
+// newInfluxReceiver starts a receiver.
+func newInfluxReceiver(t *testing.T) *influxReceiver {
+	r := &influxReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests++
+		r.header = req.Header
+		if r.failCount > 0 {
+			r.failCount--
+			http.Error(w, "failure", r.failCode)
+			return
+		}
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			gr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Errorf("invalid gzip body: %v", err)
+				return
+			}
+			body = gr
+		}
+		b, _ := ioutil.ReadAll(body)
+		r.received = append(r.received, string(b))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return r
+}
+
+// fail lets the next requests fail with the status code.
+func (r *influxReceiver) fail(code, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failCode = code
+	r.failCount = count
+}
+
+// batches returns the received batches.
+func (r *influxReceiver) batches() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.received
+}
+
+// EOF
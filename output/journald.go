@@ -0,0 +1,155 @@
+// System Monitor Daemon - Output - Journald
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// JOURNALD
+//--------------------
+
+// JournaldConfiguration contains the configuration of a journald output.
+// The socket defaults to the one of the native protocol, the identifier
+// to "sysmond". At most BufferSize events are buffered while journald
+// isn't reachable, then the oldest ones are dropped. The alerts define
+// the thresholds of the alert events.
+type JournaldConfiguration struct {
+	Socket     string
+	Identifier string
+	BufferSize int
+	Alerts     []Alert
+}
+
+// Journald sends the meter point errors and their recoveries as well as
+// the alert state changes as events to the systemd journal using its
+// native protocol. Metric ID, value, state, and severity are passed as
+// own fields.
+type Journald struct {
+	socket     string
+	identifier string
+	size       int
+	tracker    eventTracker
+	conn       net.Conn
+	events     []event
+	dropped    int
+}
+
+// NewJournald creates a journald writer. The socket is connected with the
+// first event and reconnected after errors, e.g. when journald has been
+// restarted.
+func NewJournald(cfg JournaldConfiguration) (*Journald, error) {
+	j := &Journald{
+		socket:     cfg.Socket,
+		identifier: cfg.Identifier,
+		size:       cfg.BufferSize,
+		tracker:    eventTracker{alerts: cfg.Alerts},
+	}
+	if err := validateAlerts(cfg.Alerts); err != nil {
+		return nil, err
+	}
+	if j.socket == "" {
+		j.socket = "/run/systemd/journal/socket"
+	}
+	if j.identifier == "" {
+		j.identifier = "sysmond"
+	}
+	if j.size <= 0 {
+		j.size = 1000
+	}
+	return j, nil
+}
+
+// Write implements Writer. The events of the update are buffered and sent.
+func (j *Journald) Write(ctx context.Context, u poller.Update) error {
+	j.events = append(j.events, j.tracker.track(u)...)
+	if over := len(j.events) - j.size; over > 0 {
+		j.events = append(j.events[:0], j.events[over:]...)
+		j.dropped += over
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return j.flush()
+}
+
+// Dropped returns the number of events dropped due to a full buffer.
+func (j *Journald) Dropped() int {
+	return j.dropped
+}
+
+// Close implements Writer.
+func (j *Journald) Close() error {
+	err := j.flush()
+	if j.conn != nil {
+		j.conn.Close()
+		j.conn = nil
+	}
+	return err
+}
+
+// flush sends the buffered events. In case of errors the socket is
+// closed and the unsent events stay in the buffer.
+func (j *Journald) flush() error {
+	for len(j.events) > 0 {
+		if j.conn == nil {
+			conn, err := net.Dial("unixgram", j.socket)
+			if err != nil {
+				return fmt.Errorf("cannot connect to journald: %v", err)
+			}
+			j.conn = conn
+		}
+		j.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := j.conn.Write(j.format(j.events[0])); err != nil {
+			j.conn.Close()
+			j.conn = nil
+			return fmt.Errorf("cannot write to journald: %v", err)
+		}
+		j.events = j.events[1:]
+	}
+	return nil
+}
+
+// format formats the event as datagram of the native protocol.
+func (j *Journald) format(e event) []byte {
+	var b []byte
+	field := func(name, value string) {
+		if !strings.Contains(value, "\n") {
+			b = append(b, name+"="+value+"\n"...)
+			return
+		}
+		// Values containing newlines are prefixed with their length.
+		b = append(b, name+"\n"...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+		b = append(b, value+"\n"...)
+	}
+	field("MESSAGE", e.message())
+	field("PRIORITY", strconv.Itoa(e.severity))
+	field("SYSLOG_IDENTIFIER", j.identifier)
+	field("SYSMOND_METRIC_ID", e.id)
+	field("SYSMOND_VALUE", e.value)
+	field("SYSMOND_STATE", e.state)
+	field("SYSMOND_SEVERITY", severityNames[e.severity])
+	field("SYSMOND_TIMESTAMP", e.timestamp.UTC().Format(time.RFC3339Nano))
+	return b
+}
+
+// EOF
@@ -0,0 +1,124 @@
+// System Monitor Daemon - Output - Journald - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestJournald tests sending events using the native protocol.
+func TestJournald(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond-journald")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	j, err := output.NewJournald(output.JournaldConfiguration{
+		Socket: socket,
+	})
+	if err != nil {
+		t.Fatalf("cannot create journald writer: %v", err)
+	}
+	defer j.Close()
+	ts := time.Date(2018, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	// Buffered while journald isn't running.
+	if err := j.Write(context.Background(), newUpdate(ts.Unix(), collector.Values{"app.all": "error: exit\nstatus 1"})); err == nil {
+		t.Fatalf("expected write error")
+	}
+	pc, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	if err := j.Write(context.Background(), newUpdate(ts.Unix()+10, collector.Values{"app.check": "1"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+
+	expected := []map[string]string{
+		{
+			"MESSAGE":           "metric app.all failed: error: exit\nstatus 1",
+			"PRIORITY":          "3",
+			"SYSLOG_IDENTIFIER": "sysmond",
+			"SYSMOND_METRIC_ID": "app.all",
+			"SYSMOND_VALUE":     "error: exit\nstatus 1",
+			"SYSMOND_STATE":     "error",
+			"SYSMOND_SEVERITY":  "err",
+			"SYSMOND_TIMESTAMP": "2018-10-19T12:00:00Z",
+		},
+		{
+			"MESSAGE":           "metric app.all recovered",
+			"PRIORITY":          "5",
+			"SYSLOG_IDENTIFIER": "sysmond",
+			"SYSMOND_METRIC_ID": "app.all",
+			"SYSMOND_VALUE":     "",
+			"SYSMOND_STATE":     "recovered",
+			"SYSMOND_SEVERITY":  "notice",
+			"SYSMOND_TIMESTAMP": "2018-10-19T12:00:10Z",
+		},
+	}
+	for i, exp := range expected {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("cannot read entry %d: %v", i, err)
+		}
+		if fields := parseJournalEntry(t, buf[:n]); !reflect.DeepEqual(fields, exp) {
+			t.Errorf("invalid entry %d: %q", i, fields)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// parseJournalEntry parses a datagram of the journal native protocol.
+func parseJournalEntry(t *testing.T, b []byte) map[string]string {
+	fields := make(map[string]string)
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			t.Fatalf("missing newline")
+		}
+		line := b[:nl]
+		b = b[nl+1:]
+		if eq := bytes.IndexByte(line, '='); eq >= 0 {
+			fields[string(line[:eq])] = string(line[eq+1:])
+			continue
+		}
+		n := int(binary.LittleEndian.Uint64(b))
+		fields[string(line)] = string(b[8 : 8+n])
+		b = b[8+n+1:]
+	}
+	return fields
+}
+
+// EOF
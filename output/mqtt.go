@@ -0,0 +1,653 @@
+// System Monitor Daemon - Output - MQTT
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Types of the MQTT control packets.
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPubAck     = 4
+	mqttPubRec     = 5
+	mqttPubRel     = 6
+	mqttPubComp    = 7
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+// Payloads of the status topic.
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// mqttConnAckErrors are the reasons of refused connections.
+var mqttConnAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+//--------------------
+// MQTT
+//--------------------
+
+// MQTTConfiguration contains the configuration of an MQTT output. The
+// broker URL has the scheme "tcp" or "mqtt", or "ssl", "tls", or "mqtts"
+// for TLS connections. The CA file verifies the broker certificate, the
+// certificate and key files authenticate the client. Each value is
+// published to the topic prefix followed by the metric ID with dots
+// replaced by slashes, or with JSON all values of a poll as one document
+// to the topic prefix followed by "/metrics". The prefix defaults to
+// "sysmond/<host>". The status topic, the prefix followed by "/status",
+// is "online" while connected and the last will sets it to "offline". QoS
+// is 0, 1, or 2. At most BufferSize messages are queued while the broker
+// isn't reachable, then the oldest ones are dropped.
+type MQTTConfiguration struct {
+	Broker     string
+	ClientID   string
+	Username   string
+	Password   string
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	Topic      string
+	JSON       bool
+	QoS        byte
+	Retain     bool
+	KeepAlive  time.Duration
+	BufferSize int
+	Timeout    time.Duration
+}
+
+// mqttMessage is a message to publish.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+	dup     bool
+}
+
+// mqttDocument is the JSON document published per poll.
+type mqttDocument struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Values    collector.Values `json:"values"`
+}
+
+// MQTT publishes the metrics to an MQTT broker using MQTT 3.1.1.
+type MQTT struct {
+	address   string
+	tlsConfig *tls.Config
+	clientID  string
+	username  string
+	password  string
+	topic     string
+	json      bool
+	qos       byte
+	retain    bool
+	keepAlive time.Duration
+	size      int
+	timeout   time.Duration
+	conn      *mqttConn
+	packetID  uint16
+	queue     []mqttMessage
+	dropped   int
+}
+
+// NewMQTT creates an MQTT writer. The connection is established with the
+// first write and reestablished after errors.
+func NewMQTT(cfg MQTTConfiguration) (*MQTT, error) {
+	m := &MQTT{
+		clientID:  cfg.ClientID,
+		username:  cfg.Username,
+		password:  cfg.Password,
+		topic:     strings.TrimSuffix(cfg.Topic, "/"),
+		json:      cfg.JSON,
+		qos:       cfg.QoS,
+		retain:    cfg.Retain,
+		keepAlive: cfg.KeepAlive,
+		size:      cfg.BufferSize,
+		timeout:   cfg.Timeout,
+	}
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid MQTT broker URL %q", cfg.Broker)
+	}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+		m.tlsConfig, err = newMQTTTLSConfig(u.Hostname(), cfg)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid MQTT broker scheme %q", u.Scheme)
+	}
+	m.address = u.Host
+	if u.Port() == "" {
+		m.address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if m.qos > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS %d", m.qos)
+	}
+	if m.topic == "" || m.clientID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get host name: %v", err)
+		}
+		if m.topic == "" {
+			m.topic = "sysmond/" + host
+		}
+		if m.clientID == "" {
+			m.clientID = "sysmond-" + host
+		}
+	}
+	if m.keepAlive <= 0 {
+		m.keepAlive = 60 * time.Second
+	}
+	if m.size <= 0 {
+		m.size = 10000
+	}
+	if m.timeout <= 0 {
+		m.timeout = 10 * time.Second
+	}
+	return m, nil
+}
+
+// Write implements Writer. The messages are queued and published.
+func (m *MQTT) Write(ctx context.Context, u poller.Update) error {
+	values := u.Metrics.Values()
+	if m.json {
+		payload, err := json.Marshal(mqttDocument{
+			Timestamp: u.Timestamp,
+			Values:    values,
+		})
+		if err != nil {
+			return err
+		}
+		m.queue = append(m.queue, mqttMessage{
+			topic:   m.topic + "/metrics",
+			payload: payload,
+			retain:  m.retain,
+		})
+	} else {
+		ids := make([]string, 0, len(values))
+		for id := range values {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			m.queue = append(m.queue, mqttMessage{
+				topic:   m.topic + "/" + mqttTopic(id),
+				payload: []byte(values[id]),
+				retain:  m.retain,
+			})
+		}
+	}
+	if over := len(m.queue) - m.size; over > 0 {
+		m.queue = append(m.queue[:0], m.queue[over:]...)
+		m.dropped += over
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.flush(ctx)
+}
+
+// Dropped returns the number of messages dropped due to a full queue.
+func (m *MQTT) Dropped() int {
+	return m.dropped
+}
+
+// Close implements Writer. After publishing the queued messages the status
+// is set to "offline" and the client disconnects.
+func (m *MQTT) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	err := m.flush(ctx)
+	if m.conn != nil {
+		m.conn.setDeadline(ctx)
+		m.conn.write(mqttPublishPacket(m.status(mqttOffline), 0, 0))
+		m.conn.write([]byte{mqttDisconnect << 4, 0})
+		m.conn.close()
+		m.conn = nil
+	}
+	return err
+}
+
+// status returns the retained status message.
+func (m *MQTT) status(payload string) mqttMessage {
+	return mqttMessage{
+		topic:   m.topic + "/status",
+		payload: []byte(payload),
+		retain:  true,
+	}
+}
+
+// flush publishes the queued messages. Messages with QoS 1 or 2 stay
+// queued until they are acknowledged. In case of errors the connection
+// is closed and the remaining messages are published again later.
+func (m *MQTT) flush(ctx context.Context) error {
+	if len(m.queue) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	if m.conn != nil {
+		select {
+		case <-m.conn.done:
+			// Closed by the broker in the meantime.
+			m.conn.close()
+			m.conn = nil
+		default:
+		}
+	}
+	var batch []mqttMessage
+	offset := 0
+	if m.conn == nil {
+		conn, err := m.connect(ctx)
+		if err != nil {
+			return fmt.Errorf("cannot connect to MQTT broker: %v", err)
+		}
+		m.conn = conn
+		batch = append(batch, m.status(mqttOnline))
+		offset = 1
+	}
+	batch = append(batch, m.queue...)
+	done := make([]bool, len(batch))
+	err := m.publish(ctx, batch, done)
+	queue := m.queue[:0]
+	for i, msg := range m.queue {
+		if !done[i+offset] {
+			msg.dup = m.qos > 0
+			queue = append(queue, msg)
+		}
+	}
+	m.queue = queue
+	if err != nil {
+		m.conn.close()
+		m.conn = nil
+		return fmt.Errorf("cannot publish to MQTT broker: %v", err)
+	}
+	return nil
+}
+
+// publish publishes the batch and waits for the acknowledgements. Done
+// messages are marked. Acknowledgements are already handled while
+// publishing, so that a broker blocked by unread ones can't block it.
+func (m *MQTT) publish(ctx context.Context, batch []mqttMessage, done []bool) error {
+	m.conn.setDeadline(ctx)
+	pending := make(map[uint16]int)
+	handle := func(p mqttReceived) error {
+		if len(p.body) < 2 {
+			return fmt.Errorf("invalid packet of type %d", p.kind)
+		}
+		id := binary.BigEndian.Uint16(p.body)
+		i, ok := pending[id]
+		if !ok {
+			return nil
+		}
+		switch p.kind {
+		case mqttPubAck, mqttPubComp:
+			done[i] = true
+			delete(pending, id)
+		case mqttPubRec:
+			return m.conn.write([]byte{mqttPubRel<<4 | 2, 2, byte(id >> 8), byte(id)})
+		}
+		return nil
+	}
+	for i, msg := range batch {
+		var id uint16
+		if m.qos > 0 {
+			id = m.nextPacketID()
+			pending[id] = i
+		}
+		if err := m.conn.write(mqttPublishPacket(msg, m.qos, id)); err != nil {
+			return err
+		}
+		if m.qos == 0 {
+			done[i] = true
+		}
+	drain:
+		for {
+			select {
+			case p := <-m.conn.packets:
+				if err := handle(p); err != nil {
+					return err
+				}
+			default:
+				break drain
+			}
+		}
+	}
+	for len(pending) > 0 {
+		select {
+		case p := <-m.conn.packets:
+			if err := handle(p); err != nil {
+				return err
+			}
+		case <-m.conn.done:
+			return m.conn.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// nextPacketID returns the next packet identifier, it must not be 0.
+func (m *MQTT) nextPacketID() uint16 {
+	m.packetID++
+	if m.packetID == 0 {
+		m.packetID = 1
+	}
+	return m.packetID
+}
+
+// connect establishes the connection to the broker with a clean session
+// and the last will.
+func (m *MQTT) connect(ctx context.Context) (*mqttConn, error) {
+	d := net.Dialer{Timeout: m.timeout}
+	nc, err := d.DialContext(ctx, "tcp", m.address)
+	if err != nil {
+		return nil, err
+	}
+	if m.tlsConfig != nil {
+		tc := tls.Client(nc, m.tlsConfig)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	will := m.status(mqttOffline)
+	flags := byte(0x02) | 0x04 | m.qos<<3 | 0x20
+	var payload []byte
+	payload = appendMQTTString(payload, m.clientID)
+	payload = appendMQTTString(payload, will.topic)
+	payload = appendMQTTString(payload, string(will.payload))
+	if m.username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, m.username)
+		if m.password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, m.password)
+		}
+	}
+	keepAlive := int(m.keepAlive / time.Second)
+	if keepAlive > 0xffff {
+		keepAlive = 0xffff
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, payload...)
+	if _, err := nc.Write(mqttPacket(mqttConnect<<4, body)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(nc)
+	kind, ack, err := readMQTTPacket(r)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if kind>>4 != mqttConnAck || len(ack) != 2 {
+		nc.Close()
+		return nil, fmt.Errorf("invalid connect acknowledgement")
+	}
+	if ack[1] != 0 {
+		nc.Close()
+		reason, ok := mqttConnAckErrors[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return nil, fmt.Errorf("connection refused: %s", reason)
+	}
+	nc.SetDeadline(time.Time{})
+	return newMQTTConn(nc, r, m.keepAlive), nil
+}
+
+//--------------------
+// CONNECTION
+//--------------------
+
+// mqttReceived is a received packet.
+type mqttReceived struct {
+	kind byte
+	body []byte
+}
+
+// mqttConn is an established connection to the broker. It reads the
+// incoming packets in the background and sends pings to keep it alive.
+type mqttConn struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	packets chan mqttReceived
+	closing chan struct{}
+	done    chan struct{}
+	err     error
+	once    sync.Once
+}
+
+// newMQTTConn starts the background goroutines of the connection.
+func newMQTTConn(conn net.Conn, r *bufio.Reader, keepAlive time.Duration) *mqttConn {
+	c := &mqttConn{
+		conn:    conn,
+		packets: make(chan mqttReceived, 64),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.read(r)
+	go c.ping(keepAlive)
+	return c
+}
+
+// read reads the incoming packets until the connection is closed.
+func (c *mqttConn) read(r *bufio.Reader) {
+	defer close(c.done)
+	for {
+		kind, body, err := readMQTTPacket(r)
+		if err != nil {
+			c.err = err
+			return
+		}
+		if kind>>4 == mqttPingResp {
+			continue
+		}
+		select {
+		case c.packets <- mqttReceived{kind >> 4, body}:
+		case <-c.closing:
+			c.err = errors.New("connection closed")
+			return
+		}
+	}
+}
+
+// ping sends a ping request each keep alive interval.
+func (c *mqttConn) ping(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			c.conn.SetWriteDeadline(time.Now().Add(keepAlive))
+			_, err := c.conn.Write([]byte{mqttPingReq << 4, 0})
+			c.mu.Unlock()
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+// setDeadline sets the write deadline of the connection to the one of the
+// context.
+func (c *mqttConn) setDeadline(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(deadline)
+}
+
+// write writes a packet.
+func (c *mqttConn) write(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// close closes the connection and stops the background goroutines.
+func (c *mqttConn) close() {
+	c.once.Do(func() {
+		close(c.closing)
+		c.conn.Close()
+	})
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// newMQTTTLSConfig creates the TLS configuration for the broker connection.
+func newMQTTTLSConfig(host string, cfg MQTTConfiguration) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read MQTT CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in MQTT CA file %q", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load MQTT client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// mqttTopic converts a metric ID into topic levels. Wildcard characters
+// aren't allowed in topics.
+func mqttTopic(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, id)
+}
+
+// mqttPublishPacket encodes a publish packet. The packet identifier is
+// only used with QoS 1 and 2.
+func mqttPublishPacket(msg mqttMessage, qos byte, id uint16) []byte {
+	header := byte(mqttPublish<<4) | qos<<1
+	if msg.retain {
+		header |= 0x01
+	}
+	if msg.dup && qos > 0 {
+		header |= 0x08
+	}
+	body := appendMQTTString(nil, msg.topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, msg.payload...)
+	return mqttPacket(header, body)
+}
+
+// mqttPacket encodes a packet with its fixed header. The remaining length
+// uses the same variable length encoding as varints.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	packet = binary.AppendUvarint(packet, uint64(len(body)))
+	return append(packet, body...)
+}
+
+// appendMQTTString appends a length prefixed string.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads a packet and returns its first header byte and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > 256*1024*1024 {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// EOF
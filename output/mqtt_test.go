@@ -0,0 +1,492 @@
+// System Monitor Daemon - Output - MQTT - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestMQTT tests publishing each value with QoS 1 and the status.
+func TestMQTT(t *testing.T) {
+	b := newMQTTBroker(t, nil)
+	defer b.Close()
+	m, err := output.NewMQTT(output.MQTTConfiguration{
+		Broker:   "tcp://" + b.addr(),
+		ClientID: "gw1",
+		Username: "edge",
+		Password: "s3cr3t",
+		Topic:    "edge/gw1",
+		QoS:      1,
+		Retain:   true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create MQTT writer: %v", err)
+	}
+	err = m.Write(context.Background(), newUpdate(1500000000, collector.Values{
+		"sys.cpu.0.user": "12.5",
+		"sys.mem.free":   "2048",
+		"app":            "error: timeout",
+	}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("cannot close: %v", err)
+	}
+	b.waitFor(t, func() bool { return b.disconnects == 1 })
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expectedConnect := brokerConnect{
+		clientID:    "gw1",
+		username:    "edge",
+		password:    "s3cr3t",
+		willTopic:   "edge/gw1/status",
+		willPayload: "offline",
+		willQoS:     1,
+		willRetain:  true,
+	}
+	if len(b.connects) != 1 || b.connects[0] != expectedConnect {
+		t.Errorf("invalid connects: %+v", b.connects)
+	}
+	expected := []brokerMessage{
+		{"edge/gw1/status", "online", 1, true},
+		{"edge/gw1/app", "error: timeout", 1, true},
+		{"edge/gw1/sys/cpu/0/user", "12.5", 1, true},
+		{"edge/gw1/sys/mem/free", "2048", 1, true},
+		{"edge/gw1/status", "offline", 0, true},
+	}
+	if !reflect.DeepEqual(b.messages, expected) {
+		t.Errorf("invalid messages: %v", b.messages)
+	}
+	if b.retained["edge/gw1/status"] != "offline" {
+		t.Errorf("invalid status: %q", b.retained["edge/gw1/status"])
+	}
+}
+
+// TestMQTTJSON tests publishing JSON documents with QoS 2.
+func TestMQTTJSON(t *testing.T) {
+	b := newMQTTBroker(t, nil)
+	defer b.Close()
+	m, err := output.NewMQTT(output.MQTTConfiguration{
+		Broker: "mqtt://" + b.addr(),
+		Topic:  "edge/gw1",
+		JSON:   true,
+		QoS:    2,
+	})
+	if err != nil {
+		t.Fatalf("cannot create MQTT writer: %v", err)
+	}
+	defer m.Close()
+	err = m.Write(context.Background(), newUpdate(1500000000, collector.Values{
+		"sys.mem.free": "2048",
+	}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expected := []brokerMessage{
+		{"edge/gw1/status", "online", 2, true},
+		{"edge/gw1/metrics", `{"timestamp":"` + time.Unix(1500000000, 0).Format(time.RFC3339) + `","values":{"sys.mem.free":"2048"}}`, 2, false},
+	}
+	if !reflect.DeepEqual(b.messages, expected) {
+		t.Errorf("invalid messages: %v", b.messages)
+	}
+	if b.pubRels != 2 {
+		t.Errorf("invalid number of releases: %d", b.pubRels)
+	}
+}
+
+// TestMQTTOffline tests queueing messages while the broker isn't reachable
+// and the last will after a lost connection.
+func TestMQTTOffline(t *testing.T) {
+	b := newMQTTBroker(t, nil)
+	defer b.Close()
+	m, err := output.NewMQTT(output.MQTTConfiguration{
+		Broker:     "tcp://" + b.addr(),
+		Topic:      "edge/gw1",
+		QoS:        1,
+		BufferSize: 2,
+		Timeout:    time.Second,
+	})
+	if err != nil {
+		t.Fatalf("cannot create MQTT writer: %v", err)
+	}
+	defer m.Close()
+	b.mu.Lock()
+	b.refuse = true
+	b.mu.Unlock()
+	for i := int64(1); i <= 3; i++ {
+		if err := m.Write(context.Background(), newUpdate(i, collector.Values{"a": string('0' + byte(i))})); err == nil {
+			t.Errorf("expected write error")
+		}
+	}
+	if m.Dropped() != 1 {
+		t.Errorf("invalid number of dropped messages: %d", m.Dropped())
+	}
+	b.mu.Lock()
+	b.refuse = false
+	b.mu.Unlock()
+	if err := m.Write(context.Background(), newUpdate(4, collector.Values{"a": "4"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	// Lose the connection, the broker publishes the last will.
+	b.kill()
+	b.waitFor(t, func() bool { return b.retained["edge/gw1/status"] == "offline" })
+	// Give the writer time to notice the lost connection.
+	time.Sleep(50 * time.Millisecond)
+	if err := m.Write(context.Background(), newUpdate(5, collector.Values{"a": "5"})); err != nil {
+		t.Fatalf("cannot write after lost connection: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expected := []brokerMessage{
+		{"edge/gw1/status", "online", 1, true},
+		{"edge/gw1/a", "3", 1, false},
+		{"edge/gw1/a", "4", 1, false},
+		{"edge/gw1/status", "online", 1, true},
+		{"edge/gw1/a", "5", 1, false},
+	}
+	if !reflect.DeepEqual(b.messages, expected) {
+		t.Errorf("invalid messages: %v", b.messages)
+	}
+	if b.retained["edge/gw1/status"] != "online" {
+		t.Errorf("invalid status: %q", b.retained["edge/gw1/status"])
+	}
+}
+
+// TestMQTTTLS tests publishing via TLS.
+func TestMQTTTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond-mqtt")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, caFile := newBrokerCert(t, dir)
+	b := newMQTTBroker(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer b.Close()
+	_, port, _ := net.SplitHostPort(b.addr())
+	m, err := output.NewMQTT(output.MQTTConfiguration{
+		Broker: "ssl://localhost:" + port,
+		CAFile: caFile,
+		Topic:  "edge/gw1",
+	})
+	if err != nil {
+		t.Fatalf("cannot create MQTT writer: %v", err)
+	}
+	if err := m.Write(context.Background(), newUpdate(1, collector.Values{"a": "1"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	m.Close()
+	b.waitFor(t, func() bool { return b.disconnects == 1 })
+
+	// Unknown CA.
+	m, err = output.NewMQTT(output.MQTTConfiguration{
+		Broker: "ssl://localhost:" + port,
+		Topic:  "edge/gw1",
+	})
+	if err != nil {
+		t.Fatalf("cannot create MQTT writer: %v", err)
+	}
+	if err := m.Write(context.Background(), newUpdate(1, collector.Values{"a": "1"})); err == nil {
+		t.Errorf("expected certificate error")
+	}
+}
+
+// TestMQTTInvalid tests invalid configurations.
+func TestMQTTInvalid(t *testing.T) {
+	for _, cfg := range []output.MQTTConfiguration{
+		{Broker: ""},
+		{Broker: "http://localhost"},
+		{Broker: "tcp://localhost", QoS: 3},
+		{Broker: "ssl://localhost", CAFile: "/does/not/exist"},
+	} {
+		if _, err := output.NewMQTT(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// brokerConnect is a received connect.
+type brokerConnect struct {
+	clientID    string
+	username    string
+	password    string
+	willTopic   string
+	willPayload string
+	willQoS     byte
+	willRetain  bool
+}
+
+// brokerMessage is a received message.
+type brokerMessage struct {
+	topic   string
+	payload string
+	qos     byte
+	retain  bool
+}
+
+// mqttBroker is a minimal test-local MQTT 3.1.1 broker. It records the
+// connects and published messages, keeps retained messages, and publishes
+// the last will when a connection is lost.
+type mqttBroker struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu          sync.Mutex
+	conns       []net.Conn
+	connects    []brokerConnect
+	messages    []brokerMessage
+	retained    map[string]string
+	disconnects int
+	pubRels     int
+	refuse      bool
+}
+
+// newMQTTBroker starts the broker, with TLS if configured.
+func newMQTTBroker(t *testing.T, tlsCfg *tls.Config) *mqttBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	b := &mqttBroker{
+		ln:       ln,
+		retained: make(map[string]string),
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// addr returns the address of the broker.
+func (b *mqttBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+// kill closes all connections without disconnect.
+func (b *mqttBroker) kill() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+// Close stops the broker.
+func (b *mqttBroker) Close() {
+	b.ln.Close()
+	b.kill()
+	b.wg.Wait()
+}
+
+// waitFor waits until the condition is true.
+func (b *mqttBroker) waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 500; i++ {
+		b.mu.Lock()
+		ok := condition()
+		b.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not met")
+}
+
+// serve handles one client connection.
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header, body, err := readBrokerPacket(r)
+	if err != nil || header>>4 != 1 {
+		return
+	}
+	b.mu.Lock()
+	if b.refuse {
+		b.mu.Unlock()
+		conn.Write([]byte{0x20, 2, 0, 3})
+		return
+	}
+	c := parseConnect(body)
+	b.connects = append(b.connects, c)
+	b.conns = append(b.conns, conn)
+	b.mu.Unlock()
+	conn.Write([]byte{0x20, 2, 0, 0})
+	for {
+		header, body, err := readBrokerPacket(r)
+		if err != nil {
+			// Lost connection, publish the last will.
+			b.mu.Lock()
+			if c.willRetain {
+				b.retained[c.willTopic] = c.willPayload
+			}
+			b.mu.Unlock()
+			return
+		}
+		switch header >> 4 {
+		case 3:
+			qos := header >> 1 & 3
+			topic, rest := readBrokerString(body)
+			msg := brokerMessage{topic, "", qos, header&1 == 1}
+			if qos > 0 {
+				id := rest[:2]
+				rest = rest[2:]
+				ack := byte(0x40)
+				if qos == 2 {
+					ack = 0x50
+				}
+				conn.Write([]byte{ack, 2, id[0], id[1]})
+			}
+			msg.payload = string(rest)
+			b.mu.Lock()
+			b.messages = append(b.messages, msg)
+			if msg.retain {
+				b.retained[topic] = msg.payload
+			}
+			b.mu.Unlock()
+		case 6:
+			b.mu.Lock()
+			b.pubRels++
+			b.mu.Unlock()
+			conn.Write([]byte{0x70, 2, body[0], body[1]})
+		case 12:
+			conn.Write([]byte{0xd0, 0})
+		case 14:
+			b.mu.Lock()
+			b.disconnects++
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// parseConnect parses the body of a connect packet.
+func parseConnect(body []byte) brokerConnect {
+	var c brokerConnect
+	_, rest := readBrokerString(body)
+	flags := rest[1]
+	rest = rest[4:]
+	c.clientID, rest = readBrokerString(rest)
+	if flags&0x04 != 0 {
+		c.willQoS = flags >> 3 & 3
+		c.willRetain = flags&0x20 != 0
+		c.willTopic, rest = readBrokerString(rest)
+		c.willPayload, rest = readBrokerString(rest)
+	}
+	if flags&0x80 != 0 {
+		c.username, rest = readBrokerString(rest)
+	}
+	if flags&0x40 != 0 {
+		c.password, _ = readBrokerString(rest)
+	}
+	return c
+}
+
+// readBrokerString reads a length prefixed string.
+func readBrokerString(b []byte) (string, []byte) {
+	l := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+l]), b[2+l:]
+}
+
+// readBrokerPacket reads a packet.
+func readBrokerPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// newBrokerCert creates a self-signed broker certificate for localhost and
+// writes it as CA file.
+func newBrokerCert(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("cannot write certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+// EOF
@@ -0,0 +1,455 @@
+// System Monitor Daemon - Output - OpenTelemetry
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Protocols of the OTLP output.
+const (
+	OTLPHTTP = "http/protobuf"
+	OTLPGRPC = "grpc"
+)
+
+// otlpGRPCPath is the path of the gRPC metrics export method.
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// otlpTemporalityCumulative is the OTLP aggregation temporality of sums.
+const otlpTemporalityCumulative = 2
+
+// otlpRetryableCodes are the gRPC status codes which can be retried.
+var otlpRetryableCodes = map[string]bool{
+	"1": true, "4": true, "8": true, "10": true, "11": true, "14": true, "15": true,
+}
+
+//--------------------
+// OTLP
+//--------------------
+
+// OTLPConfiguration contains the configuration of an OpenTelemetry output.
+// The endpoint is the base URL of the OTLP receiver, e.g. "http://otel:4318"
+// for HTTP/protobuf or "http://otel:4317" for gRPC, which then uses HTTP/2
+// without TLS. The headers are sent with each export, the attributes are
+// added to the resource. The instance ID defaults to a random UUID. Exports
+// which fail with retryable errors are retried with the next update, at
+// most BufferSize ones are kept.
+type OTLPConfiguration struct {
+	Endpoint   string
+	Protocol   string
+	Headers    map[string]string
+	Attributes map[string]string
+	InstanceID string
+	Gzip       bool
+	BufferSize int
+	Timeout    time.Duration
+}
+
+// OTLP exports the numeric values of the metrics via the OpenTelemetry
+// protocol. Values of the CPU, memory, disk, and network meter points are
+// mapped to the names of the OpenTelemetry semantic conventions, all other
+// ones are exported as gauges named like their IDs.
+type OTLP struct {
+	cfg      OTLPConfiguration
+	url      string
+	resource []otlpAttribute
+	start    time.Time
+	client   *http.Client
+	spool    *spool
+}
+
+// NewOTLP creates an OpenTelemetry writer.
+func NewOTLP(cfg OTLPConfiguration) (*OTLP, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", cfg.Endpoint)
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 100
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	o := &OTLP{
+		cfg:    cfg,
+		start:  time.Now(),
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	switch cfg.Protocol {
+	case "", OTLPHTTP:
+		o.cfg.Protocol = OTLPHTTP
+		o.url = strings.TrimSuffix(cfg.Endpoint, "/") + "/v1/metrics"
+	case OTLPGRPC:
+		o.url = strings.TrimSuffix(cfg.Endpoint, "/") + otlpGRPCPath
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		o.client.Transport = &http.Transport{
+			Protocols: protocols,
+		}
+	default:
+		return nil, fmt.Errorf("invalid OTLP protocol %q", cfg.Protocol)
+	}
+	attributes := map[string]string{
+		"service.name": "sysmond",
+		"os.type":      runtime.GOOS,
+	}
+	if attributes["host.name"], err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("cannot get host name: %v", err)
+	}
+	if attributes["service.instance.id"] = cfg.InstanceID; cfg.InstanceID == "" {
+		if attributes["service.instance.id"], err = newUUID(); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range cfg.Attributes {
+		attributes[k] = v
+	}
+	for k, v := range attributes {
+		o.resource = append(o.resource, otlpAttribute{key: k, value: v})
+	}
+	sort.Slice(o.resource, func(i, j int) bool { return o.resource[i].key < o.resource[j].key })
+	if o.spool, err = newSpool("", cfg.BufferSize); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Write implements Writer. Buffered exports are sent first.
+func (o *OTLP) Write(ctx context.Context, u poller.Update) error {
+	req := o.request(u)
+	if ctx.Err() != nil {
+		o.spool.push(req)
+		return ctx.Err()
+	}
+	err := o.flush(ctx)
+	if err == nil {
+		var permanent bool
+		if permanent, err = o.export(ctx, req); err == nil || permanent {
+			return err
+		}
+	}
+	o.spool.push(req)
+	return err
+}
+
+// Close implements Writer. Buffered exports are sent if possible.
+func (o *OTLP) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.cfg.Timeout)
+	defer cancel()
+	return o.flush(ctx)
+}
+
+// flush sends the buffered exports. Those rejected permanently are dropped.
+func (o *OTLP) flush(ctx context.Context) error {
+	var rerr error
+	for {
+		req, ok, _ := o.spool.peek()
+		if !ok {
+			return rerr
+		}
+		permanent, err := o.export(ctx, req)
+		if err != nil && !permanent {
+			return err
+		}
+		rerr = err
+		o.spool.pop()
+	}
+}
+
+// export sends one export request. It returns true if the request has
+// been rejected permanently.
+func (o *OTLP) export(ctx context.Context, msg []byte) (bool, error) {
+	body := msg
+	if o.cfg.Gzip {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(msg)
+		gw.Close()
+		body = buf.Bytes()
+	}
+	if o.cfg.Protocol == OTLPGRPC {
+		// Length-prefixed message with compression flag.
+		prefix := make([]byte, 5)
+		if o.cfg.Gzip {
+			prefix[0] = 1
+		}
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(body)))
+		body = append(prefix, body...)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.url, bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	for k, v := range o.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case o.cfg.Protocol == OTLPGRPC:
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+		if o.cfg.Gzip {
+			req.Header.Set("Grpc-Encoding", "gzip")
+		}
+	default:
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		if o.cfg.Gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("cannot export to OTLP receiver: %v", err)
+	}
+	defer resp.Body.Close()
+	msgBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if o.cfg.Protocol == OTLPGRPC {
+		status := resp.Trailer.Get("Grpc-Status")
+		if status == "" {
+			// Trailers-only response.
+			status = resp.Header.Get("Grpc-Status")
+		}
+		switch {
+		case resp.StatusCode != http.StatusOK:
+			return false, fmt.Errorf("OTLP receiver failed: %s", resp.Status)
+		case status == "0":
+			return false, nil
+		case otlpRetryableCodes[status]:
+			return false, fmt.Errorf("OTLP receiver unavailable: gRPC status %s", status)
+		}
+		return true, fmt.Errorf("OTLP receiver rejected export: gRPC status %s: %s",
+			status, resp.Trailer.Get("Grpc-Message"))
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return false, nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return false, fmt.Errorf("OTLP receiver unavailable: %s", resp.Status)
+	}
+	return true, fmt.Errorf("OTLP receiver rejected export: %s: %d bytes", resp.Status, len(msgBody))
+}
+
+// request creates the encoded export request of the update.
+func (o *OTLP) request(u poller.Update) []byte {
+	values := u.Metrics.Values()
+	metrics := map[string]*otlpMetric{}
+	for id, value := range values {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		m, p := otlpMap(id, f)
+		if metrics[m.name] == nil {
+			metrics[m.name] = &m
+		}
+		metrics[m.name].points = append(metrics[m.name].points, p)
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	start := uint64(o.start.UnixNano())
+	ts := uint64(u.Timestamp.UnixNano())
+	var e pbEncoder
+	// ExportMetricsServiceRequest.resource_metrics
+	e.message(1, func(e *pbEncoder) {
+		// ResourceMetrics.resource
+		e.message(1, func(e *pbEncoder) {
+			for _, a := range o.resource {
+				e.message(1, a.encode)
+			}
+		})
+		// ResourceMetrics.scope_metrics
+		e.message(2, func(e *pbEncoder) {
+			e.message(1, func(e *pbEncoder) {
+				e.string(1, "sysmond")
+			})
+			for _, name := range names {
+				e.message(2, func(e *pbEncoder) {
+					metrics[name].encode(e, start, ts)
+				})
+			}
+		})
+	})
+	return e.bytes()
+}
+
+//--------------------
+// OTLP METRICS
+//--------------------
+
+// otlpAttribute is an attribute with a string or an int value.
+type otlpAttribute struct {
+	key   string
+	value string
+	isInt bool
+}
+
+// encode encodes the attribute as KeyValue.
+func (a otlpAttribute) encode(e *pbEncoder) {
+	e.string(1, a.key)
+	e.message(2, func(e *pbEncoder) {
+		if a.isInt {
+			i, _ := strconv.ParseInt(a.value, 10, 64)
+			e.varint(3, uint64(i))
+			return
+		}
+		e.string(1, a.value)
+	})
+}
+
+// otlpPoint is a data point of a metric.
+type otlpPoint struct {
+	id         string
+	attributes []otlpAttribute
+	value      float64
+}
+
+// otlpMetric is a gauge or a monotonic cumulative sum.
+type otlpMetric struct {
+	name   string
+	unit   string
+	sum    bool
+	points []otlpPoint
+}
+
+// encode encodes the metric as Metric.
+func (m *otlpMetric) encode(e *pbEncoder, start, ts uint64) {
+	sort.Slice(m.points, func(i, j int) bool { return m.points[i].id < m.points[j].id })
+	e.string(1, m.name)
+	e.string(3, m.unit)
+	points := func(e *pbEncoder) {
+		for _, p := range m.points {
+			e.message(1, func(e *pbEncoder) {
+				if m.sum {
+					e.fixed64(2, start)
+				}
+				e.fixed64(3, ts)
+				e.double(4, p.value)
+				for _, a := range p.attributes {
+					e.message(7, a.encode)
+				}
+			})
+		}
+	}
+	if !m.sum {
+		e.message(5, points)
+		return
+	}
+	e.message(7, func(e *pbEncoder) {
+		points(e)
+		e.varint(2, otlpTemporalityCumulative)
+		e.varint(3, 1)
+	})
+}
+
+// otlpMap maps a metric ID and its value to the OpenTelemetry semantic
+// conventions. Values in kilobytes are converted to bytes.
+func otlpMap(id string, value float64) (otlpMetric, otlpPoint) {
+	parts := strings.Split(id, ".")
+	p := otlpPoint{id: id, value: value}
+	attr := func(key, value string) {
+		p.attributes = append(p.attributes, otlpAttribute{key: key, value: value})
+	}
+	if len(parts) > 2 && parts[0] == "sys" {
+		stem, rest := parts[1], parts[2:]
+		switch {
+		case stem == "cpu" && len(rest) == 2:
+			if _, err := strconv.Atoi(rest[0]); err == nil {
+				p.attributes = append(p.attributes, otlpAttribute{key: "cpu.logical_number", value: rest[0], isInt: true})
+				attr("cpu.mode", rest[1])
+				return otlpMetric{name: "system.cpu.time", unit: "s", sum: true}, p
+			}
+		case stem == "mem":
+			p.value *= 1024
+			switch strings.Join(rest, ".") {
+			case "total":
+				return otlpMetric{name: "system.memory.limit", unit: "By"}, p
+			case "free":
+				attr("system.memory.state", "free")
+				return otlpMetric{name: "system.memory.usage", unit: "By"}, p
+			case "available":
+				return otlpMetric{name: "system.linux.memory.available", unit: "By"}, p
+			case "swap.free":
+				attr("system.paging.state", "free")
+				return otlpMetric{name: "system.paging.usage", unit: "By"}, p
+			}
+			p.value = value
+		case stem == "disk" && len(rest) == 2:
+			attr("system.device", rest[0])
+			p.value *= 1024
+			switch rest[1] {
+			case "total":
+				return otlpMetric{name: "system.filesystem.limit", unit: "By"}, p
+			case "used":
+				attr("system.filesystem.state", "used")
+				return otlpMetric{name: "system.filesystem.usage", unit: "By"}, p
+			case "available":
+				attr("system.filesystem.state", "free")
+				return otlpMetric{name: "system.filesystem.usage", unit: "By"}, p
+			}
+			p.attributes = nil
+			p.value = value
+		case stem == "net" && len(rest) >= 3:
+			n := len(rest)
+			attr("network.interface.name", strings.Join(rest[:n-2], "."))
+			attr("network.io.direction", map[string]string{"rx": "receive", "tx": "transmit"}[rest[n-2]])
+			switch rest[n-1] {
+			case "bytes":
+				return otlpMetric{name: "system.network.io", unit: "By", sum: true}, p
+			case "packets":
+				return otlpMetric{name: "system.network.packets", unit: "{packet}", sum: true}, p
+			case "errors":
+				return otlpMetric{name: "system.network.errors", unit: "{error}", sum: true}, p
+			case "drops":
+				return otlpMetric{name: "system.network.dropped", unit: "{packet}", sum: true}, p
+			}
+			p.attributes = nil
+		}
+	}
+	return otlpMetric{name: id}, p
+}
+
+// newUUID creates a random UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot create UUID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// EOF
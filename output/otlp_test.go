@@ -0,0 +1,316 @@
+// System Monitor Daemon - Output - OpenTelemetry - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestOTLP tests exporting via HTTP/protobuf and gRPC.
+func TestOTLP(t *testing.T) {
+	r := newOTLPReceiver(t)
+	defer r.Close()
+	host, _ := os.Hostname()
+	for _, protocol := range []string{output.OTLPHTTP, output.OTLPGRPC} {
+		r.reset()
+		o, err := output.NewOTLP(output.OTLPConfiguration{
+			Endpoint:   r.URL,
+			Protocol:   protocol,
+			Headers:    map[string]string{"X-Token": "s3cr3t"},
+			Attributes: map[string]string{"deployment.environment": "test"},
+			InstanceID: "i-1",
+			Gzip:       true,
+		})
+		if err != nil {
+			t.Fatalf("%s: cannot create OTLP writer: %v", protocol, err)
+		}
+		err = o.Write(context.Background(), newUpdate(1500000000, collector.Values{
+			"sys.cpu.0.user":          "12.5",
+			"sys.cpu.1.user":          "10",
+			"sys.mem.free":            "2",
+			"sys.disk.root.used":      "1",
+			"sys.net.eth0.rx.bytes":   "100",
+			"sysmond.self.goroutines": "7",
+			"version.sysmond":         "0.1.0",
+		}))
+		if err != nil {
+			t.Fatalf("%s: cannot write: %v", protocol, err)
+		}
+		o.Close()
+
+		exports := r.received()
+		if len(exports) != 1 {
+			t.Fatalf("%s: invalid number of exports: %d", protocol, len(exports))
+		}
+		expected := fmt.Sprintf("deployment.environment=test host.name=%s os.type=linux service.instance.id=i-1 service.name=sysmond", host)
+		if exports[0].resource != expected {
+			t.Errorf("%s: invalid resource: %s", protocol, exports[0].resource)
+		}
+		expectedMetrics := []string{
+			"sysmond.self.goroutines gauge  [7]",
+			"system.cpu.time sum s [cpu.logical_number=0 cpu.mode=user:12.5 cpu.logical_number=1 cpu.mode=user:10]",
+			"system.filesystem.usage gauge By [system.device=root system.filesystem.state=used:1024]",
+			"system.memory.usage gauge By [system.memory.state=free:2048]",
+			"system.network.io sum By [network.interface.name=eth0 network.io.direction=receive:100]",
+		}
+		if !reflect.DeepEqual(exports[0].metrics, expectedMetrics) {
+			t.Errorf("%s: invalid metrics: %q", protocol, exports[0].metrics)
+		}
+		if r.header.Get("X-Token") != "s3cr3t" {
+			t.Errorf("%s: missing header", protocol)
+		}
+	}
+}
+
+// TestOTLPRetry tests retrying unavailable receivers with the next update.
+func TestOTLPRetry(t *testing.T) {
+	r := newOTLPReceiver(t)
+	defer r.Close()
+	o, err := output.NewOTLP(output.OTLPConfiguration{Endpoint: r.URL})
+	if err != nil {
+		t.Fatalf("cannot create OTLP writer: %v", err)
+	}
+	r.mu.Lock()
+	r.failCode = http.StatusServiceUnavailable
+	r.mu.Unlock()
+	if err := o.Write(context.Background(), newUpdate(1, collector.Values{"a": "1"})); err == nil {
+		t.Errorf("expected write error")
+	}
+	r.mu.Lock()
+	r.failCode = 0
+	r.mu.Unlock()
+	if err := o.Write(context.Background(), newUpdate(2, collector.Values{"a": "2"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	exports := r.received()
+	if len(exports) != 2 || exports[0].metrics[0] != "a gauge  [1]" || exports[1].metrics[0] != "a gauge  [2]" {
+		t.Errorf("invalid exports: %v", exports)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// otlpExport is a decoded export, simplified for comparisons.
+type otlpExport struct {
+	resource string
+	metrics  []string
+}
+
+// otlpReceiver is an in-process OTLP receiver for HTTP/protobuf and gRPC.
+type otlpReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	exports  []otlpExport
+	header   http.Header
+	failCode int
+}
+
+// newOTLPReceiver starts a receiver supporting HTTP/1.1 and HTTP/2 without TLS.
+func newOTLPReceiver(t *testing.T) *otlpReceiver {
+	r := &otlpReceiver{}
+	r.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.header = req.Header
+		body, _ := ioutil.ReadAll(req.Body)
+		grpc := req.URL.Path == "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+		switch {
+		case grpc:
+			if req.ProtoMajor != 2 || len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+				t.Errorf("invalid gRPC request")
+				return
+			}
+			if body[0] == 1 {
+				body = gunzip(t, body[5:])
+			} else {
+				body = body[5:]
+			}
+		case req.URL.Path == "/v1/metrics":
+			if req.Header.Get("Content-Type") != "application/x-protobuf" {
+				t.Errorf("invalid content type")
+			}
+			if req.Header.Get("Content-Encoding") == "gzip" {
+				body = gunzip(t, body)
+			}
+		default:
+			http.NotFound(w, req)
+			return
+		}
+		if r.failCode != 0 {
+			w.WriteHeader(r.failCode)
+			return
+		}
+		r.exports = append(r.exports, decodeExport(t, body))
+		if grpc {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte{0, 0, 0, 0, 0})
+			w.Header().Set("Grpc-Status", "0")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	r.Config.Protocols = new(http.Protocols)
+	r.Config.Protocols.SetHTTP1(true)
+	r.Config.Protocols.SetUnencryptedHTTP2(true)
+	r.Start()
+	return r
+}
+
+// reset removes the received exports.
+func (r *otlpReceiver) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exports = nil
+}
+
+// received returns the received exports.
+func (r *otlpReceiver) received() []otlpExport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.exports
+}
+
+// gunzip decompresses the data.
+func gunzip(t *testing.T, data []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid gzip data: %v", err)
+	}
+	b, _ := ioutil.ReadAll(gr)
+	return b
+}
+
+// decodeExport decodes an ExportMetricsServiceRequest into a simplified
+// form: the resource attributes as "key=value" and each metric as
+// "name kind unit [attributes:value ...]".
+func decodeExport(t *testing.T, b []byte) otlpExport {
+	var export otlpExport
+	for _, rm := range pbDecode(t, b)[1] {
+		fields := pbDecode(t, rm.([]byte))
+		var attrs []string
+		for _, kv := range pbDecode(t, fields[1][0].([]byte))[1] {
+			attrs = append(attrs, decodeKeyValue(t, kv.([]byte)))
+		}
+		sort.Strings(attrs)
+		export.resource = strings.Join(attrs, " ")
+		for _, sm := range fields[2] {
+			for _, m := range pbDecode(t, sm.([]byte))[2] {
+				export.metrics = append(export.metrics, decodeMetric(t, m.([]byte)))
+			}
+		}
+	}
+	return export
+}
+
+// decodeMetric decodes a Metric.
+func decodeMetric(t *testing.T, b []byte) string {
+	fields := pbDecode(t, b)
+	name := string(fields[1][0].([]byte))
+	unit := ""
+	if len(fields[3]) > 0 {
+		unit = string(fields[3][0].([]byte))
+	}
+	kind, data := "gauge", fields[5]
+	if len(fields[7]) > 0 {
+		kind, data = "sum", fields[7]
+		sum := pbDecode(t, data[0].([]byte))
+		if sum[2][0].(uint64) != 2 || sum[3][0].(uint64) != 1 {
+			t.Errorf("invalid sum of %s", name)
+		}
+	}
+	var points []string
+	for _, dp := range pbDecode(t, data[0].([]byte))[1] {
+		pf := pbDecode(t, dp.([]byte))
+		if pf[3][0].(uint64) != 1500000000000000000 && pf[3][0].(uint64) > 10000000000 {
+			t.Errorf("invalid timestamp of %s", name)
+		}
+		var attrs []string
+		for _, kv := range pf[7] {
+			attrs = append(attrs, decodeKeyValue(t, kv.([]byte)))
+		}
+		value := math.Float64frombits(pf[4][0].(uint64))
+		point := fmt.Sprintf("%v", value)
+		if len(attrs) > 0 {
+			point = strings.Join(attrs, " ") + ":" + point
+		}
+		points = append(points, point)
+	}
+	return fmt.Sprintf("%s %s %s [%s]", name, kind, unit, strings.Join(points, " "))
+}
+
+// decodeKeyValue decodes a KeyValue with string or int value.
+func decodeKeyValue(t *testing.T, b []byte) string {
+	fields := pbDecode(t, b)
+	value := pbDecode(t, fields[2][0].([]byte))
+	if len(value[3]) > 0 {
+		return fmt.Sprintf("%s=%d", fields[1][0], value[3][0])
+	}
+	return fmt.Sprintf("%s=%s", fields[1][0], value[1][0])
+}
+
+// pbDecode decodes the fields of a protocol buffers message. Varints and
+// fixed64 values are returned as uint64, length delimited ones as []byte.
+func pbDecode(t *testing.T, b []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("invalid tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case 1:
+			fields[field] = append(fields[field], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("invalid wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// EOF
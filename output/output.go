@@ -0,0 +1,107 @@
+// System Monitor Daemon - Output
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// WRITER
+//--------------------
+
+// Writer writes the metrics of poller updates to a destination. Writers
+// are used by one goroutine only. They have to buffer what they cannot
+// write and retry it with the next update.
+type Writer interface {
+	// Write writes the metrics of the update. The context is done when
+	// the output stops.
+	Write(ctx context.Context, u poller.Update) error
+
+	// Close flushes what's possible and releases the resources.
+	Close() error
+}
+
+//--------------------
+// OUTPUT
+//--------------------
+
+// Output pushes the updates of a poller to a writer after each poll.
+type Output struct {
+	name   string
+	writer Writer
+	sub    *poller.Subscription
+	cancel func()
+	doneC  chan struct{}
+	err    error
+}
+
+// Start subscribes to the updates of the poller and writes them with the
+// writer until the output or the poller is stopped. The name is used for
+// logging.
+func Start(p *poller.Poller, name string, w Writer) *Output {
+	ctx, cancel := context.WithCancel(context.Background())
+	o := &Output{
+		name:   name,
+		writer: w,
+		sub:    p.Subscribe(),
+		cancel: cancel,
+		doneC:  make(chan struct{}),
+	}
+	go o.backend(ctx, p)
+	return o
+}
+
+// Stop ends the output and closes the writer. A running write is
+// cancelled, closing flushes the rest. It returns the error of closing.
+func (o *Output) Stop() error {
+	o.cancel()
+	o.sub.Unsubscribe()
+	<-o.doneC
+	return o.err
+}
+
+// backend writes the updates and logs changes of the write state.
+func (o *Output) backend(ctx context.Context, p *poller.Poller) {
+	defer close(o.doneC)
+	logger := slog.With("output", o.name)
+	failing := false
+	write := func(u poller.Update) {
+		err := o.writer.Write(ctx, u)
+		if ctx.Err() != nil {
+			// Stopping, closing flushes the rest.
+			return
+		}
+		switch {
+		case err != nil && !failing:
+			logger.Error("cannot write metrics", "error", err)
+		case err == nil && failing:
+			logger.Info("writing metrics recovered")
+		}
+		failing = err != nil
+	}
+	// Initial collection may be done before subscribing.
+	if ts, m := p.Metrics(); m != nil {
+		write(poller.Update{Timestamp: ts, Metrics: m})
+	}
+	for u := range o.sub.Updates() {
+		write(u)
+	}
+	if o.err = o.writer.Close(); o.err != nil {
+		logger.Error("cannot close output", "error", o.err)
+	}
+}
+
+// EOF
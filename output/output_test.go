@@ -0,0 +1,94 @@
+// System Monitor Daemon - Output - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestOutput tests writing the poller updates until stopping.
+func TestOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("a", func(ctx context.Context) (collector.Values, error) {
+		return collector.Values{"b": "1"}, nil
+	}))
+	p := poller.New(ctx, c, 20*time.Millisecond)
+	w := &recordingWriter{}
+	o := output.Start(p, "test", w)
+	deadline := time.Now().Add(5 * time.Second)
+	for w.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no updates written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := o.Stop(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		t.Errorf("writer not closed")
+	}
+	if w.updates[0].Metrics.Values()["a.b"] != "1" {
+		t.Errorf("invalid update: %v", w.updates[0].Metrics.Values())
+	}
+}
+
+//--------------------
+// STUBS
+//--------------------
+
+// recordingWriter records the written updates.
+type recordingWriter struct {
+	mu      sync.Mutex
+	updates []poller.Update
+	closed  bool
+}
+
+// Write implements output.Writer.
+func (w *recordingWriter) Write(ctx context.Context, u poller.Update) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updates = append(w.updates, u)
+	return nil
+}
+
+// Close implements output.Writer.
+func (w *recordingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+// count returns the number of written updates.
+func (w *recordingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.updates)
+}
+
+// EOF
@@ -0,0 +1,83 @@
+// System Monitor Daemon - Output - Protocol Buffers
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+//--------------------
+// PROTOCOL BUFFERS
+//--------------------
+
+// Wire types of the protocol buffers encoding.
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+)
+
+// pbEncoder encodes protocol buffers messages. It only supports the few
+// types needed by the outputs, so no generated code and no dependencies
+// are needed.
+type pbEncoder struct {
+	buf []byte
+}
+
+// bytes returns the encoded message.
+func (e *pbEncoder) bytes() []byte {
+	return e.buf
+}
+
+// tag appends the tag of a field.
+func (e *pbEncoder) tag(field, wireType int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// varint appends a varint field, e.g. of types int64, bool, or enums.
+func (e *pbEncoder) varint(field int, v uint64) {
+	e.tag(field, pbVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+// fixed64 appends a fixed64 or sfixed64 field.
+func (e *pbEncoder) fixed64(field int, v uint64) {
+	e.tag(field, pbFixed64)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// double appends a double field.
+func (e *pbEncoder) double(field int, f float64) {
+	e.fixed64(field, math.Float64bits(f))
+}
+
+// string appends a string field, empty ones are skipped.
+func (e *pbEncoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.tag(field, pbBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// message appends an embedded message encoded by the function.
+func (e *pbEncoder) message(field int, encode func(e *pbEncoder)) {
+	var me pbEncoder
+	encode(&me)
+	e.tag(field, pbBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(me.buf)))
+	e.buf = append(e.buf, me.buf...)
+}
+
+// EOF
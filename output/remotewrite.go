@@ -0,0 +1,347 @@
+// System Monitor Daemon - Output - Prometheus Remote-Write
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// remoteWriteLabelName is the pattern of valid label names.
+var remoteWriteLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+//--------------------
+// REMOTE-WRITE
+//--------------------
+
+// RemoteWriteConfiguration contains the configuration of a Prometheus
+// remote-write output. Requests are authenticated with the bearer token or
+// username and password if set. The external labels are added to all
+// series, "job" defaults to "sysmond" and "instance" to the host name. The
+// series are distributed to the shards, each sends its requests with at
+// most MaxSamplesPerSend samples on its own. Requests are written to the
+// write-ahead log of their shard before sending, in the directory or in
+// memory if none is set. Failed requests are retried with doubling backoff
+// and stay in the log until they are delivered. At most WALSize requests
+// per shard are kept, on overflow the oldest ones are dropped.
+type RemoteWriteConfiguration struct {
+	URL               string
+	BearerToken       string
+	Username          string
+	Password          string
+	ExternalLabels    map[string]string
+	Shards            int
+	MaxSamplesPerSend int
+	Retries           int
+	RetryBackoff      time.Duration
+	WALDir            string
+	WALSize           int
+	Timeout           time.Duration
+}
+
+// remoteWriteSeries is a series with one sample.
+type remoteWriteSeries struct {
+	name  string
+	value float64
+}
+
+// RemoteWrite pushes the numeric values of the metrics via the Prometheus
+// remote-write protocol. The metric IDs are the metric names with invalid
+// characters replaced by underscores, e.g. "sys_cpu_0_user".
+type RemoteWrite struct {
+	cfg    RemoteWriteConfiguration
+	labels [][2]string
+	client *http.Client
+	shards []*spool
+}
+
+// NewRemoteWrite creates a remote-write writer. Requests left in the
+// write-ahead log by an earlier run are sent with the first write.
+func NewRemoteWrite(cfg RemoteWriteConfiguration) (*RemoteWrite, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid remote-write URL %q", cfg.URL)
+	}
+	if cfg.Shards <= 0 {
+		cfg.Shards = 4
+	}
+	if cfg.MaxSamplesPerSend <= 0 {
+		cfg.MaxSamplesPerSend = 500
+	}
+	if cfg.Retries <= 0 {
+		cfg.Retries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.WALSize <= 0 {
+		cfg.WALSize = 1000
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	labels := map[string]string{"job": "sysmond"}
+	for k, v := range cfg.ExternalLabels {
+		if !remoteWriteLabelName.MatchString(k) || k == "__name__" {
+			return nil, fmt.Errorf("invalid remote-write label name %q", k)
+		}
+		labels[k] = v
+	}
+	if labels["instance"] == "" {
+		if labels["instance"], err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot get host name: %v", err)
+		}
+	}
+	rw := &RemoteWrite{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	for k, v := range labels {
+		if v != "" {
+			// Empty labels are the same as missing ones.
+			rw.labels = append(rw.labels, [2]string{k, v})
+		}
+	}
+	for i := 0; i < cfg.Shards; i++ {
+		dir := ""
+		if cfg.WALDir != "" {
+			dir = filepath.Join(cfg.WALDir, fmt.Sprintf("shard-%d", i))
+		}
+		s, err := newSpool(dir, cfg.WALSize)
+		if err != nil {
+			return nil, err
+		}
+		rw.shards = append(rw.shards, s)
+	}
+	return rw, nil
+}
+
+// Write implements Writer. The requests of the update are logged per shard
+// and all shards send their logged requests concurrently.
+func (rw *RemoteWrite) Write(ctx context.Context, u poller.Update) error {
+	values := u.Metrics.Values()
+	series := make([][]remoteWriteSeries, len(rw.shards))
+	for id, value := range values {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		h := fnv.New32a()
+		h.Write([]byte(id))
+		shard := int(h.Sum32() % uint32(len(rw.shards)))
+		series[shard] = append(series[shard], remoteWriteSeries{remoteWriteName(id), f})
+	}
+	ts := u.Timestamp.UnixNano() / int64(time.Millisecond)
+	for shard, ss := range series {
+		sort.Slice(ss, func(i, j int) bool {
+			return ss[i].name < ss[j].name
+		})
+		for len(ss) > 0 {
+			n := len(ss)
+			if n > rw.cfg.MaxSamplesPerSend {
+				n = rw.cfg.MaxSamplesPerSend
+			}
+			if err := rw.shards[shard].push(rw.request(ss[:n], ts)); err != nil {
+				return err
+			}
+			ss = ss[n:]
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return rw.flush(ctx)
+}
+
+// Dropped returns the number of requests dropped due to full logs.
+func (rw *RemoteWrite) Dropped() int {
+	dropped := 0
+	for _, s := range rw.shards {
+		dropped += s.dropped
+	}
+	return dropped
+}
+
+// Close implements Writer. Logged requests are sent if possible, those
+// logged in a directory are kept for the next start otherwise.
+func (rw *RemoteWrite) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), rw.cfg.Timeout)
+	defer cancel()
+	return rw.flush(ctx)
+}
+
+// flush sends the logged requests of all shards concurrently and returns
+// the first error.
+func (rw *RemoteWrite) flush(ctx context.Context) error {
+	errs := make([]error, len(rw.shards))
+	var wg sync.WaitGroup
+	for i, s := range rw.shards {
+		wg.Add(1)
+		go func(i int, s *spool) {
+			defer wg.Done()
+			errs[i] = rw.flushShard(ctx, s)
+		}(i, s)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushShard sends the logged requests of one shard in order. Those
+// rejected permanently are dropped, the first rejection is returned after
+// sending the remaining requests.
+func (rw *RemoteWrite) flushShard(ctx context.Context, s *spool) error {
+	var rerr error
+	for {
+		body, ok, err := s.peek()
+		if err != nil || !ok {
+			if err == nil {
+				err = rerr
+			}
+			return err
+		}
+		permanent, err := rw.deliver(ctx, body)
+		if err != nil && !permanent {
+			return err
+		}
+		if rerr == nil {
+			rerr = err
+		}
+		if err := s.pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver posts the request and retries it with backoff. A delay requested
+// by the receiver via Retry-After is respected. It returns true if the
+// request has been rejected permanently.
+func (rw *RemoteWrite) deliver(ctx context.Context, body []byte) (bool, error) {
+	backoff := rw.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		permanent, retryAfter, err := rw.post(ctx, body)
+		if err == nil || permanent || attempt > rw.cfg.Retries {
+			return permanent, err
+		}
+		delay := backoff
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, err
+		}
+		backoff *= 2
+	}
+}
+
+// post posts the request once. It returns true if the request has been
+// rejected permanently and retrying makes no sense, and the delay requested
+// by the receiver.
+func (rw *RemoteWrite) post(ctx context.Context, body []byte) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", rw.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return true, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "sysmond")
+	switch {
+	case rw.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+rw.cfg.BearerToken)
+	case rw.cfg.Username != "":
+		req.SetBasicAuth(rw.cfg.Username, rw.cfg.Password)
+	}
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return false, 0, fmt.Errorf("cannot write to remote-write receiver: %v", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		var retryAfter time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(s) * time.Second
+		}
+		return false, retryAfter, fmt.Errorf("remote-write receiver unavailable: %s", resp.Status)
+	}
+	return true, 0, fmt.Errorf("remote-write receiver rejected request: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// request encodes the series as snappy compressed WriteRequest.
+func (rw *RemoteWrite) request(series []remoteWriteSeries, ts int64) []byte {
+	var e pbEncoder
+	for _, s := range series {
+		labels := append([][2]string{{"__name__", s.name}}, rw.labels...)
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i][0] < labels[j][0]
+		})
+		// TimeSeries with labels and one sample.
+		e.message(1, func(e *pbEncoder) {
+			for _, l := range labels {
+				e.message(1, func(e *pbEncoder) {
+					e.string(1, l[0])
+					e.string(2, l[1])
+				})
+			}
+			e.message(2, func(e *pbEncoder) {
+				e.double(1, s.value)
+				e.varint(2, uint64(ts))
+			})
+		})
+	}
+	return snappyEncode(e.bytes())
+}
+
+// remoteWriteName converts a metric ID into a valid metric name.
+func remoteWriteName(id string) string {
+	name := []byte(id)
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// EOF
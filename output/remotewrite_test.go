@@ -0,0 +1,337 @@
+// System Monitor Daemon - Output - Prometheus Remote-Write - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestRemoteWrite tests pushing samples in sharded requests.
+func TestRemoteWrite(t *testing.T) {
+	r := newRemoteWriteReceiver(t)
+	defer r.Close()
+	rw, err := output.NewRemoteWrite(output.RemoteWriteConfiguration{
+		URL:               r.URL + "/api/v1/write",
+		BearerToken:       "s3cr3t",
+		ExternalLabels:    map[string]string{"instance": "web1", "datacenter": "dc1"},
+		Shards:            2,
+		MaxSamplesPerSend: 2,
+	})
+	if err != nil {
+		t.Fatalf("cannot create remote-write writer: %v", err)
+	}
+	defer rw.Close()
+	err = rw.Write(context.Background(), newUpdate(1500000000, collector.Values{
+		"sys.cpu.0.user":      "12.5",
+		"sys.disk.root.total": "1024",
+		"sys.mem.free":        "2048",
+		"1st-app":             "1",
+		"app":                 "error: timeout",
+		"version.sysmond":     "0.1.0",
+	}))
+	if err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	expected := []string{
+		`_st_app{datacenter="dc1",instance="web1",job="sysmond"} 1 @1500000000000`,
+		`sys_cpu_0_user{datacenter="dc1",instance="web1",job="sysmond"} 12.5 @1500000000000`,
+		`sys_disk_root_total{datacenter="dc1",instance="web1",job="sysmond"} 1024 @1500000000000`,
+		`sys_mem_free{datacenter="dc1",instance="web1",job="sysmond"} 2048 @1500000000000`,
+	}
+	if samples := r.samples(); !reflect.DeepEqual(samples, expected) {
+		t.Errorf("invalid samples: %q", samples)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.requests < 2 {
+		t.Errorf("invalid number of requests: %d", r.requests)
+	}
+	if r.maxSamples > 2 {
+		t.Errorf("too many samples per request: %d", r.maxSamples)
+	}
+	if r.header.Get("Authorization") != "Bearer s3cr3t" || r.header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("invalid headers: %v", r.header)
+	}
+}
+
+// TestRemoteWriteMany tests pushing many samples, all are received once.
+func TestRemoteWriteMany(t *testing.T) {
+	r := newRemoteWriteReceiver(t)
+	defer r.Close()
+	rw, err := output.NewRemoteWrite(output.RemoteWriteConfiguration{
+		URL:            r.URL,
+		ExternalLabels: map[string]string{"instance": "web1"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create remote-write writer: %v", err)
+	}
+	defer rw.Close()
+	values := collector.Values{}
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("app.check.%04d.duration", i)
+		values[id] = fmt.Sprintf("%d", i*i)
+		expected = append(expected, fmt.Sprintf(`app_check_%04d_duration{instance="web1",job="sysmond"} %d @1000`, i, i*i))
+	}
+	if err := rw.Write(context.Background(), newUpdate(1, values)); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	if samples := r.samples(); !reflect.DeepEqual(samples, expected) {
+		t.Errorf("invalid samples: %d", len(samples))
+	}
+}
+
+// TestRemoteWriteRetry tests retrying unavailable receivers, dropping
+// rejected requests, and keeping requests in the write-ahead log.
+func TestRemoteWriteRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond-remotewrite")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := newRemoteWriteReceiver(t)
+	defer r.Close()
+	cfg := output.RemoteWriteConfiguration{
+		URL:            r.URL,
+		ExternalLabels: map[string]string{"instance": "web1"},
+		Shards:         1,
+		Retries:        2,
+		RetryBackoff:   time.Millisecond,
+		WALDir:         dir,
+	}
+	rw, err := output.NewRemoteWrite(cfg)
+	if err != nil {
+		t.Fatalf("cannot create remote-write writer: %v", err)
+	}
+
+	// Retried until available.
+	r.fail(http.StatusServiceUnavailable, 2)
+	if err := rw.Write(context.Background(), newUpdate(1, collector.Values{"a": "1"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	// Rejected and dropped.
+	r.fail(http.StatusBadRequest, 1)
+	if err := rw.Write(context.Background(), newUpdate(2, collector.Values{"a": "2"})); err == nil {
+		t.Errorf("expected rejection error")
+	}
+	// Kept in the log, also after a restart.
+	r.fail(http.StatusTooManyRequests, 3)
+	if err := rw.Write(context.Background(), newUpdate(3, collector.Values{"a": "3"})); err == nil {
+		t.Errorf("expected unavailable error")
+	}
+	rw.Close()
+	rw, err = output.NewRemoteWrite(cfg)
+	if err != nil {
+		t.Fatalf("cannot create remote-write writer again: %v", err)
+	}
+	defer rw.Close()
+	if err := rw.Write(context.Background(), newUpdate(4, collector.Values{"a": "4"})); err != nil {
+		t.Errorf("cannot write: %v", err)
+	}
+	// Rejection reported even if later requests are delivered.
+	r.fail(http.StatusServiceUnavailable, 3)
+	if err := rw.Write(context.Background(), newUpdate(5, collector.Values{"a": "5"})); err == nil {
+		t.Errorf("expected unavailable error")
+	}
+	r.fail(http.StatusBadRequest, 1)
+	if err := rw.Write(context.Background(), newUpdate(6, collector.Values{"a": "6"})); err == nil {
+		t.Errorf("expected rejection error")
+	}
+	expected := []string{
+		`a{instance="web1",job="sysmond"} 1 @1000`,
+		`a{instance="web1",job="sysmond"} 3 @3000`,
+		`a{instance="web1",job="sysmond"} 4 @4000`,
+		`a{instance="web1",job="sysmond"} 6 @6000`,
+	}
+	if samples := r.samples(); !reflect.DeepEqual(samples, expected) {
+		t.Errorf("invalid samples: %q", samples)
+	}
+}
+
+// TestRemoteWriteInvalid tests invalid configurations.
+func TestRemoteWriteInvalid(t *testing.T) {
+	for _, cfg := range []output.RemoteWriteConfiguration{
+		{URL: "udp://localhost:9090"},
+		{URL: "http://localhost:9090", ExternalLabels: map[string]string{"1a": "x"}},
+		{URL: "http://localhost:9090", ExternalLabels: map[string]string{"__name__": "x"}},
+	} {
+		if _, err := output.NewRemoteWrite(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// remoteWriteReceiver is a local remote-write receiver decoding the
+// requests.
+type remoteWriteReceiver struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	received   []string
+	header     http.Header
+	requests   int
+	maxSamples int
+	failCode   int
+	failCount  int
+}
+
+// newRemoteWriteReceiver starts a receiver.
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	r := &remoteWriteReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.header = req.Header
+		if r.failCount > 0 {
+			r.failCount--
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "failing", r.failCode)
+			return
+		}
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("invalid headers: %v", req.Header)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		samples := decodeWriteRequest(t, snappyDecode(t, body))
+		r.requests++
+		if len(samples) > r.maxSamples {
+			r.maxSamples = len(samples)
+		}
+		r.received = append(r.received, samples...)
+	}))
+	return r
+}
+
+// fail lets the next count requests fail with the status code.
+func (r *remoteWriteReceiver) fail(code, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failCode = code
+	r.failCount = count
+}
+
+// samples returns the received samples sorted.
+func (r *remoteWriteReceiver) samples() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	samples := append([]string(nil), r.received...)
+	sort.Strings(samples)
+	return samples
+}
+
+// decodeWriteRequest decodes a WriteRequest into samples formatted as
+// `name{labels} value @timestamp`.
+func decodeWriteRequest(t *testing.T, b []byte) []string {
+	var samples []string
+	for _, ts := range pbDecode(t, b)[1] {
+		fields := pbDecode(t, ts.([]byte))
+		name := ""
+		var labels []string
+		for i, l := range fields[1] {
+			lf := pbDecode(t, l.([]byte))
+			ln, lv := string(lf[1][0].([]byte)), string(lf[2][0].([]byte))
+			if i > 0 && ln < string(pbDecode(t, fields[1][i-1].([]byte))[1][0].([]byte)) {
+				t.Errorf("labels not sorted: %s", ln)
+			}
+			if ln == "__name__" {
+				name = lv
+				continue
+			}
+			labels = append(labels, fmt.Sprintf("%s=%q", ln, lv))
+		}
+		for _, s := range fields[2] {
+			sf := pbDecode(t, s.([]byte))
+			value := math.Float64frombits(sf[1][0].(uint64))
+			samples = append(samples, fmt.Sprintf("%s{%s} %v @%d", name, strings.Join(labels, ","), value, sf[2][0].(uint64)))
+		}
+	}
+	return samples
+}
+
+// snappyDecode decodes the snappy block format.
+func snappyDecode(t *testing.T, src []byte) []byte {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		t.Fatalf("invalid snappy length")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var l, offset int
+		switch tag & 3 {
+		case 0:
+			l = int(tag >> 2)
+			src = src[1:]
+			if l >= 60 {
+				extra := l - 59
+				l = 0
+				for i := 0; i < extra; i++ {
+					l |= int(src[i]) << (8 * i)
+				}
+				src = src[extra:]
+			}
+			l++
+			dst = append(dst, src[:l]...)
+			src = src[l:]
+			continue
+		case 1:
+			l = int(tag>>2&7) + 4
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			l = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			l = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			t.Fatalf("invalid snappy offset %d", offset)
+		}
+		for i := 0; i < l; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != length {
+		t.Fatalf("invalid snappy length %d, expected %d", len(dst), length)
+	}
+	return dst
+}
+
+// EOF
@@ -0,0 +1,97 @@
+// System Monitor Daemon - Output - Snappy
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"encoding/binary"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// Parameters of the snappy encoder.
+const (
+	snappyMinMatch  = 4
+	snappyMaxOffset = 1<<16 - 1
+	snappyTableBits = 14
+)
+
+//--------------------
+// SNAPPY
+//--------------------
+
+// snappyEncode compresses the data using the snappy block format. It's a
+// simple greedy encoder using only literals and copies with 2 byte offsets,
+// good enough for the repetitive label names and values of the outputs.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	var table [1 << snappyTableBits]int
+	lit := 0
+	for i := 0; i+snappyMinMatch <= len(src); {
+		key := binary.LittleEndian.Uint32(src[i:])
+		h := (key * 0x1e35a7bd) >> (32 - snappyTableBits)
+		// Positions are stored plus one, so that zero means none.
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != key {
+			i++
+			continue
+		}
+		n := snappyMinMatch
+		for i+n < len(src) && src[candidate+n] == src[i+n] {
+			n++
+		}
+		dst = snappyLiteral(dst, src[lit:i])
+		dst = snappyCopy(dst, i-candidate, n)
+		i += n
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+// snappyLiteral appends a literal element.
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends copy elements with 2 byte offsets, each copies at
+// most 64 bytes.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// EOF
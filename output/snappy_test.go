@@ -0,0 +1,149 @@
+// System Monitor Daemon - Output - Snappy - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// testLabels is a typical remote-write payload with many repetitions.
+const testLabels = `sys_mem_free{instance="web1",job="sysmond"} ` +
+	`sys_mem_total{instance="web1",job="sysmond"} ` +
+	`sys_mem_used{instance="web1",job="sysmond"}`
+
+// TestSnappyEncode tests the encoder against blocks produced by the
+// reference implementation (github.com/golang/snappy).
+func TestSnappyEncode(t *testing.T) {
+	for i, test := range []struct {
+		src     string
+		encoded string
+	}{
+		{"", "00"},
+		{"sysmond", "07187379736d6f6e64"},
+		{string(bytes.Repeat([]byte("abcd"), 40)), "a0010c61626364fe0400fe04006e0400"},
+	} {
+		encoded := hex.EncodeToString(snappyEncode([]byte(test.src)))
+		if encoded != test.encoded {
+			t.Errorf("%d: invalid block:\n%s\nexpected:\n%s", i, encoded, test.encoded)
+		}
+	}
+}
+
+// TestSnappyRoundTrip tests that the blocks are decoded to the source
+// again. The decoder is checked with a block of the reference
+// implementation first, as it uses copies the encoder doesn't produce.
+func TestSnappyRoundTrip(t *testing.T) {
+	reference, _ := hex.DecodeString("8401b07379735f6d656d5f667265657b696e7374616e63653d2277656231222c6a6f623d22" +
+		"7379736d6f6e64227d20730d2c10746f74616c9e2d000c757365647a2c00")
+	decoded, err := snappyDecode(reference)
+	if err != nil || string(decoded) != testLabels {
+		t.Fatalf("invalid decoding of reference block: %q (%v)", decoded, err)
+	}
+	for i, src := range []string{
+		"",
+		"sysmond",
+		testLabels,
+		string(bytes.Repeat([]byte("abcd"), 40)),
+		string(bytes.Repeat([]byte(testLabels), 2000)),
+	} {
+		decoded, err := snappyDecode(snappyEncode([]byte(src)))
+		if err != nil {
+			t.Errorf("%d: cannot decode: %v", i, err)
+		} else if string(decoded) != src {
+			t.Errorf("%d: invalid round trip: %q", i, decoded)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// snappyDecode decodes a snappy block following the format description,
+// independent of the encoder.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, l := binary.Uvarint(src)
+	if l <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[l:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			if length >= 60 {
+				size := length - 59
+				if len(src) < size {
+					return nil, errors.New("truncated literal length")
+				}
+				length = 0
+				for i := size - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[size:]
+			}
+			length++
+			if len(src) < length {
+				return nil, errors.New("truncated literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 1 {
+				return nil, errors.New("truncated copy")
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[0])
+			src = src[1:]
+		case 2:
+			if len(src) < 2 {
+				return nil, errors.New("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+		case 3:
+			if len(src) < 4 {
+				return nil, errors.New("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src))
+			src = src[4:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, errors.New("invalid copy offset")
+		}
+		// Byte by byte, copies may overlap.
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errors.New("invalid decoded length")
+	}
+	return dst, nil
+}
+
+// EOF
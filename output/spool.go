@@ -0,0 +1,141 @@
+// System Monitor Daemon - Output - Spool
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// spoolSuffix is the file name suffix of spooled batches.
+const spoolSuffix = ".spool"
+
+//--------------------
+// SPOOL
+//--------------------
+
+// spool buffers batches which couldn't be delivered. With a directory
+// each batch is stored in an own file, so that they survive restarts,
+// otherwise they are kept in memory. At most max batches are kept, on
+// overflow the oldest ones are dropped.
+type spool struct {
+	dir     string
+	max     int
+	seq     int
+	batches [][]byte
+	dropped int
+}
+
+// newSpool creates a spool in the directory, which is created if needed.
+// An empty directory keeps the batches in memory.
+func newSpool(dir string, max int) (*spool, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create spool directory: %v", err)
+		}
+	}
+	return &spool{
+		dir: dir,
+		max: max,
+	}, nil
+}
+
+// push adds a batch to the spool.
+func (s *spool) push(batch []byte) error {
+	if s.dir == "" {
+		s.batches = append(s.batches, batch)
+		if over := len(s.batches) - s.max; over > 0 {
+			s.batches = append(s.batches[:0], s.batches[over:]...)
+			s.dropped += over
+		}
+		return nil
+	}
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, spoolSuffix)
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), batch, 0600); err != nil {
+		return fmt.Errorf("cannot spool batch: %v", err)
+	}
+	names, err := s.names()
+	if err != nil {
+		return err
+	}
+	for over := len(names) - s.max; over > 0; over-- {
+		os.Remove(filepath.Join(s.dir, names[0]))
+		names = names[1:]
+		s.dropped++
+	}
+	return nil
+}
+
+// peek returns the oldest batch. If the spool is empty false is returned.
+func (s *spool) peek() ([]byte, bool, error) {
+	if s.dir == "" {
+		if len(s.batches) == 0 {
+			return nil, false, nil
+		}
+		return s.batches[0], true, nil
+	}
+	names, err := s.names()
+	if err != nil || len(names) == 0 {
+		return nil, false, err
+	}
+	batch, err := ioutil.ReadFile(filepath.Join(s.dir, names[0]))
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot read spooled batch: %v", err)
+	}
+	return batch, true, nil
+}
+
+// pop removes the oldest batch.
+func (s *spool) pop() error {
+	if s.dir == "" {
+		if len(s.batches) > 0 {
+			s.batches = s.batches[1:]
+		}
+		return nil
+	}
+	names, err := s.names()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil {
+		return fmt.Errorf("cannot remove spooled batch: %v", err)
+	}
+	return nil
+}
+
+// names returns the sorted file names of the spooled batches.
+func (s *spool) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read spool directory: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), spoolSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// EOF
@@ -0,0 +1,224 @@
+// System Monitor Daemon - Output - StatsD
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// STATSD
+//--------------------
+
+// StatsDConfiguration contains the configuration of a StatsD output. Network
+// is "udp" or "unixgram", the address the one of the StatsD daemon. Values
+// with IDs matching one of the counter patterns, e.g. "*.retrievals", are
+// sent as counters, all others as gauges. The tags are sent in DogStatsD
+// format. Each value is sent with the probability of the sample rate, 0
+// means 1. The packets are at most MaxPacketSize bytes large.
+type StatsDConfiguration struct {
+	Network       string
+	Address       string
+	Prefix        string
+	Counters      []string
+	Tags          map[string]string
+	SampleRate    float64
+	MaxPacketSize int
+}
+
+// StatsD sends the numeric values of the metrics to a StatsD daemon.
+// Counters are sent as deltas since the previous poll. As usual for
+// StatsD nothing is buffered.
+type StatsD struct {
+	network  string
+	address  string
+	prefix   string
+	counters []string
+	tags     string
+	rate     float64
+	size     int
+	conn     net.Conn
+	previous map[string]float64
+}
+
+// NewStatsD creates a StatsD writer. The connection is established with
+// the first packet and reestablished after errors.
+func NewStatsD(cfg StatsDConfiguration) (*StatsD, error) {
+	s := &StatsD{
+		address:  cfg.Address,
+		prefix:   cfg.Prefix,
+		counters: cfg.Counters,
+		rate:     cfg.SampleRate,
+		size:     cfg.MaxPacketSize,
+		previous: make(map[string]float64),
+	}
+	for _, pattern := range s.counters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid StatsD counter pattern %q: %v", pattern, err)
+		}
+	}
+	if s.rate < 0 || s.rate > 1 {
+		return nil, fmt.Errorf("invalid StatsD sample rate %v", s.rate)
+	}
+	if s.rate == 0 {
+		s.rate = 1
+	}
+	switch cfg.Network {
+	case "", "udp":
+		s.network = "udp"
+		if s.size <= 0 {
+			s.size = 1432
+		}
+	case "unixgram":
+		s.network = cfg.Network
+		if s.size <= 0 {
+			s.size = 8192
+		}
+	default:
+		return nil, fmt.Errorf("invalid StatsD network %q", cfg.Network)
+	}
+	if len(cfg.Tags) > 0 {
+		keys := make([]string, 0, len(cfg.Tags))
+		for k := range cfg.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		tags := make([]string, len(keys))
+		for i, k := range keys {
+			tags[i] = statsdEscape(k) + ":" + statsdEscape(cfg.Tags[k])
+		}
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+// Write implements Writer.
+func (s *StatsD) Write(ctx context.Context, u poller.Update) error {
+	values := u.Metrics.Values()
+	ids := make([]string, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	sampling := ""
+	if s.rate < 1 {
+		sampling = "|@" + strconv.FormatFloat(s.rate, 'f', -1, 64)
+	}
+	var lines []string
+	current := make(map[string]float64)
+	for _, id := range ids {
+		f, err := strconv.ParseFloat(values[id], 64)
+		if err != nil {
+			continue
+		}
+		value, kind := values[id], "g"
+		if s.counter(id) {
+			current[id] = f
+			previous, ok := s.previous[id]
+			if !ok || f < previous {
+				// No baseline yet or counter reset.
+				continue
+			}
+			value, kind = strconv.FormatFloat(f-previous, 'f', -1, 64), "c"
+		}
+		if s.rate < 1 && rand.Float64() >= s.rate {
+			continue
+		}
+		lines = append(lines, statsdEscape(s.prefix+id)+":"+value+"|"+kind+sampling+s.tags)
+	}
+	s.previous = current
+	return s.send(ctx, lines)
+}
+
+// Close implements Writer.
+func (s *StatsD) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// counter checks if the ID is the one of a counter.
+func (s *StatsD) counter(id string) bool {
+	for _, pattern := range s.counters {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// send sends the lines in packets not larger than the maximum size.
+// Single larger lines are sent in own packets. In case of errors the
+// remaining packets are dropped.
+func (s *StatsD) send(ctx context.Context, lines []string) error {
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > s.size {
+			if err := s.write(ctx, packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	return s.write(ctx, packet)
+}
+
+// write writes one packet. In case of errors the connection is closed,
+// so that the next packet reconnects.
+func (s *StatsD) write(ctx context.Context, packet []byte) error {
+	if s.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, s.network, s.address)
+		if err != nil {
+			return fmt.Errorf("cannot connect to StatsD: %v", err)
+		}
+		s.conn = conn
+	}
+	if _, err := s.conn.Write(packet); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("cannot write to StatsD: %v", err)
+	}
+	return nil
+}
+
+// statsdEscape replaces characters reserved by the StatsD protocol.
+func statsdEscape(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// EOF
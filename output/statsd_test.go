@@ -0,0 +1,209 @@
+// System Monitor Daemon - Output - StatsD - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestStatsD tests sending gauges and counter deltas with tags.
+func TestStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewStatsD(output.StatsDConfiguration{
+		Address:  pc.LocalAddr().String(),
+		Prefix:   "sysmond.",
+		Counters: []string{"*.retrievals"},
+		Tags:     map[string]string{"host": "web1", "dc": "ber"},
+	})
+	if err != nil {
+		t.Fatalf("cannot create StatsD writer: %v", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Write(ctx, newUpdate(1, collector.Values{"sys.mem.free": "1024", "a.retrievals": "10", "b": "error: timeout"}))
+	expected := []string{"sysmond.sys.mem.free:1024|g|#dc:ber,host:web1"}
+	if lines := readDatagram(t, pc); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("invalid lines: %q", lines)
+	}
+
+	s.Write(ctx, newUpdate(2, collector.Values{"sys.mem.free": "512", "a.retrievals": "15"}))
+	expected = []string{
+		"sysmond.a.retrievals:5|c|#dc:ber,host:web1",
+		"sysmond.sys.mem.free:512|g|#dc:ber,host:web1",
+	}
+	if lines := readDatagram(t, pc); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("invalid lines: %q", lines)
+	}
+}
+
+// TestStatsDPackets tests splitting the lines into packets via a Unix
+// datagram socket.
+func TestStatsDPackets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "statsd.sock")
+	pc, err := net.ListenPacket("unixgram", addr)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewStatsD(output.StatsDConfiguration{
+		Network:       "unixgram",
+		Address:       addr,
+		MaxPacketSize: 20,
+	})
+	if err != nil {
+		t.Fatalf("cannot create StatsD writer: %v", err)
+	}
+	defer s.Close()
+	s.Write(context.Background(), newUpdate(1, collector.Values{"a": "1", "b": "2", "c": "3", "long.value.id": "4"}))
+	for _, expected := range [][]string{{"a:1|g", "b:2|g", "c:3|g"}, {"long.value.id:4|g"}} {
+		if lines := readDatagram(t, pc); !reflect.DeepEqual(lines, expected) {
+			t.Errorf("invalid lines: %q", lines)
+		}
+	}
+}
+
+// TestStatsDReconnect tests connecting to a StatsD daemon started after
+// the writer and reconnecting after its restart.
+func TestStatsDReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "statsd.sock")
+	s, err := output.NewStatsD(output.StatsDConfiguration{
+		Network: "unixgram",
+		Address: addr,
+	})
+	if err != nil {
+		t.Fatalf("cannot create StatsD writer without daemon: %v", err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	u := newUpdate(1, collector.Values{"a": "1"})
+	if err := s.Write(ctx, u); err == nil {
+		t.Errorf("expected error without daemon")
+	}
+
+	for i := 0; i < 2; i++ {
+		pc, err := net.ListenPacket("unixgram", addr)
+		if err != nil {
+			t.Fatalf("cannot listen: %v", err)
+		}
+		// The first write after a restart fails on the old connection.
+		if err := s.Write(ctx, u); err != nil {
+			if err := s.Write(ctx, u); err != nil {
+				t.Errorf("%d: cannot write: %v", i, err)
+			}
+		}
+		if lines := readDatagram(t, pc); !reflect.DeepEqual(lines, []string{"a:1|g"}) {
+			t.Errorf("%d: invalid lines: %q", i, lines)
+		}
+		pc.Close()
+		os.Remove(addr)
+	}
+}
+
+// TestStatsDSampling tests sending only a sample of the values.
+func TestStatsDSampling(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewStatsD(output.StatsDConfiguration{
+		Address:    pc.LocalAddr().String(),
+		SampleRate: 0.5,
+	})
+	if err != nil {
+		t.Fatalf("cannot create StatsD writer: %v", err)
+	}
+	defer s.Close()
+	values := collector.Values{}
+	for i := 0; i < 200; i++ {
+		values[fmt.Sprintf("v%03d", i)] = "1"
+	}
+	s.Write(context.Background(), newUpdate(1, values))
+	var lines []string
+	for {
+		l := readDatagram(t, pc)
+		if l == nil {
+			break
+		}
+		lines = append(lines, l...)
+	}
+	if len(lines) < 50 || len(lines) > 150 {
+		t.Errorf("invalid number of sampled lines: %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasSuffix(line, "|g|@0.5") {
+			t.Errorf("invalid line: %q", line)
+		}
+	}
+}
+
+// TestStatsDInvalid tests invalid configurations.
+func TestStatsDInvalid(t *testing.T) {
+	for _, cfg := range []output.StatsDConfiguration{
+		{Network: "tcp", Address: "127.0.0.1:8125"},
+		{Address: "127.0.0.1:8125", SampleRate: 2},
+		{Address: "127.0.0.1:8125", Counters: []string{"["}},
+	} {
+		if _, err := output.NewStatsD(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// readDatagram reads one datagram and returns its lines. After a
+// timeout nil is returned.
+func readDatagram(t *testing.T, pc net.PacketConn) []string {
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+// EOF
@@ -0,0 +1,252 @@
+// System Monitor Daemon - Output - Syslog
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// syslogSDID is the ID of the structured data element of the events. The
+// number is the private enterprise number reserved for documentation.
+const syslogSDID = "sysmond@32473"
+
+// syslogFacilities maps the names of the facilities to their codes.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+//--------------------
+// SYSLOG
+//--------------------
+
+// SyslogConfiguration contains the configuration of a syslog output.
+// Network is "udp", "tcp", "unixgram", or "unix", it defaults to
+// "unixgram" with the address "/dev/log". The facility defaults to
+// "daemon", the application name to "sysmond", and the host to the host
+// name. At most BufferSize events are buffered while the syslog daemon
+// isn't reachable, then the oldest ones are dropped. The alerts define
+// the thresholds of the alert events.
+type SyslogConfiguration struct {
+	Network    string
+	Address    string
+	Facility   string
+	AppName    string
+	Host       string
+	BufferSize int
+	Timeout    time.Duration
+	Alerts     []Alert
+}
+
+// Syslog sends the meter point errors and their recoveries as well as the
+// alert state changes as events in the RFC 5424 format. Metric ID, value,
+// state, and severity are passed as structured data. TCP connections use
+// octet counting framing, Unix stream sockets newline terminated framing
+// as expected by the local syslog daemons.
+type Syslog struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	host     string
+	size     int
+	timeout  time.Duration
+	tracker  eventTracker
+	conn     net.Conn
+	events   []event
+	dropped  int
+}
+
+// NewSyslog creates a syslog writer. The connection is established with
+// the first event and reestablished after errors.
+func NewSyslog(cfg SyslogConfiguration) (*Syslog, error) {
+	s := &Syslog{
+		network: cfg.Network,
+		address: cfg.Address,
+		appName: cfg.AppName,
+		host:    cfg.Host,
+		size:    cfg.BufferSize,
+		timeout: cfg.Timeout,
+		tracker: eventTracker{alerts: cfg.Alerts},
+	}
+	if err := validateAlerts(cfg.Alerts); err != nil {
+		return nil, err
+	}
+	switch s.network {
+	case "":
+		s.network = "unixgram"
+		if s.address == "" {
+			s.address = "/dev/log"
+		}
+	case "udp", "tcp", "unixgram", "unix":
+	default:
+		return nil, fmt.Errorf("invalid syslog network %q", cfg.Network)
+	}
+	if s.address == "" {
+		return nil, fmt.Errorf("missing syslog address")
+	}
+	facility := cfg.Facility
+	if facility == "" {
+		facility = "daemon"
+	}
+	var ok bool
+	if s.facility, ok = syslogFacilities[facility]; !ok {
+		return nil, fmt.Errorf("invalid syslog facility %q", cfg.Facility)
+	}
+	if s.appName == "" {
+		s.appName = "sysmond"
+	}
+	if s.host == "" {
+		var err error
+		if s.host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("cannot get host name: %v", err)
+		}
+	}
+	if s.size <= 0 {
+		s.size = 1000
+	}
+	if s.timeout <= 0 {
+		s.timeout = 5 * time.Second
+	}
+	return s, nil
+}
+
+// Write implements Writer. The events of the update are buffered and sent.
+func (s *Syslog) Write(ctx context.Context, u poller.Update) error {
+	s.events = append(s.events, s.tracker.track(u)...)
+	if over := len(s.events) - s.size; over > 0 {
+		s.events = append(s.events[:0], s.events[over:]...)
+		s.dropped += over
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.flush(ctx)
+}
+
+// Dropped returns the number of events dropped due to a full buffer.
+func (s *Syslog) Dropped() int {
+	return s.dropped
+}
+
+// Close implements Writer.
+func (s *Syslog) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	err := s.flush(ctx)
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// flush sends the buffered events. In case of errors the connection is
+// closed and the unsent events stay in the buffer.
+func (s *Syslog) flush(ctx context.Context) error {
+	for len(s.events) > 0 {
+		if s.conn == nil {
+			d := net.Dialer{Timeout: s.timeout}
+			conn, err := d.DialContext(ctx, s.network, s.address)
+			if err != nil {
+				return fmt.Errorf("cannot connect to syslog: %v", err)
+			}
+			s.conn = conn
+		}
+		msg := s.format(s.events[0])
+		switch s.network {
+		case "tcp":
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		case "unix":
+			msg = strings.ReplaceAll(msg, "\n", " ") + "\n"
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return fmt.Errorf("cannot write to syslog: %v", err)
+		}
+		s.events = s.events[1:]
+	}
+	return nil
+}
+
+// format formats the event as RFC 5424 message.
+func (s *Syslog) format(e event) string {
+	pri := s.facility*8 + e.severity
+	ts := e.timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	var msgID string
+	switch e.state {
+	case stateError:
+		msgID = "error"
+	case stateRecovered:
+		msgID = "recovery"
+	default:
+		msgID = "alert"
+	}
+	sd := "[" + syslogSDID +
+		` id="` + syslogEscape(e.id) +
+		`" value="` + syslogEscape(e.value) +
+		`" state="` + e.state +
+		`" severity="` + severityNames[e.severity] + `"]`
+	host, appName := syslogHeader(s.host), syslogHeader(s.appName)
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		pri, ts, host, appName, os.Getpid(), msgID, sd, e.message())
+}
+
+// syslogEscape escapes the characters not allowed in parameter values of
+// structured data.
+func syslogEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+// syslogHeader replaces the characters not allowed in header fields.
+func syslogHeader(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// EOF
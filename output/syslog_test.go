@@ -0,0 +1,305 @@
+// System Monitor Daemon - Output - Syslog - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package output_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestSyslogUDP tests sending error and recovery events via UDP.
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewSyslog(output.SyslogConfiguration{
+		Network:  "udp",
+		Address:  pc.LocalAddr().String(),
+		Facility: "local0",
+		Host:     "web1",
+	})
+	if err != nil {
+		t.Fatalf("cannot create syslog writer: %v", err)
+	}
+	defer s.Close()
+	ts := time.Date(2018, 10, 19, 12, 0, 0, 0, time.UTC)
+	writeEvents(t, s, ts)
+
+	pid := os.Getpid()
+	expected := []string{
+		fmt.Sprintf(`<131>1 2018-10-19T12:00:00.000000Z web1 sysmond %d error [sysmond@32473 id="app.all" value="error: exit \"1\" \]" state="error" severity="err"] metric app.all failed: error: exit "1" ]`, pid),
+		fmt.Sprintf(`<131>1 2018-10-19T12:00:00.000000Z web1 sysmond %d error [sysmond@32473 id="sys.disk.root" value="error: timeout" state="error" severity="err"] metric sys.disk.root failed: error: timeout`, pid),
+		fmt.Sprintf(`<133>1 2018-10-19T12:00:10.000000Z web1 sysmond %d recovery [sysmond@32473 id="app.all" value="" state="recovered" severity="notice"] metric app.all recovered`, pid),
+		fmt.Sprintf(`<133>1 2018-10-19T12:00:10.000000Z web1 sysmond %d recovery [sysmond@32473 id="sys.disk.root" value="42" state="recovered" severity="notice"] metric sys.disk.root recovered`, pid),
+	}
+	for i, exp := range expected {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("cannot read message %d: %v", i, err)
+		}
+		if msg := string(buf[:n]); msg != exp {
+			t.Errorf("invalid message %d:\n%s\nexpected:\n%s", i, msg, exp)
+		}
+	}
+}
+
+// TestSyslogTCP tests octet counting framing and buffering while the
+// syslog daemon isn't reachable.
+func TestSyslogTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s, err := output.NewSyslog(output.SyslogConfiguration{
+		Network: "tcp",
+		Address: addr,
+	})
+	if err != nil {
+		t.Fatalf("cannot create syslog writer: %v", err)
+	}
+	defer s.Close()
+	ts := time.Unix(1500000000, 0)
+	if err := s.Write(context.Background(), newUpdate(ts.Unix(), collector.Values{"a": "error: down"})); err == nil {
+		t.Fatalf("expected write error")
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("cannot listen again: %v", err)
+	}
+	defer ln.Close()
+	if err := s.Write(context.Background(), newUpdate(ts.Unix()+10, collector.Values{"a": "1"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("cannot accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, state := range []string{"error", "recovered"} {
+		msg := readFramed(t, r)
+		if !strings.HasPrefix(msg, "<") || !strings.Contains(msg, ` id="a" `) || !strings.Contains(msg, `state="`+state+`"`) {
+			t.Errorf("invalid %s message: %s", state, msg)
+		}
+	}
+}
+
+// TestSyslogUnix tests sending via a Unix datagram socket.
+func TestSyslogUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond-syslog")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "log")
+	pc, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewSyslog(output.SyslogConfiguration{
+		Network: "unixgram",
+		Address: socket,
+		AppName: "monitor",
+	})
+	if err != nil {
+		t.Fatalf("cannot create syslog writer: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(context.Background(), newUpdate(1500000000, collector.Values{"a": "error: down"})); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("cannot read: %v", err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<27>1 ") || !strings.Contains(msg, " monitor ") {
+		t.Errorf("invalid message: %s", msg)
+	}
+}
+
+// TestSyslogUnixStream tests newline terminated framing via a Unix
+// stream socket.
+func TestSyslogUnixStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond-syslog")
+	if err != nil {
+		t.Fatalf("cannot create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "log")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer ln.Close()
+	s, err := output.NewSyslog(output.SyslogConfiguration{
+		Network: "unix",
+		Address: socket,
+	})
+	if err != nil {
+		t.Fatalf("cannot create syslog writer: %v", err)
+	}
+	defer s.Close()
+	values := collector.Values{"a": "error: down\nreally", "b": "error: gone"}
+	if err := s.Write(context.Background(), newUpdate(1500000000, values)); err != nil {
+		t.Fatalf("cannot write: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("cannot accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, id := range []string{"a", "b"} {
+		msg, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("cannot read: %v", err)
+		}
+		if !strings.HasPrefix(msg, "<27>1 ") || !strings.Contains(msg, ` id="`+id+`" `) {
+			t.Errorf("invalid message: %q", msg)
+		}
+	}
+}
+
+// TestSyslogAlerts tests sending alert state changes.
+func TestSyslogAlerts(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer pc.Close()
+	s, err := output.NewSyslog(output.SyslogConfiguration{
+		Network: "udp",
+		Address: pc.LocalAddr().String(),
+		Host:    "web1",
+		Alerts: []output.Alert{
+			{Pattern: "sys.disk.*.percent", Warning: 80, Critical: 90},
+			{Pattern: "sys.mem.free", Critical: 100, Below: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create syslog writer: %v", err)
+	}
+	defer s.Close()
+	ts := time.Date(2018, 10, 19, 12, 0, 0, 0, time.UTC)
+	updates := []collector.Values{
+		{"sys.disk.root.percent": "50", "sys.mem.free": "500", "sys.mem.total": "1000"},
+		{"sys.disk.root.percent": "85", "sys.mem.free": "50", "sys.mem.total": "1000"},
+		{"sys.disk.root.percent": "95", "sys.mem.free": "40", "sys.mem.total": "1000"},
+		{"sys.disk.root.percent": "60", "sys.mem.free": "error: timeout", "sys.mem.total": "1000"},
+	}
+	for i, values := range updates {
+		if err := s.Write(context.Background(), newUpdate(ts.Unix()+int64(i*5), values)); err != nil {
+			t.Fatalf("cannot write update %d: %v", i, err)
+		}
+	}
+
+	pid := os.Getpid()
+	expected := []string{
+		fmt.Sprintf(`<28>1 2018-10-19T12:00:05.000000Z web1 sysmond %d alert [sysmond@32473 id="sys.disk.root.percent" value="85" state="warning" severity="warning"] metric sys.disk.root.percent alert warning: 85`, pid),
+		fmt.Sprintf(`<26>1 2018-10-19T12:00:05.000000Z web1 sysmond %d alert [sysmond@32473 id="sys.mem.free" value="50" state="critical" severity="crit"] metric sys.mem.free alert critical: 50`, pid),
+		fmt.Sprintf(`<26>1 2018-10-19T12:00:10.000000Z web1 sysmond %d alert [sysmond@32473 id="sys.disk.root.percent" value="95" state="critical" severity="crit"] metric sys.disk.root.percent alert critical: 95`, pid),
+		fmt.Sprintf(`<29>1 2018-10-19T12:00:15.000000Z web1 sysmond %d alert [sysmond@32473 id="sys.disk.root.percent" value="60" state="ok" severity="notice"] metric sys.disk.root.percent alert ok: 60`, pid),
+		fmt.Sprintf(`<27>1 2018-10-19T12:00:15.000000Z web1 sysmond %d error [sysmond@32473 id="sys.mem.free" value="error: timeout" state="error" severity="err"] metric sys.mem.free failed: error: timeout`, pid),
+	}
+	for i, exp := range expected {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("cannot read message %d: %v", i, err)
+		}
+		if msg := string(buf[:n]); msg != exp {
+			t.Errorf("invalid message %d:\n%s\nexpected:\n%s", i, msg, exp)
+		}
+	}
+}
+
+// TestSyslogInvalid tests invalid configurations.
+func TestSyslogInvalid(t *testing.T) {
+	for _, cfg := range []output.SyslogConfiguration{
+		{Network: "http", Address: "localhost:514"},
+		{Network: "udp"},
+		{Network: "udp", Address: "localhost:514", Facility: "none"},
+		{Network: "udp", Address: "localhost:514", Alerts: []output.Alert{{Pattern: "[", Warning: 1}}},
+		{Network: "udp", Address: "localhost:514", Alerts: []output.Alert{{Pattern: "sys.mem.free"}}},
+	} {
+		if _, err := output.NewSyslog(cfg); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// writeEvents writes an update with two errors and one where both recover,
+// one by returning a value again, one by being gone.
+func writeEvents(t *testing.T, w output.Writer, ts time.Time) {
+	updates := []collector.Values{
+		{"app.all": `error: exit "1" ]`, "sys.disk.root": "error: timeout", "sys.mem.free": "1"},
+		{"app.all": `error: exit "2"`, "sys.disk.root": "error: timeout", "sys.mem.free": "2"},
+		{"app.ok": "1", "sys.disk.root": "42", "sys.mem.free": "3"},
+	}
+	for i, values := range updates {
+		if err := w.Write(context.Background(), newUpdate(ts.Unix()+int64(i*5), values)); err != nil {
+			t.Fatalf("cannot write update %d: %v", i, err)
+		}
+	}
+}
+
+// readFramed reads a message with octet counting framing.
+func readFramed(t *testing.T, r *bufio.Reader) string {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		t.Fatalf("cannot read length: %v", err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		t.Fatalf("invalid length %q", length)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		t.Fatalf("cannot read message: %v", err)
+	}
+	return string(msg)
+}
+
+// EOF
@@ -13,6 +13,10 @@ package poller
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/themue/sysmond/collector"
@@ -22,27 +26,86 @@ import (
 // POLLER
 //--------------------
 
+// Update contains the metrics of one poll together with its timestamp.
+type Update struct {
+	Timestamp time.Time
+	Metrics   *collector.Metrics
+}
+
+// Subscription delivers the updates of a poller after each poll. A slow
+// subscriber never blocks the poller, it only misses intermediate updates
+// and always gets the latest one.
+type Subscription struct {
+	poller  *Poller
+	updateC chan Update
+}
+
+// Updates returns the channel delivering the updates. It will be closed
+// after unsubscribing or when the poller stops.
+func (s *Subscription) Updates() <-chan Update {
+	return s.updateC
+}
+
+// Unsubscribe ends the subscription.
+func (s *Subscription) Unsubscribe() {
+	s.poller.do(func() {
+		if _, ok := s.poller.subscriptions[s]; ok {
+			delete(s.poller.subscriptions, s)
+			close(s.updateC)
+		}
+	})
+}
+
+// deliver passes the update to the subscriber. In case the previous update
+// hasn't been received yet it will be replaced.
+func (s *Subscription) deliver(u Update) {
+	select {
+	case <-s.updateC:
+	default:
+	}
+	s.updateC <- u
+}
+
+// collection is an on-demand collection which may be shared by multiple
+// concurrent callers.
+type collection struct {
+	doneC  chan struct{}
+	update Update
+}
+
 // Poller retrieves system informations via the collector in configurable intervals.
-// Stopping is done by the passed context. For serialisation of all accesses the
-// backend goroutine works as actor and uses no mutex.
+// The first retrieval is done immediately when starting. Stopping is done by the
+// passed context. For serialisation of all accesses the
+// backend goroutine works as actor and uses no mutex. Only the readiness,
+// the running state, and the liveness timestamp are atomic, so that they
+// can be checked without waiting for the actor.
 type Poller struct {
-	ctx       context.Context
-	collector *collector.Collector
-	interval  time.Duration
-	actionC   chan func()
-	timestamp time.Time
-	metrics   *collector.Metrics
+	ctx           context.Context
+	collector     *collector.Collector
+	interval      time.Duration
+	actionC       chan func()
+	timestamp     time.Time
+	metrics       *collector.Metrics
+	subscriptions map[*Subscription]struct{}
+	collections   map[string]*collection
+	ready         atomic.Bool
+	running       atomic.Bool
+	alive         atomic.Int64
 }
 
 // New creates a new poller instance.
 func New(ctx context.Context, c *collector.Collector, i time.Duration) *Poller {
 	p := &Poller{
-		ctx:       ctx,
-		collector: c,
-		interval:  i,
-		actionC:   make(chan func()),
-		timestamp: time.Now(),
+		ctx:           ctx,
+		collector:     c,
+		interval:      i,
+		actionC:       make(chan func()),
+		timestamp:     time.Now(),
+		subscriptions: make(map[*Subscription]struct{}),
+		collections:   make(map[string]*collection),
 	}
+	p.running.Store(true)
+	p.alive.Store(time.Now().UnixNano())
 	go p.backend()
 	return p
 }
@@ -55,6 +118,35 @@ func (p *Poller) SetCollector(c *collector.Collector) {
 	})
 }
 
+// Ready returns true if the first metrics have been retrieved.
+func (p *Poller) Ready() bool {
+	return p.ready.Load()
+}
+
+// Running returns true as long as the poller hasn't been stopped.
+func (p *Poller) Running() bool {
+	return p.ctx.Err() == nil && p.running.Load()
+}
+
+// Alive returns the time the backend has been responsive the last time. It
+// is updated at least once per interval.
+func (p *Poller) Alive() time.Time {
+	return time.Unix(0, p.alive.Load())
+}
+
+// Interval returns the poll interval.
+func (p *Poller) Interval() time.Duration {
+	return p.interval
+}
+
+// MeterPoints returns the IDs of the meter points of the collector.
+func (p *Poller) MeterPoints() (ids []string) {
+	p.do(func() {
+		ids = p.collector.List()
+	})
+	return
+}
+
 // Metrics retrieves the latest metrics and the according timestamp.
 func (p *Poller) Metrics() (ts time.Time, m *collector.Metrics) {
 	p.do(func() {
@@ -64,21 +156,121 @@ func (p *Poller) Metrics() (ts time.Time, m *collector.Metrics) {
 	return
 }
 
+// Collect immediately retrieves the metrics of the passed meter point IDs, or
+// of all when none are passed. The timeout limits the retrieval of each meter
+// point. Concurrent calls for the same IDs share one retrieval, which uses the
+// timeout of the first call. A complete collection also becomes the latest
+// metrics of the poller and is delivered to the subscribers. The context only
+// ends the waiting of the caller.
+func (p *Poller) Collect(ctx context.Context, timeout time.Duration, ids ...string) (Update, error) {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+	var col *collection
+	if !p.do(func() {
+		col = p.collections[key]
+		if col == nil {
+			col = &collection{
+				doneC: make(chan struct{}),
+			}
+			p.collections[key] = col
+			go p.collect(col, key, p.collector, timeout, ids)
+		}
+	}) {
+		return Update{}, errors.New("poller stopped")
+	}
+	select {
+	case <-ctx.Done():
+		return Update{}, ctx.Err()
+	case <-col.doneC:
+		return col.update, nil
+	}
+}
+
+// Subscribe returns a new subscription for the updates of the poller. In case
+// the poller is already stopped the updates channel is closed.
+func (p *Poller) Subscribe() *Subscription {
+	s := &Subscription{
+		poller:  p,
+		updateC: make(chan Update, 1),
+	}
+	if !p.do(func() {
+		p.subscriptions[s] = struct{}{}
+	}) {
+		close(s.updateC)
+	}
+	return s
+}
+
 // do lets the actor perform an action in the backend. The wait channel ensures that
-// it is performed to avoid race conditions.
-func (p *Poller) do(action func()) {
+// it is performed to avoid race conditions. If the poller is stopped the action
+// will not be performed and false is returned.
+func (p *Poller) do(action func()) bool {
 	waitC := make(chan struct{})
-	p.actionC <- func() {
+	select {
+	case <-p.ctx.Done():
+		return false
+	case p.actionC <- func() {
 		action()
 		close(waitC)
+	}:
 	}
 	<-waitC
+	return true
+}
+
+// collect performs an on-demand collection and passes the result to the
+// backend.
+func (p *Poller) collect(col *collection, key string, c *collector.Collector, timeout time.Duration, ids []string) {
+	defer close(col.doneC)
+	col.update = Update{
+		Timestamp: time.Now(),
+		Metrics:   c.Retrieve(p.ctx, timeout, ids...),
+	}
+	p.do(func() {
+		delete(p.collections, key)
+		if len(ids) == 0 && col.update.Timestamp.After(p.timestamp) {
+			p.update(col.update)
+		}
+	})
+}
+
+// update sets the latest metrics and delivers them to the subscribers.
+func (p *Poller) update(u Update) {
+	p.timestamp = u.Timestamp
+	p.metrics = u.Metrics
+	p.ready.Store(true)
+	for s := range p.subscriptions {
+		s.deliver(u)
+	}
+}
+
+// poll starts a complete collection in background like an on-demand
+// collection, so that the poller is responsive in the meantime. If one is
+// already running, e.g. the initial one or an on-demand one, it is joined
+// instead of overlapping with it.
+func (p *Poller) poll() {
+	if _, ok := p.collections[""]; ok {
+		return
+	}
+	col := &collection{
+		doneC: make(chan struct{}),
+	}
+	p.collections[""] = col
+	go p.collect(col, "", p.collector, p.interval, nil)
 }
 
 // backend runs the poller goroutine and calls the collector in intervals.
 func (p *Poller) backend() {
 	ticker := time.NewTicker(p.interval)
 	defer ticker.Stop()
+	defer p.running.Store(false)
+	defer func() {
+		for s := range p.subscriptions {
+			close(s.updateC)
+		}
+	}()
+	p.poll()
 	for {
 		select {
 		case <-p.ctx.Done():
@@ -86,9 +278,9 @@ func (p *Poller) backend() {
 		case action := <-p.actionC:
 			action()
 		case <-ticker.C:
-			p.timestamp = time.Now()
-			p.metrics = p.collector.Retrieve(p.ctx, p.interval)
+			p.poll()
 		}
+		p.alive.Store(time.Now().UnixNano())
 	}
 }
 
@@ -30,7 +30,7 @@ import (
 func TestPoller(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(3)
-	mpsync := collector.NewGenericMeterPoints("sync", func() (collector.Values, error) {
+	mpsync := collector.NewGenericMeterPoints("sync", func(ctx context.Context) (collector.Values, error) {
 		wg.Done()
 		return collector.Values{"wait": "done"}, nil
 	})
@@ -53,8 +53,9 @@ func TestPoller(t *testing.T) {
 	tsBegin := time.Now()
 	p := poller.New(ctx, c, 50*time.Millisecond)
 
-	// Wait until three runs are done.
+	// Wait until three runs are done and published.
 	wg.Wait()
+	waitMetrics(t, p, "a.i", "6")
 
 	ts, m := p.Metrics()
 	if m == nil {
@@ -78,8 +79,9 @@ func TestPoller(t *testing.T) {
 	c.Register(mpb, mpc, mpd, mpsync)
 	p.SetCollector(c)
 
-	// Wait until five runs are done.
+	// Wait until five runs are done and published.
 	wg.Wait()
+	waitMetrics(t, p, "c.i", "10")
 
 	ts, m = p.Metrics()
 	if m == nil {
@@ -100,14 +102,231 @@ func TestPoller(t *testing.T) {
 	testMetric(m, "d.j", "30")
 }
 
+// TestSlowCollection tests that meter points taking longer than the
+// interval don't overlap with themselves and publish their latest values
+// as stale while skipped.
+func TestSlowCollection(t *testing.T) {
+	var mu sync.Mutex
+	current, max := 0, 0
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("slow", func(ctx context.Context) (collector.Values, error) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+		time.Sleep(120 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return collector.Values{"ok": "true"}, nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, c, 50*time.Millisecond)
+	s := p.Subscribe()
+	for i := 0; i < 5; i++ {
+		// Timed out retrievals continue in background.
+		u := <-s.Updates()
+		values := u.Metrics.Values()
+		delete(values, "slow.stale")
+		if len(values) != 1 || (values["slow.ok"] != "true" && values["slow"] != "error: timeout") {
+			t.Errorf("illegal values: %q", values)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 1 {
+		t.Errorf("illegal number of parallel retrievals: %d", max)
+	}
+}
+
+// TestInitialCollection tests the immediate collection when starting.
+func TestInitialCollection(t *testing.T) {
+	c := collector.New()
+	c.Register(NewMeterPoints("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, c, time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("no initial collection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, m := p.Metrics()
+	if v, ok := m.Get("a.i"); !ok || v != "2" {
+		t.Errorf("illegal meter point value a.i: %q", v)
+	}
+}
+
+// TestAlive tests the liveness timestamp of the poller backend.
+func TestAlive(t *testing.T) {
+	c := collector.New()
+	c.Register(NewMeterPoints("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, c, 20*time.Millisecond)
+	start := p.Alive()
+	time.Sleep(100 * time.Millisecond)
+	if alive := p.Alive(); !alive.After(start) || time.Since(alive) > 50*time.Millisecond {
+		t.Errorf("liveness not updated: %v", alive)
+	}
+}
+
+// TestSubscription tests the delivery of updates to subscribers.
+func TestSubscription(t *testing.T) {
+	c := collector.New()
+	c.Register(NewMeterPoints("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	p := poller.New(ctx, c, 50*time.Millisecond)
+
+	sa := p.Subscribe()
+	sb := p.Subscribe()
+	ua := <-sa.Updates()
+	if ua.Metrics == nil {
+		t.Fatalf("metrics is nil")
+	}
+	if _, ok := ua.Metrics.Get("a.i"); !ok {
+		t.Errorf("missing meter points value for a.i")
+	}
+
+	// Subscriber b has been slow, it only gets the latest update.
+	time.Sleep(200 * time.Millisecond)
+	ub := <-sb.Updates()
+	if !ub.Timestamp.After(ua.Timestamp) {
+		t.Errorf("subscriber b got outdated update")
+	}
+
+	// Unsubscribe a, stop poller for b.
+	sa.Unsubscribe()
+	for range sa.Updates() {
+	}
+	cancel()
+	select {
+	case <-time.After(time.Second):
+		t.Errorf("updates of b not closed after stopping the poller")
+	case <-waitClosed(sb.Updates()):
+	}
+	sc := p.Subscribe()
+	if _, ok := <-sc.Updates(); ok {
+		t.Errorf("subscription to stopped poller not closed")
+	}
+}
+
+// TestCollect tests the coalesced on-demand collection.
+func TestCollect(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	mpslow := collector.NewGenericMeterPoints("slow", func(ctx context.Context) (collector.Values, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		return collector.Values{"done": "yes"}, nil
+	})
+	c := collector.New()
+	c.Register(mpslow, NewMeterPoints("a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, c, time.Hour)
+
+	// Concurrent callers share one collection.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, err := p.Collect(context.Background(), time.Second)
+			if err != nil {
+				t.Errorf("collect error: %v", err)
+				return
+			}
+			if v, ok := u.Metrics.Get("slow.done"); !ok || v != "yes" {
+				t.Errorf("illegal meter point value slow.done: %q", v)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("collection not coalesced, %d calls", calls)
+	}
+	ts, m := p.Metrics()
+	if m == nil || ts.IsZero() {
+		t.Fatalf("complete collection not set as latest metrics")
+	}
+
+	// Collection of selected meter points.
+	u, err := p.Collect(context.Background(), time.Second, "a", "b")
+	if err != nil {
+		t.Fatalf("collect error: %v", err)
+	}
+	if _, ok := u.Metrics.Get("slow.done"); ok {
+		t.Errorf("unselected meter points retrieved")
+	}
+	if v, ok := u.Metrics.Get("a.i"); !ok || v != "4" {
+		t.Errorf("illegal meter point value a.i: %q", v)
+	}
+	if v, ok := u.Metrics.Get("b"); !ok || v != "error: unknown meter points" {
+		t.Errorf("illegal meter point value b: %q", v)
+	}
+	if _, lm := p.Metrics(); lm != m {
+		t.Errorf("partial collection set as latest metrics")
+	}
+
+	// Waiting can be cancelled.
+	wctx, wcancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer wcancel()
+	if _, err := p.Collect(wctx, time.Second); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+
+	// Stopped poller.
+	cancel()
+	if _, err := p.Collect(context.Background(), time.Second); err == nil {
+		t.Errorf("expected error of stopped poller")
+	}
+}
+
 //--------------------
 // HELPERS
 //--------------------
 
+// waitMetrics waits until the latest metrics of the poller contain the
+// value. Collections run in background, so they are published shortly
+// after the meter points have been retrieved.
+func waitMetrics(t *testing.T, p *poller.Poller, id, value string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, m := p.Metrics(); m != nil {
+			if v, _ := m.Get(id); v == value {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("value %q not published", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitClosed drains the updates channel and signals when it's closed.
+func waitClosed(updateC <-chan poller.Update) <-chan struct{} {
+	doneC := make(chan struct{})
+	go func() {
+		for range updateC {
+		}
+		close(doneC)
+	}()
+	return doneC
+}
+
 func NewMeterPoints(id string) collector.MeterPoints {
 	i := 0
 	j := 5
-	return collector.NewGenericMeterPoints(id, func() (collector.Values, error) {
+	return collector.NewGenericMeterPoints(id, func(ctx context.Context) (collector.Values, error) {
 		i += 2
 		j += 5
 		return collector.Values{
@@ -12,9 +12,13 @@ package main
 //--------------------
 
 import (
+	"context"
+	"os"
 	"time"
 
 	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/output"
 )
 
 //--------------------
@@ -22,29 +26,102 @@ import (
 //--------------------
 
 // Configuration contains the configuration to run the system monitor daemon.
+// The server listens on the TCP address and the Unix socket, each if set,
+// unless systemd passes sockets via socket activation. Logs are written in
+// "text" or "json" format, retrievals taking longer than SlowRetrieval are
+// logged as slow. At most RetrievalWorkers meter points are retrieved at the
+// same time, 0 means no limit.
+// Without TLS configuration the server uses plain HTTP, without authentication
+// configuration everybody can access all metrics and the admin API is disabled.
+// Browsers may connect to the live metrics only from the origin of the server
+// or one of the LiveOrigins. The collector contains the meter points created
+// by the definitions. The metrics are pushed to the configured outputs and
+// the additional writers after each poll. With a fleet configuration the
+// daemon additionally aggregates the metrics of its peers.
 type Configuration struct {
-	Address   string
-	Collector *collector.Collector
-	Interval  time.Duration
+	Address          string
+	UnixSocket       string
+	UnixSocketMode   os.FileMode
+	Collector        *collector.Collector
+	MeterPoints      []collector.Definition
+	Interval         time.Duration
+	LiveIdleTimeout  time.Duration
+	LiveOrigins      []string
+	ShutdownTimeout  time.Duration
+	TLS              *TLSConfiguration
+	Auth             *AuthConfiguration
+	Graphite         *output.GraphiteConfiguration
+	Influx           *output.InfluxConfiguration
+	StatsD           *output.StatsDConfiguration
+	OTLP             *output.OTLPConfiguration
+	MQTT             *output.MQTTConfiguration
+	Syslog           *output.SyslogConfiguration
+	Journald         *output.JournaldConfiguration
+	RemoteWrite      *output.RemoteWriteConfiguration
+	Writers          map[string]output.Writer
+	Fleet            *FleetConfiguration
+	LogLevel         string
+	LogFormat        string
+	SlowRetrieval    time.Duration
+	RetrievalWorkers int
+	Loaded           time.Time
+}
+
+// AuthConfiguration contains the authentication and authorisation of the
+// metrics endpoints. Tokens and certificate subjects map to identity names,
+// the password file contains the names and their bcrypt hashed passwords.
+// The permissions define what each identity may access.
+type AuthConfiguration struct {
+	Tokens       map[string]string
+	PasswordFile string
+	CertSubjects map[string]string
+	Permissions  map[string]handler.Permissions
 }
 
 // ReadConfiguration simulates reading a configuration to run the system
 // monitor daemon.
 func ReadConfiguration() (*Configuration, error) {
 	// Configure collector and meter points.
+	defs := []collector.Definition{
+		{Type: collector.TypeMemory},
+		{Type: collector.TypeDisk, ID: "root", Mount: "/"},
+		{Type: collector.TypeNetwork},
+	}
 	c := collector.New()
-	memMP := collector.NewMemoryMeterPoints()
-	rootDiskMP := collector.NewDiskMeterPoints("root", "/")
-	versionMP := collector.NewGenericMeterPoints("version", func() (collector.Values, error) {
+	for _, def := range defs {
+		mp, err := collector.NewDefinedMeterPoints(def)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Register(mp); err != nil {
+			return nil, err
+		}
+	}
+	versionMP := collector.NewGenericMeterPoints("version", func(ctx context.Context) (collector.Values, error) {
 		return collector.Values{"sysmond": version}, nil
 	})
-	c.Register(memMP, rootDiskMP, versionMP)
+	c.Register(versionMP)
 	// Return simulated configuration.
 	return &Configuration{
-		Address:   ":1984",
-		Collector: c,
-		Interval:  10 * time.Second,
+		Address:          ":1984",
+		Collector:        c,
+		MeterPoints:      defs,
+		Interval:         10 * time.Second,
+		LiveIdleTimeout:  time.Minute,
+		ShutdownTimeout:  10 * time.Second,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		SlowRetrieval:    2 * time.Second,
+		RetrievalWorkers: 8,
+		Loaded:           time.Now(),
 	}, nil
 }
 
+// values returns the state of the configuration for the self meter points.
+func (cfg *Configuration) values() collector.Values {
+	return collector.Values{
+		"config.loaded": cfg.Loaded.Format(time.RFC3339),
+	}
+}
+
 // EOF
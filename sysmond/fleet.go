@@ -0,0 +1,178 @@
+// System Monitor Daemon - Fleet Aggregation
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// FLEET AGGREGATION
+//--------------------
+
+// FleetConfiguration contains the configuration of the fleet aggregation
+// mode. The daemon scrapes the metrics of its peers, the configured ones
+// and those listed in the discovery file as JSON array of peers. The file
+// is checked for modifications each discovery interval. The token is sent
+// to peers requiring authentication, scrapes are cancelled after the
+// timeout.
+type FleetConfiguration struct {
+	Peers             []collector.Peer
+	DiscoveryFile     string
+	DiscoveryInterval time.Duration
+	Token             string
+	Timeout           time.Duration
+}
+
+// fleet manages the meter points of the peers.
+type fleet struct {
+	cfg        *FleetConfiguration
+	collector  *collector.Collector
+	discovered map[string]collector.Peer
+	modTime    time.Time
+	cancel     func()
+	done       chan struct{}
+}
+
+// startFleet registers the meter points of the configured peers and those
+// of the discovery file. With a discovery file it's watched in background
+// until the context is done or the fleet is stopped.
+func startFleet(ctx context.Context, cfg *FleetConfiguration, c *collector.Collector) (*fleet, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &fleet{
+		cfg:        cfg,
+		collector:  c,
+		discovered: make(map[string]collector.Peer),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	for _, peer := range cfg.Peers {
+		mp, err := collector.NewPeerMeterPoints(peer, cfg.Token, cfg.Timeout)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if err := c.Register(mp); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	if cfg.DiscoveryFile == "" {
+		close(f.done)
+		return f, nil
+	}
+	if err := f.discover(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go f.watch(ctx)
+	return f, nil
+}
+
+// stop stops watching the discovery file.
+func (f *fleet) stop() {
+	f.cancel()
+	<-f.done
+}
+
+// watch checks the discovery file each interval.
+func (f *fleet) watch(ctx context.Context) {
+	defer close(f.done)
+	interval := f.cfg.DiscoveryInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.discover(); err != nil {
+				slog.Error("cannot discover peers", "file", f.cfg.DiscoveryFile, "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// discover reads the discovery file if it has been modified and updates
+// the meter points of the discovered peers. Peers with IDs of other meter
+// points are skipped. In case of errors nothing is changed.
+func (f *fleet) discover() error {
+	info, err := os.Stat(f.cfg.DiscoveryFile)
+	if err != nil {
+		return fmt.Errorf("cannot read discovery file: %v", err)
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.cfg.DiscoveryFile)
+	if err != nil {
+		return fmt.Errorf("cannot read discovery file: %v", err)
+	}
+	var peers []collector.Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return fmt.Errorf("invalid discovery file: %v", err)
+	}
+	registered := make(map[string]bool)
+	for _, id := range f.collector.List() {
+		registered[id] = true
+	}
+	peerByID := make(map[string]collector.Peer)
+	var mps []collector.MeterPoints
+	for _, peer := range peers {
+		id := peer.MeterPointsID()
+		if _, ok := f.discovered[id]; registered[id] && !ok {
+			slog.Warn("skipping discovered peer", "url", peer.URL, "error", fmt.Sprintf("ID %q already in use", id))
+			continue
+		}
+		if _, ok := peerByID[id]; ok {
+			return fmt.Errorf("double peer ID %q in discovery file", id)
+		}
+		peerByID[id] = peer
+		if f.discovered[id] == peer {
+			continue
+		}
+		mp, err := collector.NewPeerMeterPoints(peer, f.cfg.Token, f.cfg.Timeout)
+		if err != nil {
+			return err
+		}
+		mps = append(mps, mp)
+	}
+	var gone []string
+	for id := range f.discovered {
+		if _, ok := peerByID[id]; !ok {
+			gone = append(gone, id)
+		}
+	}
+	if len(gone) > 0 {
+		f.collector.Unregister(gone...)
+	}
+	f.collector.Replace(mps...)
+	f.discovered = peerByID
+	f.modTime = info.ModTime()
+	if len(gone) > 0 || len(mps) > 0 {
+		slog.Info("discovered peers changed", "peers", len(peerByID), "updated", len(mps), "removed", len(gone))
+	}
+	return nil
+}
+
+// EOF
@@ -0,0 +1,108 @@
+// System Monitor Daemon - Fleet Aggregation - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestFleet tests aggregating configured and discovered peers.
+func TestFleet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	peer := func(free string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer s3cr3t" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"sys.mem.free": %q}`, free)
+		}))
+	}
+	web1, web2, web3 := peer("1"), peer("2"), peer("3")
+	defer web1.Close()
+	defer web2.Close()
+	defer web3.Close()
+	file := filepath.Join(dir, "peers.json")
+	discover := func(content string, mtime time.Time) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatalf("cannot write discovery file: %v", err)
+		}
+		os.Chtimes(file, mtime, mtime)
+	}
+	now := time.Now()
+	discover(fmt.Sprintf(`[{"name": "web2", "url": %q}, {"name": "version", "url": %q}]`, web2.URL, web3.URL), now.Add(-time.Minute))
+
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("version", func(ctx context.Context) (collector.Values, error) {
+		return collector.Values{"sysmond": "test"}, nil
+	}))
+	f, err := startFleet(context.Background(), &FleetConfiguration{
+		Peers:             []collector.Peer{{Name: "web1", URL: web1.URL}},
+		DiscoveryFile:     file,
+		DiscoveryInterval: 10 * time.Millisecond,
+		Token:             "s3cr3t",
+	}, c)
+	if err != nil {
+		t.Fatalf("cannot start fleet: %v", err)
+	}
+	defer f.stop()
+	if ids := c.List(); !reflect.DeepEqual(ids, []string{"version", "web1", "web2"}) {
+		t.Errorf("invalid meter points: %v", ids)
+	}
+	values := c.Retrieve(context.Background(), 5*time.Second).Values()
+	if values["web1.sys.mem.free"] != "1" || values["web1.up"] != "1" ||
+		values["web2.sys.mem.free"] != "2" || values["web2.up"] != "1" ||
+		values["version.sysmond"] != "test" {
+		t.Errorf("invalid values: %q", values)
+	}
+
+	// Replace web2 by web3 and wait for the discovery.
+	discover(fmt.Sprintf(`[{"name": "web3", "url": %q}]`, web3.URL), now)
+	for i := 0; ; i++ {
+		ids := c.List()
+		if reflect.DeepEqual(ids, []string{"version", "web1", "web3"}) {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("peers not discovered: %v", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invalid files don't change anything.
+	f.stop()
+	discover(`[{"url": "ftp://web4"}]`, now.Add(time.Minute))
+	if err := f.discover(); err == nil {
+		t.Errorf("expected discovery error")
+	}
+	if ids := c.List(); !reflect.DeepEqual(ids, []string{"version", "web1", "web3"}) {
+		t.Errorf("invalid meter points: %v", ids)
+	}
+}
+
+// EOF
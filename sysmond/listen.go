@@ -0,0 +1,111 @@
+// System Monitor Daemon - Listeners
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/themue/sysmond/systemd"
+)
+
+//--------------------
+// LISTENERS
+//--------------------
+
+// listener is one network listener the server is serving on.
+type listener struct {
+	net.Listener
+	useTLS bool
+}
+
+// serve lets the server serve on the listener.
+func (l listener) serve(srv *http.Server) error {
+	if l.useTLS {
+		return srv.ServeTLS(l, "", "")
+	}
+	return srv.Serve(l)
+}
+
+// listen creates the listeners. If systemd passes sockets via socket
+// activation those are used, otherwise the configured TCP address and Unix
+// socket. TLS is used for all but Unix sockets if configured.
+func listen(cfg *Configuration) ([]listener, error) {
+	useTLS := cfg.TLS != nil
+	sls, names, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(sls) > 0 {
+		return passedListeners(sls, names, useTLS), nil
+	}
+	var ls []listener
+	if cfg.Address != "" {
+		tl, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, listener{tl, useTLS})
+	}
+	if cfg.UnixSocket != "" {
+		ul, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketMode)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, listener{ul, false})
+	}
+	if len(ls) == 0 {
+		return nil, errors.New("neither address nor Unix socket configured")
+	}
+	return ls, nil
+}
+
+// passedListeners wraps the sockets passed by systemd. Like the configured
+// Unix socket passed Unix sockets are served without TLS.
+func passedListeners(sls []net.Listener, names []string, useTLS bool) []listener {
+	ls := make([]listener, len(sls))
+	for i, sl := range sls {
+		unix := sl.Addr().Network() == "unix"
+		slog.Info("serving on socket passed by systemd", "name", names[i], "address", sl.Addr(), "tls", useTLS && !unix)
+		ls[i] = listener{sl, useTLS && !unix}
+	}
+	return ls
+}
+
+// listenUnix listens on a Unix socket with the passed permissions. A stale
+// socket file of a previous run is removed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("cannot listen on %q: file exists and is no socket", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot set permissions of %q: %v", path, err)
+	}
+	return l, nil
+}
+
+// EOF
@@ -0,0 +1,103 @@
+// System Monitor Daemon - Listeners - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestPassedListeners tests serving TLS on passed TCP sockets and plain
+// HTTP on passed Unix sockets.
+func TestPassedListeners(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	socket := filepath.Join(dir, "sysmond.sock")
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen on TCP: %v", err)
+	}
+	ul, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("cannot listen on Unix socket: %v", err)
+	}
+	ls := passedListeners([]net.Listener{tl, ul}, []string{"http", "local"}, true)
+	if len(ls) != 2 || !ls[0].useTLS || ls[1].useTLS {
+		t.Fatalf("invalid listeners: %+v", ls)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				w.Write([]byte("tls"))
+				return
+			}
+			w.Write([]byte("plain"))
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{server.tlsCert()}},
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	defer srv.Close()
+	for _, l := range ls {
+		go l.serve(srv)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(c *http.Client, url string) string {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("cannot get %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("cannot read response: %v", err)
+		}
+		return string(b)
+	}
+	tc := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+	if body := get(tc, "https://"+tl.Addr().String()); body != "tls" {
+		t.Errorf("TCP socket not served with TLS: %q", body)
+	}
+	uc := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	if body := get(uc, "http://sysmond/"); body != "plain" {
+		t.Errorf("Unix socket not served without TLS: %q", body)
+	}
+}
+
+// EOF
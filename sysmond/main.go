@@ -13,11 +13,18 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/themue/sysmond/collector"
 	"github.com/themue/sysmond/handler"
+	"github.com/themue/sysmond/poller"
+	"github.com/themue/sysmond/systemd"
 )
 
 //--------------------
@@ -26,47 +33,237 @@ import (
 
 const version = "v0.1.0"
 
+// Exit codes of the daemon.
+const (
+	exitOK = iota
+	exitServerError
+	exitConfigurationError
+	exitShutdownError
+)
+
 //--------------------
 // RUN
 //--------------------
 
-// Run simply configures and runs the server.
-func Run(ctx context.Context, cfg *Configuration) <-chan error {
-	errC := make(chan error)
-	go func() {
-		h := handler.New(ctx, cfg.Collector, cfg.Interval)
+// shutdownError signals that the server has not been shut down gracefully.
+type shutdownError struct {
+	err error
+}
 
-		http.Handle("/metrics", h)
+// Error implements the error interface.
+func (e *shutdownError) Error() string {
+	return fmt.Sprintf("graceful shutdown failed: %v", e.err)
+}
 
-		errC <- http.ListenAndServe(cfg.Address, nil)
+// Run configures and runs the server until the context is done. Then the
+// poller is stopped and in-flight requests are drained within the
+// configured grace period. Afterwards stopping is notified to systemd, the
+// outputs flush their buffers, and the meter points are stopped. The
+// returned channel delivers nil after a clean shutdown or the error which
+// ended the server, both only when all this is done.
+func Run(ctx context.Context, cfg *Configuration) <-chan error {
+	errC := make(chan error, 1)
+	go func() {
+		errC <- run(ctx, cfg)
 	}()
 	return errC
 }
 
+// run runs the server. The deferred stopping is done before returning.
+func run(ctx context.Context, cfg *Configuration) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	defer cfg.Collector.Stop()
+
+	stats := handler.NewStats()
+	err := cfg.Collector.Register(collector.NewSelfMeterPoints(cfg.Collector, stats.Values, cfg.values))
+	if err != nil {
+		return err
+	}
+
+	if cfg.Fleet != nil {
+		f, err := startFleet(ctx, cfg.Fleet, cfg.Collector)
+		if err != nil {
+			return err
+		}
+		defer f.stop()
+	}
+
+	p := poller.New(ctx, cfg.Collector, cfg.Interval)
+	outputs, err := startOutputs(cfg, p)
+	if err != nil {
+		return err
+	}
+	defer stopOutputs(outputs)
+	if n := systemd.NewNotifier(); n != nil {
+		notifiedC := make(chan struct{})
+		go func() {
+			defer close(notifiedC)
+			notifySystemd(ctx, n, p, systemd.WatchdogInterval())
+		}()
+		// Also stops notifying when the server fails.
+		defer func() {
+			stop()
+			<-notifiedC
+		}()
+	}
+
+	auth, err := newAuth(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	protect := func(endpoint string, h http.Handler) http.Handler {
+		if auth == nil {
+			return h
+		}
+		return auth.Protect(endpoint, h)
+	}
+
+	mux := http.NewServeMux()
+	handle := func(endpoint string, h http.Handler) {
+		mux.Handle(endpoint, stats.Instrument(endpoint, h))
+	}
+	handle("/metrics", protect("/metrics", handler.New(p)))
+	handle("/metrics/stream", protect("/metrics/stream", handler.NewStream(p)))
+	handle("/metrics/live", protect("/metrics/live", handler.NewLive(p, cfg.LiveIdleTimeout, cfg.LiveOrigins...)))
+	if auth != nil {
+		admin := handler.NewAdmin(cfg.Collector, cfg.MeterPoints)
+		admin = stats.Instrument(handler.AdminPath, auth.ProtectAdmin(handler.AdminPath, admin))
+		mux.Handle(handler.AdminPath, admin)
+		mux.Handle(handler.AdminPath+"/", admin)
+	}
+	handle("/ready", handler.NewReady(p))
+	handle("/healthz", handler.NewHealth(p))
+
+	srv := &http.Server{
+		Handler: mux,
+	}
+	if cfg.TLS != nil {
+		tlsCfg, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsCfg
+	}
+	ls, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	serveC := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l listener) {
+			serveC <- l.serve(srv)
+		}(l)
+	}
+
+	select {
+	case err := <-serveC:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stopped poller closes the streams, now drain the remaining requests.
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		srv.Close()
+		return &shutdownError{err}
+	}
+	return nil
+}
+
+// newAuth creates the authentication and authorisation of the endpoints. It
+// returns nil if not configured.
+func newAuth(cfg *AuthConfiguration) (*handler.Auth, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var authenticators []handler.Authenticator
+	if len(cfg.CertSubjects) > 0 {
+		authenticators = append(authenticators, handler.NewCertAuthenticator(cfg.CertSubjects))
+	}
+	if len(cfg.Tokens) > 0 {
+		authenticators = append(authenticators, handler.NewTokenAuthenticator(cfg.Tokens))
+	}
+	if cfg.PasswordFile != "" {
+		ba, err := handler.NewBasicAuthenticator(cfg.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, ba)
+	}
+	if len(authenticators) == 0 {
+		return nil, errors.New("authentication configured without authenticators")
+	}
+	return handler.NewAuth(cfg.Permissions, authenticators...), nil
+}
+
+// newLogger creates the structured logger with the configured format and level.
+func newLogger(cfg *Configuration) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", cfg.LogLevel)
+	}
+	opts := &slog.HandlerOptions{
+		Level: level,
+	}
+	switch cfg.LogFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", cfg.LogFormat)
+	}
+}
+
 //--------------------
 // MAIN
 //--------------------
 
-// main runs the system monitor daemon.
+// main runs the system monitor daemon until SIGTERM or SIGINT.
 func main() {
-	log.Printf("system monitor daemon %s ...", version)
-
-	// Create a context with timeout to automatically end the demo program.
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-
-	// Read configuration and run the server.
+	// Read configuration and set up logging.
 	cfg, err := ReadConfiguration()
 	if err != nil {
-		log.Fatalf("server configuration error: %v", err)
+		slog.Error("server configuration error", "error", err)
+		os.Exit(exitConfigurationError)
+	}
+	logger, err := newLogger(cfg)
+	if err != nil {
+		slog.Error("server configuration error", "error", err)
+		os.Exit(exitConfigurationError)
 	}
+	slog.SetDefault(logger)
+	cfg.Collector.SetLogger(logger, cfg.SlowRetrieval)
+	cfg.Collector.SetWorkers(cfg.RetrievalWorkers)
+	slog.Info("system monitor daemon starting", "version", version)
+
+	// Run the server until a signal is received. Afterwards the default
+	// signal handling is restored, so that a second signal terminates
+	// immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	errC := Run(ctx, cfg)
 
 	select {
 	case <-ctx.Done():
-		log.Printf("done!")
+		stop()
+		slog.Info("shutting down")
+		err = <-errC
 	case err = <-errC:
-		log.Fatalf("server error: %v", err)
+		stop()
+	}
+
+	switch err.(type) {
+	case nil:
+		slog.Info("done")
+		os.Exit(exitOK)
+	case *shutdownError:
+		slog.Error("server error", "error", err)
+		os.Exit(exitShutdownError)
+	default:
+		slog.Error("server error", "error", err)
+		os.Exit(exitServerError)
 	}
 }
 
@@ -0,0 +1,125 @@
+// System Monitor Daemon - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/output"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestRunShutdown tests that stopping is notified, the outputs are closed,
+// and the meter points are stopped before Run reports the shutdown.
+func TestRunShutdown(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	mp := &stoppingMeterPoints{}
+	w := &closingWriter{}
+	c := collector.New()
+	c.Register(mp)
+	cfg := &Configuration{
+		Address:         "127.0.0.1:0",
+		Collector:       c,
+		Interval:        50 * time.Millisecond,
+		ShutdownTimeout: time.Second,
+		Writers:         map[string]output.Writer{"closing": w},
+		Loaded:          time.Now(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := Run(ctx, cfg)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errC:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no shutdown")
+	}
+	if !w.closed.Load() {
+		t.Errorf("output not closed before reporting")
+	}
+	if !mp.stopped.Load() {
+		t.Errorf("meter points not stopped before reporting")
+	}
+	if msgs := readNotifications(t, conn, 100*time.Millisecond); !strings.Contains(msgs, "STOPPING=1\n") {
+		t.Errorf("stopping not notified before reporting: %q", msgs)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// stoppingMeterPoints take some time to be stopped.
+type stoppingMeterPoints struct {
+	stopped atomic.Bool
+}
+
+// ID implements collector.MeterPoints.
+func (mp *stoppingMeterPoints) ID() string {
+	return "stopping"
+}
+
+// Retrieve implements collector.MeterPoints.
+func (mp *stoppingMeterPoints) Retrieve(ctx context.Context) (collector.Values, error) {
+	return collector.Values{"ok": "1"}, nil
+}
+
+// Stop implements collector.Stopper.
+func (mp *stoppingMeterPoints) Stop() {
+	time.Sleep(100 * time.Millisecond)
+	mp.stopped.Store(true)
+}
+
+// closingWriter takes some time to be closed.
+type closingWriter struct {
+	closed atomic.Bool
+}
+
+// Write implements output.Writer.
+func (w *closingWriter) Write(ctx context.Context, u poller.Update) error {
+	return nil
+}
+
+// Close implements output.Writer.
+func (w *closingWriter) Close() error {
+	time.Sleep(100 * time.Millisecond)
+	w.closed.Store(true)
+	return nil
+}
+
+// EOF
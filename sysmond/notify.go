@@ -0,0 +1,113 @@
+// System Monitor Daemon - Systemd Notification
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/themue/sysmond/poller"
+	"github.com/themue/sysmond/systemd"
+)
+
+//--------------------
+// SYSTEMD NOTIFICATION
+//--------------------
+
+// notifySystemd tells systemd that the daemon is ready after the first poll
+// retrieving at least one value without error and describes the health of
+// the meter points after each poll. The watchdog, if enabled, is only
+// notified while the poller is running and its backend has been alive within
+// the watchdog timeout. When the context is done stopping is notified.
+func notifySystemd(ctx context.Context, n *systemd.Notifier, p *poller.Poller, watchdog time.Duration) {
+	notify := func(states ...string) {
+		if err := n.Notify(states...); err != nil {
+			slog.Error("cannot notify systemd", "error", err)
+		}
+	}
+	s := p.Subscribe()
+	defer s.Unsubscribe()
+	var pingC <-chan time.Time
+	if watchdog > 0 {
+		ticker := time.NewTicker(watchdog / 2)
+		defer ticker.Stop()
+		pingC = ticker.C
+	}
+	ready := false
+	update := func(u poller.Update) {
+		states := []string{systemd.Status(healthStatus(u))}
+		if !ready && successful(u) {
+			states = append(states, systemd.StateReady)
+			ready = true
+		}
+		notify(states...)
+	}
+	// Initial collection may be done before subscribing.
+	if ts, m := p.Metrics(); m != nil {
+		update(poller.Update{Timestamp: ts, Metrics: m})
+	}
+	updateC := s.Updates()
+	for {
+		select {
+		case <-ctx.Done():
+			notify(systemd.StateStopping)
+			return
+		case u, ok := <-updateC:
+			if !ok {
+				updateC = nil
+				continue
+			}
+			update(u)
+		case <-pingC:
+			// A wedged poller doesn't update its liveness.
+			if p.Running() && time.Since(p.Alive()) < watchdog {
+				notify(systemd.StateWatchdog)
+			}
+		}
+	}
+}
+
+// successful checks if an update contains at least one value without error.
+func successful(u poller.Update) bool {
+	for _, value := range u.Metrics.Values() {
+		if !strings.HasPrefix(value, "error:") {
+			return true
+		}
+	}
+	return false
+}
+
+// healthStatus summarises the number of values and errors of an update.
+func healthStatus(u poller.Update) string {
+	values := u.Metrics.Values()
+	var errs []string
+	for id, value := range values {
+		if strings.HasPrefix(value, "error:") {
+			errs = append(errs, id)
+		}
+	}
+	status := fmt.Sprintf("%d values, %d errors", len(values), len(errs))
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		if len(errs) > 3 {
+			errs = append(errs[:3], "...")
+		}
+		status += " (" + strings.Join(errs, ", ") + ")"
+	}
+	return status
+}
+
+// EOF
@@ -0,0 +1,162 @@
+// System Monitor Daemon - Systemd Notification - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/collector"
+	"github.com/themue/sysmond/poller"
+	"github.com/themue/sysmond/systemd"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestNotifySystemd tests the notifications using a local datagram socket
+// as stand-in for systemd.
+func TestNotifySystemd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	c := collector.New()
+	c.Register(
+		collector.NewGenericMeterPoints("ok", func(ctx context.Context) (collector.Values, error) {
+			return collector.Values{"a": "1", "b": "2"}, nil
+		}),
+		collector.NewGenericMeterPoints("failing", func(ctx context.Context) (collector.Values, error) {
+			return nil, errors.New("broken")
+		}),
+	)
+	pctx, pcancel := context.WithCancel(context.Background())
+	defer pcancel()
+	p := poller.New(pctx, c, 50*time.Millisecond)
+	nctx, ncancel := context.WithCancel(context.Background())
+	defer ncancel()
+	go notifySystemd(nctx, systemd.NewNotifier(), p, 100*time.Millisecond)
+
+	// Ready and status after first poll, watchdog while running.
+	msgs := readNotifications(t, conn, 300*time.Millisecond)
+	if !strings.Contains(msgs, "READY=1\n") {
+		t.Errorf("ready not notified: %q", msgs)
+	}
+	if strings.Count(msgs, "READY=1\n") != 1 {
+		t.Errorf("ready notified multiple times: %q", msgs)
+	}
+	if !strings.Contains(msgs, "STATUS=3 values, 1 errors (failing.all)\n") {
+		t.Errorf("status not notified: %q", msgs)
+	}
+	if !strings.Contains(msgs, "WATCHDOG=1\n") {
+		t.Errorf("watchdog not notified: %q", msgs)
+	}
+
+	// No watchdog after the poller stopped.
+	// Notifications sent before stopping are discarded.
+	pcancel()
+	readNotifications(t, conn, 100*time.Millisecond)
+	msgs = readNotifications(t, conn, 300*time.Millisecond)
+	if strings.Contains(msgs, "WATCHDOG=1\n") {
+		t.Errorf("watchdog notified for stopped poller: %q", msgs)
+	}
+
+	// Stopping.
+	ncancel()
+	msgs = readNotifications(t, conn, 100*time.Millisecond)
+	if msgs != "STOPPING=1\n" {
+		t.Errorf("stopping not notified: %q", msgs)
+	}
+}
+
+// TestNotifySystemdReady tests that ready is only notified after a poll
+// retrieved values without errors.
+func TestNotifySystemdReady(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	var failing atomic.Bool
+	failing.Store(true)
+	c := collector.New()
+	c.Register(collector.NewGenericMeterPoints("flaky", func(ctx context.Context) (collector.Values, error) {
+		if failing.Load() {
+			return nil, errors.New("broken")
+		}
+		return collector.Values{"a": "1"}, nil
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := poller.New(ctx, c, 50*time.Millisecond)
+	go notifySystemd(ctx, systemd.NewNotifier(), p, 0)
+
+	// Only errors, not ready.
+	msgs := readNotifications(t, conn, 200*time.Millisecond)
+	if !strings.Contains(msgs, "STATUS=1 values, 1 errors (flaky.all)\n") {
+		t.Errorf("status not notified: %q", msgs)
+	}
+	if strings.Contains(msgs, "READY=1\n") {
+		t.Errorf("ready notified without successful poll: %q", msgs)
+	}
+
+	// Ready after the first successful poll.
+	failing.Store(false)
+	msgs = readNotifications(t, conn, 200*time.Millisecond)
+	if strings.Count(msgs, "READY=1\n") != 1 {
+		t.Errorf("ready not notified once: %q", msgs)
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// readNotifications reads all notifications received during the duration.
+func readNotifications(t *testing.T, conn *net.UnixConn, d time.Duration) string {
+	msgs := ""
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(d))
+	for {
+		l, err := conn.Read(buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return msgs
+			}
+			t.Fatalf("cannot read notification: %v", err)
+		}
+		msgs += string(buf[:l])
+	}
+}
+
+// EOF
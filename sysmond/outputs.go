@@ -0,0 +1,103 @@
+// System Monitor Daemon - Outputs
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"github.com/themue/sysmond/output"
+	"github.com/themue/sysmond/poller"
+)
+
+//--------------------
+// OUTPUTS
+//--------------------
+
+// startOutputs starts the configured outputs pushing the updates of the
+// poller.
+func startOutputs(cfg *Configuration, p *poller.Poller) ([]*output.Output, error) {
+	var outputs []*output.Output
+	if cfg.Graphite != nil {
+		g, err := output.NewGraphite(*cfg.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "graphite", g))
+	}
+	if cfg.Influx != nil {
+		i, err := output.NewInflux(*cfg.Influx, cfg.Collector.List)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "influx", i))
+	}
+	if cfg.StatsD != nil {
+		s, err := output.NewStatsD(*cfg.StatsD)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "statsd", s))
+	}
+	if cfg.OTLP != nil {
+		o, err := output.NewOTLP(*cfg.OTLP)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "otlp", o))
+	}
+	if cfg.MQTT != nil {
+		m, err := output.NewMQTT(*cfg.MQTT)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "mqtt", m))
+	}
+	if cfg.Syslog != nil {
+		s, err := output.NewSyslog(*cfg.Syslog)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "syslog", s))
+	}
+	if cfg.Journald != nil {
+		j, err := output.NewJournald(*cfg.Journald)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "journald", j))
+	}
+	if cfg.RemoteWrite != nil {
+		rw, err := output.NewRemoteWrite(*cfg.RemoteWrite)
+		if err != nil {
+			stopOutputs(outputs)
+			return nil, err
+		}
+		outputs = append(outputs, output.Start(p, "remotewrite", rw))
+	}
+	for name, w := range cfg.Writers {
+		outputs = append(outputs, output.Start(p, name, w))
+	}
+	return outputs, nil
+}
+
+// stopOutputs stops the outputs, they flush their buffered metrics.
+func stopOutputs(outputs []*output.Output) {
+	for _, o := range outputs {
+		o.Stop()
+	}
+}
+
+// EOF
@@ -0,0 +1,168 @@
+// System Monitor Daemon - TLS
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+//--------------------
+// TLS CONFIGURATION
+//--------------------
+
+// TLSConfiguration contains the settings for serving via TLS. If a client
+// CA file is set, clients have to authenticate with certificates signed by
+// one of its CAs (mutual TLS).
+type TLSConfiguration struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	ClientCAFile string
+}
+
+// tlsVersions maps the configurable minimum versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the TLS configuration for the server. Certificates
+// are reloaded when their files change.
+func newTLSConfig(cfg *TLSConfiguration) (*tls.Config, error) {
+	cr, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS minimum version %q", cfg.MinVersion)
+		}
+		tlsCfg.MinVersion = version
+	}
+	if len(cfg.CipherSuites) > 0 {
+		ids := make(map[string]uint16)
+		for _, cs := range tls.CipherSuites() {
+			ids[cs.Name] = cs.ID
+		}
+		for _, name := range cfg.CipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid or insecure TLS cipher suite %q", name)
+			}
+			tlsCfg.CipherSuites = append(tlsCfg.CipherSuites, id)
+		}
+	}
+	if cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA file %q", cfg.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+//--------------------
+// CERTIFICATE RELOADER
+//--------------------
+
+// certReloader provides the server certificate and reloads it when the
+// certificate or key file have been modified, e.g. after a rotation.
+type certReloader struct {
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+// newCertReloader creates a reloader and initially loads the certificate.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the current certificate. It is used as callback
+// of the TLS configuration. If reloading fails the previous certificate is
+// used further on.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.modified() {
+		if err := cr.reload(); err != nil {
+			slog.Error("cannot reload TLS certificate", "error", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+// modified checks if one of the files is newer than the loaded certificate.
+func (cr *certReloader) modified() bool {
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err == nil && fi.ModTime().After(cr.modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the certificate and remembers the latest modification time.
+func (cr *certReloader) reload() error {
+	var modTime time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("cannot access TLS file: %v", err)
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	// Remember modification time even in case of an error, so that
+	// the next try is done after the next change.
+	cr.modTime = modTime
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	cr.cert = &cert
+	return nil
+}
+
+// EOF
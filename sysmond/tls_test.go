@@ -0,0 +1,246 @@
+// System Monitor Daemon - TLS - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package main
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestTLSMutual tests serving with client certificate verification.
+func TestTLSMutual(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	client := newTestCert(t, "client", ca)
+	certFile, keyFile := server.write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	tlsCfg, err := newTLSConfig(&TLSConfiguration{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ClientCAFile: caFile,
+	})
+	if err != nil {
+		t.Fatalf("cannot create TLS configuration: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.Listener = tls.NewListener(srv.Listener, tlsCfg)
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.Start()
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs []tls.Certificate) (string, error) {
+		c := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:      roots,
+					Certificates: certs,
+				},
+			},
+		}
+		resp, err := c.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+	if _, err := get(nil); err == nil {
+		t.Errorf("request without client certificate succeeded")
+	}
+	cn, err := get([]tls.Certificate{client.tlsCert()})
+	if err != nil {
+		t.Fatalf("request with client certificate failed: %v", err)
+	}
+	if cn != "client" {
+		t.Errorf("invalid client common name: %q", cn)
+	}
+}
+
+// TestTLSReload tests reloading a rotated certificate.
+func TestTLSReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "first", ca).write(t, dir, "server")
+	tlsCfg, err := newTLSConfig(&TLSConfiguration{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatalf("cannot create TLS configuration: %v", err)
+	}
+	commonName := func() string {
+		cert, err := tlsCfg.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("cannot get certificate: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("cannot parse certificate: %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if cn := commonName(); cn != "first" {
+		t.Errorf("invalid initial certificate: %q", cn)
+	}
+
+	// Rotate the certificate.
+	newTestCert(t, "second", ca).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if cn := commonName(); cn != "second" {
+		t.Errorf("certificate not reloaded: %q", cn)
+	}
+
+	// Broken files keep the previous certificate.
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if cn := commonName(); cn != "second" {
+		t.Errorf("previous certificate not kept: %q", cn)
+	}
+}
+
+// TestTLSInvalid tests invalid TLS configurations.
+func TestTLSInvalid(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := newTestCert(t, "server", nil).write(t, dir, "server")
+	tests := []TLSConfiguration{
+		{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile},
+		{CertFile: certFile, KeyFile: keyFile, MinVersion: "0.9"},
+		{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+	}
+	for i, test := range tests {
+		if _, err := newTLSConfig(&test); err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}
+
+//--------------------
+// HELPERS
+//--------------------
+
+// testCert contains a generated certificate and its key.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by the parent, or a self-signed
+// CA certificate if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{
+		cert: cert,
+		der:  der,
+		key:  key,
+	}
+}
+
+// write writes the certificate and key as PEM files.
+func (tc *testCert) write(t *testing.T, dir, name string) (string, string) {
+	keyDER, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("cannot write certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("cannot write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// tlsCert returns the certificate for a TLS configuration.
+func (tc *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{tc.der},
+		PrivateKey:  tc.key,
+	}
+}
+
+// tempDir creates a temporary directory for the test files.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	return dir
+}
+
+// EOF
@@ -0,0 +1,82 @@
+// System Monitor Daemon - Systemd - Socket Activation
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package systemd
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+//--------------------
+// SOCKET ACTIVATION
+//--------------------
+
+// Listeners returns the listeners passed by systemd via socket activation
+// together with their names as configured with FileDescriptorName. If the
+// process hasn't been activated by systemd nil is returned. The environment
+// variables are unset afterwards so that child processes don't inherit them.
+func Listeners() ([]net.Listener, []string, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listeners(listenFDsStart)
+}
+
+// listeners creates the listeners out of the file descriptors starting
+// with the passed one.
+func listeners(start int) ([]net.Listener, []string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var ls []net.Listener
+	var lnames []string
+	for fd := start; fd < start+n; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i := fd - start; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("invalid socket %q (fd %d): %v", name, fd, err)
+		}
+		ls = append(ls, l)
+		lnames = append(lnames, name)
+	}
+	return ls, lnames, nil
+}
+
+// EOF
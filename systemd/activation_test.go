@@ -0,0 +1,88 @@
+// System Monitor Daemon - Systemd - Socket Activation - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package systemd
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestListeners tests taking over passed sockets.
+func TestListeners(t *testing.T) {
+	// Create two listeners with consecutive file descriptors.
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer tcp.Close()
+	tcpFile, _ := tcp.(*net.TCPListener).File()
+	defer tcpFile.Close()
+	start := int(tcpFile.Fd())
+	unixPath := os.TempDir() + "/sysmond-test-" + strconv.Itoa(os.Getpid()) + ".sock"
+	unix, err := net.Listen("unix", unixPath)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer unix.Close()
+	unixFile, _ := unix.(*net.UnixListener).File()
+	defer unixFile.Close()
+	if err := syscall.Dup2(int(unixFile.Fd()), start+1); err != nil {
+		t.Fatalf("cannot duplicate file descriptor: %v", err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "http:local")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	ls, names, err := listeners(start)
+	if err != nil {
+		t.Fatalf("cannot get listeners: %v", err)
+	}
+	if len(ls) != 2 || names[0] != "http" || names[1] != "local" {
+		t.Fatalf("invalid listeners: %v %v", ls, names)
+	}
+	if ls[0].Addr().String() != tcp.Addr().String() {
+		t.Errorf("invalid TCP listener address: %v", ls[0].Addr())
+	}
+	if ls[1].Addr().String() != unixPath {
+		t.Errorf("invalid Unix listener address: %v", ls[1].Addr())
+	}
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// TestListenersNotActivated tests running without socket activation.
+func TestListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	defer os.Unsetenv("LISTEN_FDS")
+	ls, _, err := Listeners()
+	if err != nil || ls != nil {
+		t.Errorf("unexpected listeners: %v %v", ls, err)
+	}
+	if os.Getenv("LISTEN_PID") != "" {
+		t.Errorf("environment not cleaned")
+	}
+}
+
+// EOF
@@ -0,0 +1,99 @@
+// System Monitor Daemon - Systemd - Notification
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package systemd
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+//--------------------
+// CONSTANTS
+//--------------------
+
+// States which can be notified.
+const (
+	StateReady    = "READY=1"
+	StateStopping = "STOPPING=1"
+	StateWatchdog = "WATCHDOG=1"
+)
+
+//--------------------
+// NOTIFIER
+//--------------------
+
+// Notifier sends state notifications to systemd for services of Type=notify.
+type Notifier struct {
+	addr *net.UnixAddr
+}
+
+// NewNotifier creates a notifier for the socket passed by systemd in
+// NOTIFY_SOCKET. If the variable isn't set nil is returned.
+func NewNotifier() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Leading @ signals an abstract socket.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	return &Notifier{
+		addr: &net.UnixAddr{
+			Name: socket,
+			Net:  "unixgram",
+		},
+	}
+}
+
+// Notify sends one or more states, e.g. StateReady or a status created
+// with Status.
+func (n *Notifier) Notify(states ...string) error {
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	msg := ""
+	for _, state := range states {
+		msg += state + "\n"
+	}
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+// Status creates a free-form status state describing the service.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+//--------------------
+// WATCHDOG
+//--------------------
+
+// WatchdogInterval returns the interval in which systemd expects the
+// watchdog notifications. It returns 0 if the watchdog isn't enabled for
+// this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// EOF
@@ -0,0 +1,90 @@
+// System Monitor Daemon - Systemd - Notification - Unit Tests
+//
+// Copyright (C) 2018 Frank Mueller / Oldenburg / Germany
+//
+// All rights reserved. Use of this source code is governed
+// by the new BSD license.
+
+package systemd_test
+
+//--------------------
+// IMPORTS
+//--------------------
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/themue/sysmond/systemd"
+)
+
+//--------------------
+// TESTS
+//--------------------
+
+// TestNotify tests sending notifications to a local datagram socket.
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysmond")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	n := systemd.NewNotifier()
+	if n == nil {
+		t.Fatalf("no notifier created")
+	}
+	if err := n.Notify(systemd.StateReady, systemd.Status("all fine")); err != nil {
+		t.Fatalf("cannot notify: %v", err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	l, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("cannot read notification: %v", err)
+	}
+	if msg := string(buf[:l]); msg != "READY=1\nSTATUS=all fine\n" {
+		t.Errorf("invalid notification: %q", msg)
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	if systemd.NewNotifier() != nil {
+		t.Errorf("notifier created without socket")
+	}
+}
+
+// TestWatchdogInterval tests reading the watchdog settings.
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if i := systemd.WatchdogInterval(); i != 0 {
+		t.Errorf("unexpected watchdog interval: %v", i)
+	}
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if i := systemd.WatchdogInterval(); i != 30*time.Second {
+		t.Errorf("invalid watchdog interval: %v", i)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if i := systemd.WatchdogInterval(); i != 30*time.Second {
+		t.Errorf("invalid watchdog interval: %v", i)
+	}
+	os.Setenv("WATCHDOG_PID", "1")
+	if i := systemd.WatchdogInterval(); i != 0 {
+		t.Errorf("watchdog enabled for other process: %v", i)
+	}
+}
+
+// EOF